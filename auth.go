@@ -0,0 +1,144 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// An Authenticator implements one SOCKS5 authentication method: the sub-negotiation
+// that follows once the server selected Method. Private methods use codes 0x80 to 0xFE.
+// Both sides can return a conn wrapping the one they were given, for methods that
+// encapsulate the rest of the session.
+type Authenticator interface {
+	// Method returns the method code.
+	Method() byte
+	// ClientAuthenticate runs the client side of the sub-negotiation.
+	ClientAuthenticate(conn net.Conn) (net.Conn, error)
+	// ServerAuthenticate runs the server side of the sub-negotiation and returns the
+	// identity of the client, which may be empty.
+	ServerAuthenticate(conn net.Conn) (net.Conn, string, error)
+}
+
+// WithAuthenticators sets the authentication methods of a Socks5Client or Socks5Server,
+// in order of preference. Clients offer all of them; servers select the first one
+// the client offers. By default, servers only accept NoAuth, and clients offer NoAuth
+// and, if they were given a user, USERNAME/PASSWORD. An HTTPProxy takes the credentials
+// of a UserPassAuthenticator from the Proxy-Authorization header instead.
+func WithAuthenticators(authenticators ...Authenticator) Option {
+	return func(o *options) {
+		o.authenticators = append([]Authenticator(nil), authenticators...)
+	}
+}
+
+// NoAuth is the NO AUTHENTICATION REQUIRED method.
+var NoAuth Authenticator = noAuth{}
+
+type noAuth struct{}
+
+func (noAuth) Method() byte { return MethodNoAuth }
+
+func (noAuth) ClientAuthenticate(conn net.Conn) (net.Conn, error) { return conn, nil }
+
+func (noAuth) ServerAuthenticate(conn net.Conn) (net.Conn, string, error) { return conn, "", nil }
+
+// UserPassAuthenticator is the USERNAME/PASSWORD method (RFC 1929). Clients send Username
+// and Password. Servers accept the credentials Verify approves, or Username and Password
+// if Verify is nil, and report the username as the identity.
+type UserPassAuthenticator struct {
+	Username string
+	Password string
+	Verify   func(username, password string) bool
+}
+
+// Method returns MethodUserPass.
+func (a *UserPassAuthenticator) Method() byte { return MethodUserPass }
+
+// ClientAuthenticate sends the credentials and checks the server accepted them.
+func (a *UserPassAuthenticator) ClientAuthenticate(conn net.Conn) (net.Conn, error) {
+	auth := &UserPassAuth{Username: a.Username, Password: a.Password}
+	if _, err := auth.WriteTo(conn); err != nil {
+		return nil, errors.New("socks: failed to write password authentication request: " + err.Error())
+	}
+	var status UserPassAuthReply
+	if _, err := status.ReadFrom(conn); err != nil {
+		return nil, errors.New("socks: failed to read password authentication reply: " + err.Error())
+	}
+	// 0 indicates success
+	if status.Status != 0 {
+		return nil, errors.New("socks: SOCKS5 server reject username/password")
+	}
+	return conn, nil
+}
+
+// ServerAuthenticate reads the credentials and replies whether they are accepted.
+func (a *UserPassAuthenticator) ServerAuthenticate(conn net.Conn) (net.Conn, string, error) {
+	var auth UserPassAuth
+	if _, err := auth.ReadFrom(conn); err != nil {
+		return nil, "", errors.New("socks: failed to read password authentication request: " + err.Error())
+	}
+	if !a.verify(auth.Username, auth.Password) {
+		(&UserPassAuthReply{Status: 1}).WriteTo(conn)
+		return nil, "", errors.New("socks: invalid username or password for user " + strconv.Quote(auth.Username))
+	}
+	if _, err := (&UserPassAuthReply{Status: 0}).WriteTo(conn); err != nil {
+		return nil, "", err
+	}
+	return conn, auth.Username, nil
+}
+
+func (a *UserPassAuthenticator) verify(username, password string) bool {
+	if a.Verify != nil {
+		return a.Verify(username, password)
+	}
+	return subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+}
+
+// clientAuthenticate offers the methods of authenticators and runs the one the server selects.
+func clientAuthenticate(conn net.Conn, authenticators []Authenticator) (net.Conn, error) {
+	methods := &MethodSelection{}
+	for _, a := range authenticators {
+		methods.Methods = append(methods.Methods, a.Method())
+	}
+	if _, err := methods.WriteTo(conn); err != nil {
+		return nil, errors.New("socks: failed to write handshake request: " + err.Error())
+	}
+	var selected MethodSelectionReply
+	if _, err := selected.ReadFrom(conn); err != nil {
+		return nil, errors.New("socks: failed to read handshake reply: " + err.Error())
+	}
+	if selected.Method == MethodNoAcceptable {
+		return nil, errors.New("socks: no acceptable methods")
+	}
+	for _, a := range authenticators {
+		if a.Method() == selected.Method {
+			return a.ClientAuthenticate(conn)
+		}
+	}
+	return nil, errors.New("socks: server selected a method that wasn't offered: " + strconv.Itoa(int(selected.Method)))
+}
+
+// serverAuthenticate reads the methods the client offers, selects the first of
+// authenticators that is among them and runs it.
+func serverAuthenticate(conn net.Conn, authenticators []Authenticator) (net.Conn, string, error) {
+	var methods MethodSelection
+	if _, err := methods.ReadFrom(conn); err != nil {
+		(&MethodSelectionReply{Method: MethodNoAcceptable}).WriteTo(conn)
+		return nil, "", errors.New("socks: failed to read handshake request: " + err.Error())
+	}
+	for _, a := range authenticators {
+		for _, m := range methods.Methods {
+			if a.Method() != m {
+				continue
+			}
+			if _, err := (&MethodSelectionReply{Method: m}).WriteTo(conn); err != nil {
+				return nil, "", errors.New("socks: failed to write handshake reply: " + err.Error())
+			}
+			return a.ServerAuthenticate(conn)
+		}
+	}
+	(&MethodSelectionReply{Method: MethodNoAcceptable}).WriteTo(conn)
+	return nil, "", errors.New("socks: no acceptable methods")
+}
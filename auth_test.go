@@ -0,0 +1,95 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+// tokenAuth is a private method that sends a fixed-size token.
+type tokenAuth struct {
+	token string
+}
+
+func (a tokenAuth) Method() byte { return 0x80 }
+
+func (a tokenAuth) ClientAuthenticate(conn net.Conn) (net.Conn, error) {
+	_, err := io.WriteString(conn, a.token)
+	return conn, err
+}
+
+func (a tokenAuth) ServerAuthenticate(conn net.Conn) (net.Conn, string, error) {
+	token := make([]byte, len(a.token))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return nil, "", err
+	}
+	if string(token) != a.token {
+		return nil, "", errors.New("bad token")
+	}
+	return conn, "token-user", nil
+}
+
+func TestSocks5Authenticators(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	users := make(chan string, 1)
+	connect := ConnectHandler(Direct)
+	server, err := NewSocks5Server(nil,
+		WithAuthenticators(tokenAuth{"secret"}, &UserPassAuthenticator{
+			Verify: func(username, password string) bool {
+				return username == "alice" && password == "pw" || username == "bob" && password == ""
+			},
+		}),
+		WithHandler(Socks5HandlerFunc(func(r *Socks5Request) {
+			users <- r.User
+			connect.ServeSocks5(r)
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	tests := []struct {
+		user, password string
+		opts           []Option
+		identity       string
+		err            string
+	}{
+		{"", "", []Option{WithAuthenticators(NoAuth, tokenAuth{"secret"})}, "token-user", ""},
+		{"alice", "pw", nil, "alice", ""},
+		{"alice", "wrong", nil, "", "reject username/password"},
+		{"bob", "", nil, "bob", ""},
+		{"", "", nil, "", "no acceptable methods"},
+	}
+	for _, test := range tests {
+		client, err := NewSocks5Client("tcp", listener.Addr().String(), test.user, test.password, Direct, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := client.Dial("tcp", echo.Addr())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("user %q: got %v, want %q", test.user, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("user %q: %v", test.user, err)
+		}
+		if identity := <-users; identity != test.identity {
+			t.Errorf("user %q: server got identity %q, want %q", test.user, identity, test.identity)
+		}
+		sockstest.AssertEcho(t, conn, 10)
+		conn.Close()
+	}
+}
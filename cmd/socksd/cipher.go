@@ -119,6 +119,16 @@ func (c *Chacha20Cipher) Write(p []byte) (n int, err error) {
 	return c.StreamWriter.Write(p)
 }
 
+func (c *Chacha20Cipher) Close() error {
+	if c.StreamWriter != nil {
+		c.StreamWriter.Close()
+	}
+	if c.rwc != nil {
+		c.rwc.Close()
+	}
+	return nil
+}
+
 type DESCFBCipher struct {
 	block cipher.Block
 	rwc   io.ReadWriteCloser
@@ -25,6 +25,16 @@ func (c *CipherConn) Close() error {
 	return err
 }
 
+// Prepare writes the IV of the cipher, if it has one, ahead of the first write, so that
+// connections waiting in a warm pool only have the payload left to write.
+func (c *CipherConn) Prepare() error {
+	if c.rwc == c.Conn {
+		return nil
+	}
+	_, err := c.rwc.Write(nil)
+	return err
+}
+
 func NewCipherConn(conn net.Conn, cryptMethod string, password []byte) (*CipherConn, error) {
 	var rwc io.ReadWriteCloser
 	var err error
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCipherConnPrepare(t *testing.T) {
+	for _, method := range []string{"rc4", "des", "aes-128-cfb", "aes-256-cfb", "chacha20", ""} {
+		password := []byte("password")
+		client, server := net.Pipe()
+		clientConn, err := NewCipherConn(client, method, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, err := NewCipherConn(server, method, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The IV goes out with Prepare, and not again with the first write.
+		done := make(chan error, 1)
+		go func() {
+			if err := clientConn.Prepare(); err != nil {
+				done <- err
+				return
+			}
+			_, err := clientConn.Write([]byte("hello"))
+			done <- err
+		}()
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(serverConn, b); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if string(b) != "hello" {
+			t.Errorf("%s: got %q, want hello", method, b)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
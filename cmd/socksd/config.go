@@ -1,15 +1,64 @@
 package main
 
 import (
-	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 )
 
 type Upstream struct {
-	Type     string `json:"type"`
-	Crypto   string `json:"crypto"`
-	Password string `json:"password"`
-	Address  string `json:"address"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Crypto     string     `json:"crypto"`
+	Password   string     `json:"password" config:"secret"`
+	Address    string     `json:"address"`
+	Resolve    string     `json:"resolve"`
+	TLS        bool       `json:"tls"`
+	CA         string     `json:"ca"`
+	Cert       string     `json:"cert"`
+	Key        string     `json:"key"`
+	ServerName string     `json:"serverName"`
+	Pins       []string   `json:"pins"`
+	WebSocket  *WebSocket `json:"websocket"`
+	Mux        *Mux       `json:"mux"`
+	Pool       *Pool      `json:"pool"`
+}
+
+type WebSocket struct {
+	Path string `json:"path"`
+	Host string `json:"host"`
+}
+
+type Mux struct {
+	Sessions  int `json:"sessions"`
+	KeepAlive int `json:"keepAlive"`
+}
+
+type Pool struct {
+	Size    int `json:"size"`
+	MaxIdle int `json:"maxIdle"`
+}
+
+type HealthCheck struct {
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+	Probe    string `json:"probe"`
+	Failures int    `json:"failures"`
+	Cooldown int    `json:"cooldown"`
+}
+
+type DNS struct {
+	Address   string   `json:"address"`
+	Servers   []string `json:"servers"`
+	Direct    []string `json:"direct"`
+	Rules     string   `json:"rules"`
+	CacheSize int      `json:"cacheSize"`
+	FakeIP    *FakeIP  `json:"fakeIP"`
+}
+
+type FakeIP struct {
+	Range string `json:"range"`
+	File  string `json:"file"`
 }
 
 type PAC struct {
@@ -21,29 +70,116 @@ type PAC struct {
 	Upstream    Upstream `json:"upstream"`
 }
 
+type RateLimit struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Burst    int64 `json:"burst"`
+}
+
+type ConnLimit struct {
+	MaxSessions      int   `json:"maxSessions"`
+	MaxSessionsPerIP int   `json:"maxSessionsPerIP"`
+	AcceptRate       int64 `json:"acceptRate"`
+	AcceptBurst      int64 `json:"acceptBurst"`
+}
+
 type Proxy struct {
-	HTTP            string     `json:"http"`
-	SOCKS4          string     `json:"socks4"`
-	SOCKS5          string     `json:"socks5"`
-	Crypto          string     `json:"crypto"`
-	Password        string     `json:"password"`
-	DNSCacheTimeout int        `json:"dnsCacheTimeout"`
-	Upstreams       []Upstream `json:"upstreams"`
+	HTTP            string               `json:"http"`
+	SOCKS4          string               `json:"socks4"`
+	SOCKS5          string               `json:"socks5"`
+	Redir           string               `json:"redir"`
+	TProxy          bool                 `json:"tproxy"`
+	Crypto          string               `json:"crypto"`
+	Password        string               `json:"password" config:"secret"`
+	DNSCacheTimeout int                  `json:"dnsCacheTimeout"`
+	Upstreams       []Upstream           `json:"upstreams"`
+	HealthCheck     *HealthCheck         `json:"healthCheck"`
+	Attempts        int                  `json:"attempts"`
+	RateLimit       RateLimit            `json:"rateLimit"`
+	ConnRateLimit   RateLimit            `json:"connRateLimit"`
+	UserRateLimits  map[string]RateLimit `json:"userRateLimits"`
+	ConnLimit       ConnLimit            `json:"connLimit"`
+	Users           map[string]string    `json:"users" config:"secret"`
+	TLS             bool                 `json:"tls"`
+	Cert            string               `json:"cert"`
+	Key             string               `json:"key"`
+	ClientCA        string               `json:"clientCA"`
+	CRL             string               `json:"crl"`
+	WebSocket       *WebSocket           `json:"websocket"`
+	Mux             *Mux                 `json:"mux"`
+	DNS             *DNS                 `json:"dns"`
+	Bind            []string             `json:"bind"`
+}
+
+type Forward struct {
+	Listen   string `json:"listen"`
+	Target   string `json:"target"`
+	Upstream string `json:"upstream"`
+	Network  string `json:"network"`
+}
+
+type Reverse struct {
+	Remote   string `json:"remote"`
+	Target   string `json:"target"`
+	Upstream string `json:"upstream"`
+}
+
+type Log struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
 }
 
 type Config struct {
-	PAC     PAC     `json:"pac"`
-	Proxies []Proxy `json:"proxies"`
+	Log          Log        `json:"log"`
+	PAC          PAC        `json:"pac"`
+	Proxies      []Proxy    `json:"proxies"`
+	Upstreams    []Upstream `json:"upstreams"`
+	Forwards     []Forward  `json:"forwards"`
+	Reverses     []Reverse  `json:"reverses"`
+	RateLimit    RateLimit  `json:"rateLimit"`
+	ConnLimit    ConnLimit  `json:"connLimit"`
+	Metrics      string     `json:"metrics"`
+	DrainTimeout int        `json:"drainTimeout"`
 }
 
-func LoadConfig(s string) (*Config, error) {
+// LoadConfig reads the config file s, checked by ParseConfig. format is json, yaml or
+// toml, or empty to choose by the extension of s, json by default.
+func LoadConfig(s, format string) (*Config, error) {
 	data, err := ioutil.ReadFile(s)
 	if err != nil {
 		return nil, err
 	}
-	cfgGroup := &Config{}
-	if err = json.Unmarshal(data, cfgGroup); err != nil {
-		return nil, err
+	if format == "" {
+		format = ConfigFormat(s)
+	}
+	return ParseConfig(data, format)
+}
+
+// ConfigFormat returns the format of the config file s by its extension.
+func ConfigFormat(s string) string {
+	switch strings.ToLower(filepath.Ext(s)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// FindUpstream returns the upstream named name, looked up in the upstreams of the
+// config, then in those of the proxies.
+func (c *Config) FindUpstream(name string) (Upstream, bool) {
+	for _, upstream := range c.Upstreams {
+		if upstream.Name == name {
+			return upstream, true
+		}
+	}
+	for _, proxy := range c.Proxies {
+		for _, upstream := range proxy.Upstreams {
+			if upstream.Name == name {
+				return upstream, true
+			}
+		}
 	}
-	return cfgGroup, nil
+	return Upstream{}, false
 }
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+// ConfigError is a problem with the value at Path in a config, a JSON path like
+// proxies[0].upstreams[1].crypto.
+type ConfigError struct {
+	Path string
+	Err  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Err
+	}
+	return e.Path + ": " + e.Err
+}
+
+// ConfigErrors lists the problems found in a config, one per line.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for n, err := range e {
+		lines[n] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseConfig decodes data, in format json, yaml or toml, strictly: fields must be
+// spelled as documented, with their case, and the values must make sense. The strings
+// of the config are expanded by expandEnv. A secret field like password can be read
+// from a file named by password_file instead, and the passwords of users from files
+// named by name_file. All the problems found are returned as ConfigErrors.
+func ParseConfig(data []byte, format string) (*Config, error) {
+	raw, err := decodeConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+	var checker configChecker
+	raw = checker.expand("", raw)
+	checker.checkFields("", raw, reflect.TypeOf(Config{}))
+	if len(checker.errs) != 0 {
+		return nil, checker.errs
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, jsonError(data, err)
+	}
+	if errs := ValidateConfig(conf); len(errs) != 0 {
+		return nil, errs
+	}
+	return conf, nil
+}
+
+// decodeConfig decodes data into maps, slices and scalars, like encoding/json does.
+func decodeConfig(data []byte, format string) (interface{}, error) {
+	var raw interface{}
+	var err error
+	switch strings.ToLower(format) {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err = decoder.Decode(&raw); err != nil {
+			return nil, jsonError(data, err)
+		}
+		if _, err = decoder.Token(); err != io.EOF {
+			return nil, ConfigErrors{{Err: "unexpected data after the top-level value"}}
+		}
+		return raw, nil
+	case "yaml":
+		raw, err = parseYAML(data)
+	case "toml":
+		raw, err = parseTOML(data)
+	default:
+		return nil, errors.New("unknown config format " + format + ", want json, yaml or toml")
+	}
+	if err, ok := err.(*syntaxError); ok {
+		return nil, ConfigErrors{{Path: "line " + strconv.Itoa(err.line), Err: err.msg}}
+	}
+	return raw, err
+}
+
+// plainValue returns value, decoded by the YAML or TOML parsers, with the types that
+// encoding/json decodes to: maps keyed by strings, []interface{} for arrays, and
+// strings for dates, in RFC 3339, and for the numbers JSON can't hold.
+func plainValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, element := range value {
+			value[key] = plainValue(element)
+		}
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			object[fmt.Sprint(key)] = plainValue(element)
+		}
+		return object
+	case []interface{}:
+		for n, element := range value {
+			value[n] = plainValue(element)
+		}
+	case []map[string]interface{}:
+		array := make([]interface{}, len(value))
+		for n, element := range value {
+			array[n] = plainValue(element)
+		}
+		return array
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return strconv.FormatFloat(value, 'g', -1, 64)
+		}
+	case time.Time:
+		// The TOML parser marks local dates and times by the names of their zones.
+		switch value.Location().String() {
+		case "date-local":
+			return value.Format("2006-01-02")
+		case "time-local":
+			return value.Format("15:04:05.999999999")
+		case "datetime-local":
+			return value.Format("2006-01-02T15:04:05.999999999")
+		}
+		return value.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return value.String()
+	}
+	return value
+}
+
+// syntaxError is an error of the YAML or TOML parsers at a line of the input.
+type syntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *syntaxError) Error() string {
+	return "line " + strconv.Itoa(e.line) + ": " + e.msg
+}
+
+// expand expands the environment variables in the strings of value.
+func (c *configChecker) expand(path string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		expanded, err := expandEnv(value)
+		if err != nil {
+			c.fail(path, err.Error())
+		}
+		return expanded
+	case []interface{}:
+		for n, element := range value {
+			value[n] = c.expand(index(path, n), element)
+		}
+	case map[string]interface{}:
+		for _, key := range sortedKeys(value) {
+			value[key] = c.expand(joinPath(path, key), value[key])
+		}
+	}
+	return value
+}
+
+// expandEnv replaces each ${NAME} in s by the value of the environment variable NAME,
+// which must be set. $${ stands for a literal ${.
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i] + "{")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", errors.New("missing } after ${")
+		}
+		name := s[i+2 : i+end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		b.WriteString(s[:i] + value)
+		s = s[i+end+1:]
+	}
+}
+
+// readSecretFile replaces the field name_file of object, for a secret field name, by
+// name set to the contents of the file, without its trailing newlines.
+func (c *configChecker) readSecretFile(path string, object map[string]interface{}, name string) {
+	key := name + "_file"
+	file, ok := object[key].(string)
+	delete(object, key)
+	if !ok {
+		c.fail(joinPath(path, key), "want a file name")
+		return
+	}
+	if _, ok := object[name]; ok {
+		c.fail(joinPath(path, key), "set either "+name+" or "+key)
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.fail(joinPath(path, key), err.Error())
+		return
+	}
+	object[name] = strings.TrimRight(string(data), "\r\n")
+}
+
+// jsonError turns the syntax and type errors of encoding/json into a ConfigError,
+// located by line, or by path for type errors.
+func jsonError(data []byte, err error) error {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset := err.Offset
+		if offset > int64(len(data)) {
+			offset = int64(len(data))
+		}
+		line := bytes.Count(data[:offset], []byte("\n")) + 1
+		return ConfigErrors{{Path: "line " + strconv.Itoa(line), Err: err.Error()}}
+	case *json.UnmarshalTypeError:
+		var path string
+		for _, key := range strings.Split(err.Field, ".") {
+			if n, convErr := strconv.Atoi(key); convErr == nil {
+				path = index(path, n)
+			} else {
+				path = joinPath(path, key)
+			}
+		}
+		return ConfigErrors{{Path: path, Err: "want " + err.Type.String() + ", not " + err.Value}}
+	}
+	return err
+}
+
+// ValidateConfig returns the problems of conf that decoding doesn't catch.
+func ValidateConfig(conf *Config) ConfigErrors {
+	var checker configChecker
+	checker.checkConfig(conf)
+	return checker.errs
+}
+
+type configChecker struct {
+	errs      ConfigErrors
+	listeners []configListener
+}
+
+// configListener is an address listened on, to find those listened on twice.
+type configListener struct {
+	path    string
+	network string
+	host    string
+	port    string
+}
+
+func (c *configChecker) fail(path, err string) {
+	c.errs = append(c.errs, &ConfigError{Path: path, Err: err})
+}
+
+// checkFields checks that the objects of value only have the fields of typ, matching
+// the JSON names exactly, while encoding/json would ignore or case-fold them. It reads
+// the files of secret fields, and of the values of secret maps.
+func (c *configChecker) checkFields(path string, value interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		secrets := make(map[string]bool)
+		for n := 0; n < typ.NumField(); n++ {
+			field := typ.Field(n)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = field.Type
+			secrets[name] = field.Tag.Get("config") == "secret"
+		}
+		for _, key := range sortedKeys(object) {
+			fieldPath := joinPath(path, key)
+			if name := strings.TrimSuffix(key, "_file"); name != key && secrets[name] && fields[name].Kind() == reflect.String {
+				c.readSecretFile(path, object, name)
+				continue
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				c.fail(fieldPath, "unknown field"+suggestField(key, fields))
+				continue
+			}
+			if values, ok := object[key].(map[string]interface{}); ok && secrets[key] {
+				for _, name := range sortedKeys(values) {
+					if strings.HasSuffix(name, "_file") {
+						c.readSecretFile(fieldPath, values, strings.TrimSuffix(name, "_file"))
+					}
+				}
+			}
+			c.checkFields(fieldPath, object[key], fieldType)
+		}
+	case reflect.Slice:
+		if array, ok := value.([]interface{}); ok {
+			for n, element := range array {
+				c.checkFields(index(path, n), element, typ.Elem())
+			}
+		}
+	case reflect.Map:
+		if object, ok := value.(map[string]interface{}); ok {
+			for _, key := range sortedKeys(object) {
+				c.checkFields(joinPath(path, key), object[key], typ.Elem())
+			}
+		}
+	}
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// suggestField returns a hint naming the field key was likely meant to be.
+func suggestField(key string, fields map[string]reflect.Type) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(s))
+	}
+	for name := range fields {
+		if normalize(name) == normalize(key) {
+			return ", did you mean " + strconv.Quote(name) + "?"
+		}
+	}
+	return ""
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func index(path string, n int) string {
+	return path + "[" + strconv.Itoa(n) + "]"
+}
+
+func (c *configChecker) checkConfig(conf *Config) {
+	if _, err := ParseLogLevel(conf.Log.Level); err != nil {
+		c.fail("log.level", err.Error())
+	}
+	if _, err := NewLogger(nil, LevelInfo, conf.Log.Format); err != nil {
+		c.fail("log.format", err.Error())
+	}
+	c.checkListen("metrics", "tcp", conf.Metrics)
+	c.checkPAC("pac", conf.PAC)
+
+	names := make(map[string]string)
+	checkName := func(path string, upstream Upstream) {
+		if upstream.Name == "" {
+			return
+		}
+		if other, ok := names[upstream.Name]; ok {
+			c.fail(path+".name", "upstream name "+strconv.Quote(upstream.Name)+" is also used by "+other)
+			return
+		}
+		names[upstream.Name] = path
+	}
+	for n, upstream := range conf.Upstreams {
+		path := index("upstreams", n)
+		c.checkUpstream(path, upstream)
+		checkName(path, upstream)
+	}
+	for n, proxy := range conf.Proxies {
+		path := index("proxies", n)
+		c.checkProxy(path, proxy)
+		for m, upstream := range proxy.Upstreams {
+			checkName(index(path+".upstreams", m), upstream)
+		}
+	}
+	for n, forward := range conf.Forwards {
+		c.checkForward(conf, index("forwards", n), forward)
+	}
+	for n, reverse := range conf.Reverses {
+		c.checkReverse(conf, index("reverses", n), reverse)
+	}
+	c.checkRateLimit("rateLimit", conf.RateLimit)
+	c.checkConnLimit("connLimit", conf.ConnLimit)
+	if conf.DrainTimeout < 0 {
+		c.fail("drainTimeout", "must not be negative")
+	}
+}
+
+func (c *configChecker) checkPAC(path string, pac PAC) {
+	c.checkListen(path+".address", "tcp", pac.Address)
+	c.checkAddress(path+".proxy", pac.Proxy, false)
+	c.checkAddress(path+".socks5", pac.SOCKS5, false)
+	if pac.RemoteRules != "" {
+		c.checkUpstream(path+".upstream", pac.Upstream)
+	}
+}
+
+func (c *configChecker) checkProxy(path string, proxy Proxy) {
+	c.checkListen(path+".http", "tcp", proxy.HTTP)
+	c.checkListen(path+".socks4", "tcp", proxy.SOCKS4)
+	c.checkListen(path+".socks5", "tcp", proxy.SOCKS5)
+	c.checkListen(path+".redir", "tcp", proxy.Redir)
+	if proxy.TProxy {
+		if proxy.Redir == "" {
+			c.fail(path+".tproxy", "tproxy requires redir")
+		}
+		c.checkListen(path+".redir", "udp", proxy.Redir)
+	}
+	if proxy.HTTP == "" && proxy.SOCKS4 == "" && proxy.SOCKS5 == "" && proxy.Redir == "" && proxy.DNS == nil {
+		c.fail(path, "no listen address: set http, socks4, socks5, redir or dns")
+	}
+	c.checkCrypto(path, proxy.Crypto, proxy.Password)
+	if proxy.DNSCacheTimeout < 0 {
+		c.fail(path+".dnsCacheTimeout", "must not be negative")
+	}
+	for n, upstream := range proxy.Upstreams {
+		c.checkUpstream(index(path+".upstreams", n), upstream)
+	}
+	c.checkHealthCheck(path+".healthCheck", proxy.HealthCheck)
+	if proxy.Attempts < 0 {
+		c.fail(path+".attempts", "must not be negative")
+	}
+	c.checkRateLimit(path+".rateLimit", proxy.RateLimit)
+	c.checkRateLimit(path+".connRateLimit", proxy.ConnRateLimit)
+	for user, limit := range proxy.UserRateLimits {
+		c.checkRateLimit(joinPath(path+".userRateLimits", user), limit)
+	}
+	c.checkConnLimit(path+".connLimit", proxy.ConnLimit)
+	for user := range proxy.Users {
+		if user == "" || len(user) > 255 || len(proxy.Users[user]) > 255 {
+			c.fail(joinPath(path+".users", user), "user names must have 1 to 255 bytes, and passwords at most 255")
+		}
+	}
+	if len(proxy.Users) != 0 && proxy.SOCKS4 != "" {
+		c.fail(path+".socks4", "SOCKS4 can't authenticate users, so it can't be set with users")
+	}
+	if proxy.TLS && (proxy.Cert == "" || proxy.Key == "") {
+		c.fail(path+".tls", "tls requires cert and key")
+	}
+	if proxy.CRL != "" && proxy.ClientCA == "" {
+		c.fail(path+".crl", "crl requires clientCA")
+	}
+	if proxy.WebSocket != nil || proxy.Mux != nil {
+		if proxy.SOCKS4 == "" && proxy.SOCKS5 == "" {
+			c.fail(path, "websocket and mux require socks4 or socks5")
+		}
+	}
+	c.checkMux(path+".mux", proxy.Mux)
+	if proxy.DNS != nil {
+		c.checkDNS(path+".dns", *proxy.DNS)
+	}
+	for n, address := range proxy.Bind {
+		c.checkAddress(index(path+".bind", n), address, true)
+	}
+	if len(proxy.Bind) != 0 && proxy.SOCKS5 == "" {
+		c.fail(path+".bind", "bind requires socks5")
+	}
+}
+
+func (c *configChecker) checkDNS(path string, dns DNS) {
+	if dns.Address == "" {
+		c.fail(path+".address", "missing address")
+	}
+	c.checkListen(path+".address", "tcp", dns.Address)
+	c.checkListen(path+".address", "udp", dns.Address)
+	for n, server := range dns.Servers {
+		c.checkAddress(index(path+".servers", n), server, false)
+	}
+	for n, server := range dns.Direct {
+		c.checkAddress(index(path+".direct", n), server, false)
+	}
+	if dns.Rules != "" && len(dns.Direct) == 0 {
+		c.fail(path+".rules", "rules require direct servers")
+	}
+	if dns.CacheSize < 0 {
+		c.fail(path+".cacheSize", "must not be negative")
+	}
+	if dns.FakeIP != nil && dns.FakeIP.Range != "" {
+		_, network, err := net.ParseCIDR(dns.FakeIP.Range)
+		if err != nil {
+			c.fail(path+".fakeIP.range", err.Error())
+		} else if ones, bits := network.Mask.Size(); bits != 32 || ones > 30 {
+			c.fail(path+".fakeIP.range", "must be an IPv4 network of at least 4 addresses")
+		}
+	}
+}
+
+func (c *configChecker) checkUpstream(path string, upstream Upstream) {
+	upstreamType := strings.ToLower(upstream.Type)
+	switch upstreamType {
+	case "socks5", "shadowsocks":
+	case "":
+		c.fail(path+".type", "missing type, socks5 or shadowsocks")
+	default:
+		c.fail(path+".type", "unknown upstream type "+strconv.Quote(upstream.Type)+", want socks5 or shadowsocks")
+	}
+	if upstream.Address == "" {
+		c.fail(path+".address", "missing address")
+	}
+	c.checkAddress(path+".address", upstream.Address, false)
+	c.checkCrypto(path, upstream.Crypto, upstream.Password)
+	if _, err := socks.ParseResolvePolicy(upstream.Resolve); err != nil {
+		c.fail(path+".resolve", strings.TrimPrefix(err.Error(), "socks: "))
+	}
+	if upstream.TLS && upstream.WebSocket == nil && upstream.Mux == nil && upstreamType == "shadowsocks" {
+		c.fail(path+".tls", "tls is not supported by shadowsocks upstreams, except over websocket or mux")
+	}
+	if upstream.TLS && (upstream.Cert == "") != (upstream.Key == "") {
+		c.fail(path+".cert", "cert and key go together")
+	}
+	if upstream.Pool != nil && upstream.Mux != nil {
+		c.fail(path+".pool", "pool and mux can't be combined")
+	}
+	if upstream.Pool != nil && (upstream.Pool.Size < 0 || upstream.Pool.MaxIdle < 0) {
+		c.fail(path+".pool", "size and maxIdle must not be negative")
+	}
+	c.checkMux(path+".mux", upstream.Mux)
+}
+
+func (c *configChecker) checkMux(path string, mux *Mux) {
+	if mux != nil && (mux.Sessions < 0 || mux.KeepAlive < 0) {
+		c.fail(path, "sessions and keepAlive must not be negative")
+	}
+}
+
+func (c *configChecker) checkForward(conf *Config, path string, forward Forward) {
+	switch forward.Network {
+	case "", "tcp", "udp":
+	default:
+		c.fail(path+".network", "unknown network "+strconv.Quote(forward.Network)+", want tcp or udp")
+	}
+	network := forward.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if forward.Listen == "" {
+		c.fail(path+".listen", "missing address")
+	}
+	c.checkListen(path+".listen", network, forward.Listen)
+	if forward.Target == "" {
+		c.fail(path+".target", "missing address")
+	}
+	c.checkAddress(path+".target", forward.Target, false)
+	if forward.Upstream != "" {
+		if _, ok := conf.FindUpstream(forward.Upstream); !ok {
+			c.fail(path+".upstream", "unknown upstream "+strconv.Quote(forward.Upstream))
+		} else if network == "udp" {
+			c.fail(path+".upstream", "udp can't go through shadowsocks or socks5 upstreams")
+		}
+	}
+}
+
+func (c *configChecker) checkReverse(conf *Config, path string, reverse Reverse) {
+	if reverse.Remote == "" {
+		c.fail(path+".remote", "missing address")
+	}
+	c.checkAddress(path+".remote", reverse.Remote, true)
+	if reverse.Target == "" {
+		c.fail(path+".target", "missing address")
+	}
+	c.checkAddress(path+".target", reverse.Target, false)
+	upstream, ok := conf.FindUpstream(reverse.Upstream)
+	if reverse.Upstream == "" || !ok {
+		c.fail(path+".upstream", "unknown upstream "+strconv.Quote(reverse.Upstream))
+	} else if strings.ToLower(upstream.Type) != "socks5" {
+		c.fail(path+".upstream", "reverse forwards need a socks5 upstream")
+	}
+}
+
+func (c *configChecker) checkHealthCheck(path string, check *HealthCheck) {
+	if check == nil {
+		return
+	}
+	if check.Interval < 0 || check.Timeout < 0 || check.Failures < 0 || check.Cooldown < 0 {
+		c.fail(path, "interval, timeout, failures and cooldown must not be negative")
+	}
+	if check.Probe != "" {
+		u, err := url.Parse(check.Probe)
+		if err != nil {
+			c.fail(path+".probe", err.Error())
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.fail(path+".probe", "want an http or https URL")
+		}
+	}
+}
+
+func (c *configChecker) checkRateLimit(path string, limit RateLimit) {
+	if limit.Upload < 0 || limit.Download < 0 || limit.Burst < 0 {
+		c.fail(path, "upload, download and burst must not be negative")
+	}
+}
+
+func (c *configChecker) checkConnLimit(path string, limit ConnLimit) {
+	if limit.MaxSessions < 0 || limit.MaxSessionsPerIP < 0 || limit.AcceptRate < 0 || limit.AcceptBurst < 0 {
+		c.fail(path, "limits must not be negative")
+	}
+}
+
+// checkCrypto checks the crypto method of path, and that password makes a key for it.
+func (c *configChecker) checkCrypto(path, crypto, password string) {
+	switch strings.ToLower(crypto) {
+	case "":
+		if password != "" {
+			c.fail(path+".password", "password requires crypto")
+		}
+		return
+	case "des":
+		if len(password) != 8 {
+			c.fail(path+".password", "des needs a password of 8 bytes, not "+strconv.Itoa(len(password)))
+		}
+		return
+	case "rc4":
+		if len(password) > 256 {
+			c.fail(path+".password", "rc4 needs a password of 1 to 256 bytes, not "+strconv.Itoa(len(password)))
+			return
+		}
+	case "aes-128-cfb", "aes-192-cfb", "aes-256-cfb", "chacha20":
+	default:
+		c.fail(path+".crypto", "unknown crypto method "+strconv.Quote(crypto)+
+			", want rc4, des, aes-128-cfb, aes-192-cfb, aes-256-cfb or chacha20")
+		return
+	}
+	if password == "" {
+		c.fail(path+".password", "missing password for "+crypto)
+	}
+}
+
+// checkAddress checks that address is a host and port, if set. An empty host is only
+// allowed for addresses listened on.
+func (c *configChecker) checkAddress(path, address string, listen bool) (host, port string, ok bool) {
+	if address == "" {
+		return "", "", false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		c.fail(path, "invalid address "+strconv.Quote(address)+", want host:port")
+		return "", "", false
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			c.fail(path, "invalid port "+strconv.Quote(port))
+			return "", "", false
+		}
+	}
+	if host == "" && !listen {
+		c.fail(path, "missing host in "+strconv.Quote(address))
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// checkListen checks an address listened on, and that no other listener of the config
+// uses its port.
+func (c *configChecker) checkListen(path, network, address string) {
+	host, port, ok := c.checkAddress(path, address, true)
+	if !ok || port == "0" {
+		return
+	}
+	if n, err := net.LookupPort(network, port); err == nil {
+		port = strconv.Itoa(n)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	for _, other := range c.listeners {
+		if other.network == network && other.port == port && (other.host == host || other.host == "" || host == "") {
+			c.fail(path, network+" port "+port+" is also used by "+other.path)
+			return
+		}
+	}
+	c.listeners = append(c.listeners, configListener{path: path, network: network, host: host, port: port})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configErrors returns the lines of the error of parsing data as JSON.
+func configErrors(t *testing.T, data string) []string {
+	t.Helper()
+	_, err := ParseConfig([]byte(data), "json")
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(ConfigErrors); !ok {
+		t.Fatalf("got %T %v, want ConfigErrors", err, err)
+	}
+	return strings.Split(err.Error(), "\n")
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			"syntax",
+			"{\n\"proxies\": [\n{\"socks5\": }\n]}",
+			[]string{"line 3: invalid character '}' looking for beginning of value"},
+		},
+		{
+			"trailing data",
+			`{} {}`,
+			[]string{"unexpected data after the top-level value"},
+		},
+		{
+			"type",
+			`{"proxies": [{"socks5": ":1080", "connLimit": {"maxSessions": "10"}}]}`,
+			[]string{"proxies[0].connLimit.maxSessions: want int, not string"},
+		},
+		{
+			"unknown fields",
+			`{"proxies": [{"socks5": ":1080", "dnscachetimeout": 1, "colour": 2}]}`,
+			[]string{
+				"proxies[0].colour: unknown field",
+				`proxies[0].dnscachetimeout: unknown field, did you mean "dnsCacheTimeout"?`,
+			},
+		},
+		{
+			"log",
+			`{"log": {"level": "loud", "format": "xml"}}`,
+			[]string{"log.level: ", "log.format: "},
+		},
+		{
+			"drain timeout",
+			`{"drainTimeout": -1}`,
+			[]string{"drainTimeout: must not be negative"},
+		},
+		{
+			"addresses",
+			`{"metrics": "9100", "pac": {"address": ":99999", "proxy": ":8080"}}`,
+			[]string{
+				`metrics: invalid address "9100", want host:port`,
+				`pac.address: invalid port "99999"`,
+				`pac.proxy: missing host in ":8080"`,
+			},
+		},
+		{
+			"shared ports",
+			`{"pac": {"address": ":8080"}, "proxies": [{"http": "127.0.0.1:8080", "socks5": "10.0.0.1:1080", "socks4": "10.0.0.2:1080"}],
+			 "forwards": [{"listen": ":1080", "target": "example.com:80", "network": "udp"}]}`,
+			[]string{"proxies[0].http: tcp port 8080 is also used by pac.address"},
+		},
+		{
+			"proxy",
+			`{"proxies": [{"tproxy": true, "tls": true, "crl": "crl.pem", "websocket": {}, "bind": [":22"], "users": {"": "x"}, "dnsCacheTimeout": -1}]}`,
+			[]string{
+				"proxies[0].tproxy: tproxy requires redir",
+				"proxies[0]: no listen address: set http, socks4, socks5, redir or dns",
+				"proxies[0].dnsCacheTimeout: must not be negative",
+				"proxies[0].users.: user names must have 1 to 255 bytes, and passwords at most 255",
+				"proxies[0].tls: tls requires cert and key",
+				"proxies[0].crl: crl requires clientCA",
+				"proxies[0]: websocket and mux require socks4 or socks5",
+				"proxies[0].bind: bind requires socks5",
+			},
+		},
+		{
+			"users with socks4",
+			`{"proxies": [{"socks4": ":1", "http": ":2", "users": {"user": "secret"}}]}`,
+			[]string{"proxies[0].socks4: SOCKS4 can't authenticate users, so it can't be set with users"},
+		},
+		{
+			"crypto",
+			`{"proxies": [{"socks5": ":1", "crypto": "des", "password": "short"}, {"socks5": ":2", "password": "x"},
+			 {"socks5": ":3", "crypto": "rot13"}, {"socks5": ":4", "crypto": "aes-256-cfb"}]}`,
+			[]string{
+				"proxies[0].password: des needs a password of 8 bytes, not 5",
+				"proxies[1].password: password requires crypto",
+				`proxies[2].crypto: unknown crypto method "rot13", want rc4, des, aes-128-cfb, aes-192-cfb, aes-256-cfb or chacha20`,
+				"proxies[3].password: missing password for aes-256-cfb",
+			},
+		},
+		{
+			"upstreams",
+			`{"upstreams": [{"name": "a", "type": "http", "address": "host"}, {"name": "a", "type": "shadowsocks", "address": "h:1",
+			  "crypto": "rc4", "password": "p", "tls": true, "resolve": "sometimes", "pool": {"size": -1}},
+			  {}, {"type": "socks5", "address": "h:2", "pool": {}, "mux": {}}]}`,
+			[]string{
+				`upstreams[0].type: unknown upstream type "http", want socks5 or shadowsocks`,
+				`upstreams[0].address: invalid address "host", want host:port`,
+				"upstreams[1].resolve: unknown resolve policy sometimes",
+				"upstreams[1].tls: tls is not supported by shadowsocks upstreams, except over websocket or mux",
+				"upstreams[1].pool: size and maxIdle must not be negative",
+				`upstreams[1].name: upstream name "a" is also used by upstreams[0]`,
+				"upstreams[2].type: missing type, socks5 or shadowsocks",
+				"upstreams[2].address: missing address",
+				"upstreams[3].pool: pool and mux can't be combined",
+			},
+		},
+		{
+			"dns",
+			`{"proxies": [{"dns": {"servers": ["8.8.8.8"], "rules": "rules.txt", "cacheSize": -1, "fakeIP": {"range": "10.0.0.0/31"}}}]}`,
+			[]string{
+				"proxies[0].dns.address: missing address",
+				`proxies[0].dns.servers[0]: invalid address "8.8.8.8", want host:port`,
+				"proxies[0].dns.rules: rules require direct servers",
+				"proxies[0].dns.cacheSize: must not be negative",
+				"proxies[0].dns.fakeIP.range: must be an IPv4 network of at least 4 addresses",
+			},
+		},
+		{
+			"health check",
+			`{"proxies": [{"socks5": ":1", "healthCheck": {"interval": -1, "probe": "ftp://example.com"}, "attempts": -1}]}`,
+			[]string{
+				"proxies[0].healthCheck: interval, timeout, failures and cooldown must not be negative",
+				"proxies[0].healthCheck.probe: want an http or https URL",
+				"proxies[0].attempts: must not be negative",
+			},
+		},
+		{
+			"limits",
+			`{"rateLimit": {"upload": -1}, "connLimit": {"acceptRate": -1},
+			  "proxies": [{"socks5": ":1", "userRateLimits": {"bob": {"burst": -1}}}]}`,
+			[]string{
+				"proxies[0].userRateLimits.bob: upload, download and burst must not be negative",
+				"rateLimit: upload, download and burst must not be negative",
+				"connLimit: limits must not be negative",
+			},
+		},
+		{
+			"forwards and reverses",
+			`{"upstreams": [{"name": "ss", "type": "shadowsocks", "address": "h:1", "crypto": "rc4", "password": "p"}],
+			  "forwards": [{"network": "sctp", "target": "h:1", "upstream": "missing"}, {"listen": ":53", "target": "h:53", "network": "udp", "upstream": "ss"}],
+			  "reverses": [{"remote": ":22", "target": "h:22", "upstream": "ss"}, {"target": "h:22"}]}`,
+			[]string{
+				`forwards[0].network: unknown network "sctp", want tcp or udp`,
+				"forwards[0].listen: missing address",
+				`forwards[0].upstream: unknown upstream "missing"`,
+				"forwards[1].upstream: udp can't go through shadowsocks or socks5 upstreams",
+				"reverses[0].upstream: reverse forwards need a socks5 upstream",
+				"reverses[1].remote: missing address",
+				`reverses[1].upstream: unknown upstream ""`,
+			},
+		},
+	}
+	for _, test := range tests {
+		errs := configErrors(t, test.data)
+		if len(errs) != len(test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, errs, test.want)
+			continue
+		}
+		for n, want := range test.want {
+			if !strings.HasPrefix(errs[n], want) {
+				t.Errorf("%s: got %q, want %q", test.name, errs[n], want)
+			}
+		}
+	}
+}
+
+func TestParseConfigValid(t *testing.T) {
+	data := `{
+		"pac": {"address": "127.0.0.1:50000", "proxy": "127.0.0.1:8080"},
+		"upstreams": [{"name": "up", "type": "socks5", "address": "proxy.example.com:1080"}],
+		"proxies": [{"http": "127.0.0.1:8080", "socks5": "127.0.0.1:1080", "crypto": "des", "password": "8 bytes!",
+			"upstreams": [{"type": "shadowsocks", "crypto": "chacha20", "password": "secret", "address": "1.2.3.4:8388"}],
+			"dns": {"address": "127.0.0.1:5353"}}],
+		"forwards": [{"listen": ":2222", "target": "host:22", "upstream": "up"}, {"listen": ":2222", "target": "host:53", "network": "udp"}],
+		"reverses": [{"remote": ":8022", "target": "127.0.0.1:22", "upstream": "up"}]
+	}`
+	if errs := configErrors(t, data); errs != nil {
+		t.Fatalf("got %q", errs)
+	}
+}
+
+func TestParseConfigPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"proxies": [{"socks5": ":1", "crypto": "rc4", "password_file": "` + file + `"}]}`
+	conf, err := ParseConfig([]byte(data), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := conf.Proxies[0].Password; password != "secret" {
+		t.Fatalf("got password %q, want secret", password)
+	}
+	data = `{"proxies": [{"socks5": ":1", "users": {"alice_file": "` + file + `", "bob": "inline"}}]}`
+	if conf, err = ParseConfig([]byte(data), "json"); err != nil {
+		t.Fatal(err)
+	}
+	if users := conf.Proxies[0].Users; !reflect.DeepEqual(users, map[string]string{"alice": "secret", "bob": "inline"}) {
+		t.Fatalf("got users %q, want the password of alice from the file", users)
+	}
+
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{"proxies": [{"socks5": ":1", "crypto": "rc4", "password": "x", "password_file": "` + file + `"}]}`,
+			"proxies[0].password_file: set either password or password_file"},
+		{`{"proxies": [{"socks5": ":1", "crypto": "rc4", "password_file": 1}]}`,
+			"proxies[0].password_file: want a file name"},
+		{`{"proxies": [{"socks5": ":1", "crypto": "rc4", "password_file": "` + filepath.Join(dir, "missing") + `"}]}`,
+			"proxies[0].password_file: open "},
+		{`{"proxies": [{"socks5": ":1", "crypto_file": "x"}]}`,
+			"proxies[0].crypto_file: unknown field"},
+		{`{"proxies": [{"socks5": ":1", "users_file": "x"}]}`,
+			"proxies[0].users_file: unknown field"},
+		{`{"proxies": [{"socks5": ":1", "users": {"alice": "x", "alice_file": "` + file + `"}}]}`,
+			"proxies[0].users.alice_file: set either alice or alice_file"},
+	}
+	for _, test := range tests {
+		errs := configErrors(t, test.data)
+		if len(errs) == 0 || !strings.HasPrefix(errs[0], test.want) {
+			t.Errorf("got %q, want %q", errs, test.want)
+		}
+	}
+}
+
+func TestParseConfigFormat(t *testing.T) {
+	if _, err := ParseConfig([]byte(`{}`), "ini"); err == nil || !strings.Contains(err.Error(), "unknown config format ini") {
+		t.Fatalf("got %v, want unknown config format", err)
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	t.Setenv("SOCKSD_TEST_PASSWORD", "from env")
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("from file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		format   string
+		data     string
+		password string
+		err      string
+	}{
+		{"yaml", "proxies:\n- socks5: ':1'\n  crypto: rc4\n  password: ${SOCKSD_TEST_PASSWORD}!\n", "from env!", ""},
+		{"toml", "[[proxies]]\nsocks5 = ':1'\ncrypto = 'rc4'\npassword = 'a${SOCKSD_TEST_PASSWORD}'\n", "afrom env", ""},
+		{"yaml", "proxies:\n- socks5: ':1'\n  crypto: rc4\n  password: $${SOCKSD_TEST_PASSWORD}\n", "${SOCKSD_TEST_PASSWORD}", ""},
+		{"yaml", "proxies:\n- socks5: ':1'\n  crypto: rc4\n  password_file: " + file + "\n", "from file", ""},
+		{"toml", "[[proxies]]\nsocks5 = ':1'\ncrypto = 'rc4'\npassword_file = '" + file + "'\n", "from file", ""},
+		{"yaml", "proxies:\n- socks5: ':1'\n  crypto: rc4\n  password: ${SOCKSD_TEST_UNSET}\n", "",
+			"proxies[0].password: environment variable SOCKSD_TEST_UNSET is not set"},
+		{"toml", "[[proxies]]\nsocks5 = ':1'\ncrypto = 'rc4'\npassword = '${SOCKSD_TEST_PASSWORD'\n", "",
+			"proxies[0].password: missing } after ${"},
+		{"json", `{"proxies": [{"socks5": ":1", "crypto": "rc4", "password": "${SOCKSD_TEST_PASSWORD}"}]}`, "from env", ""},
+		{"JSON", `{"proxies": [{"socks5": ":1", "crypto": "rc4", "password": "$${x"}]}`, "${x", ""},
+	}
+	for _, test := range tests {
+		conf, err := ParseConfig([]byte(test.data), test.format)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s %q: got %v, want %s", test.format, test.data, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", test.format, test.data, err)
+			continue
+		}
+		if password := conf.Proxies[0].Password; password != test.password {
+			t.Errorf("%s %q: got password %q, want %q", test.format, test.data, password, test.password)
+		}
+	}
+}
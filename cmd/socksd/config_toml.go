@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML decodes a TOML document into maps, slices and scalars, like encoding/json
+// does.
+func parseTOML(data []byte) (interface{}, error) {
+	raw := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		if err, ok := err.(toml.ParseError); ok {
+			return nil, &syntaxError{line: err.Position.Line, msg: err.Message}
+		}
+		return nil, err
+	}
+	return plainValue(raw), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"empty", "# nothing\n", object{}},
+		{
+			"scalars",
+			"a = 1\nb = \"text\"\nc = true\nd = 1.5\ne = inf\nf = 2024-01-01\ng = 2024-01-01T10:00:00Z\nh = 07:32:00\n",
+			object{"a": int64(1), "b": "text", "c": true, "d": 1.5, "e": "+Inf", "f": "2024-01-01", "g": "2024-01-01T10:00:00Z",
+				"h": "07:32:00"},
+		},
+		{
+			"arrays of tables",
+			"[[p]]\nn = 1\n[[p.u]]\nm = 1\n[[p]]\nn = 2\n",
+			object{"p": array{
+				object{"n": int64(1), "u": array{object{"m": int64(1)}}},
+				object{"n": int64(2)},
+			}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseTOML([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"a = 1\na = 2\n", "line 2: "},
+		{"a = [1 2]\n", "line 1: "},
+	}
+	for _, test := range tests {
+		_, err := parseTOML([]byte(test.data))
+		if err, ok := err.(*syntaxError); !ok || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want an error at %s", test.data, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlErrorLine matches the line yaml.v3 locates its errors at.
+var yamlErrorLine = regexp.MustCompile(`^yaml: (?:unmarshal errors:\n\s*)?line (\d+): `)
+
+// parseYAML decodes a YAML document into maps, slices and scalars, like encoding/json
+// does. Multiple documents are rejected rather than all but the first ignored.
+func parseYAML(data []byte) (interface{}, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		if err == io.EOF {
+			return map[string]interface{}{}, nil
+		}
+		return nil, yamlError(err)
+	}
+	var next interface{}
+	if err := decoder.Decode(&next); err != io.EOF {
+		if err != nil {
+			return nil, yamlError(err)
+		}
+		return nil, errors.New("multiple documents are not supported")
+	}
+	if raw == nil {
+		return map[string]interface{}{}, nil
+	}
+	return plainValue(raw), nil
+}
+
+// yamlError turns an error of yaml.v3 located at a line into a syntaxError.
+func yamlError(err error) error {
+	match := yamlErrorLine.FindStringSubmatchIndex(err.Error())
+	if match == nil {
+		return err
+	}
+	msg := err.Error()
+	line, _ := strconv.Atoi(msg[match[2]:match[3]])
+	return &syntaxError{line: line, msg: msg[match[1]:]}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type object = map[string]interface{}
+type array = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"empty", "# nothing\n", object{}},
+		{
+			"scalars",
+			"a: 1\nb: text with spaces\nc: true\nd: ~\ne: 1.5\nf: 127.0.0.1:1080\ng: 2024-01-01\n",
+			object{"a": 1, "b": "text with spaces", "c": true, "d": nil, "e": 1.5, "f": "127.0.0.1:1080", "g": "2024-01-01T00:00:00Z"},
+		},
+		{
+			"anchors and multi-line scalars",
+			"base: &base {crypto: rc4, password: x}\nproxies:\n- <<: *base\n  socks5: ':1'\nkey: |\n  line one\n  line two\n",
+			object{"base": object{"crypto": "rc4", "password": "x"},
+				"proxies": array{object{"crypto": "rc4", "password": "x", "socks5": ":1"}}, "key": "line one\nline two\n"},
+		},
+		{
+			"keys that aren't strings",
+			"users:\n  1000: secret\n  true: other\n",
+			object{"users": object{"1000": "secret", "true": "other"}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseYAML([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"a: 1\n---\nb: 2\n", "multiple documents are not supported"},
+		{"a: 1\na: 2\n", `line 2: mapping key "a" already defined at line 1`},
+		{"a:\n\tb: 1\n", "line 2: found character that cannot start any token"},
+	}
+	for _, test := range tests {
+		_, err := parseYAML([]byte(test.data))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: got %v, want %s", test.data, err, test.want)
+		}
+	}
+}
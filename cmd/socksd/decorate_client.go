@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net"
 
 	"github.com/eahydra/socks"
@@ -20,9 +21,12 @@ func NewDecorateClient(forward socks.Dialer, ds ...ConnDecorator) *DecorateClien
 }
 
 func (d *DecorateClient) Dial(network, address string) (net.Conn, error) {
-	conn, err := d.forward.Dial(network, address)
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *DecorateClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := socks.DialContext(ctx, d.forward, network, address)
 	if err != nil {
-		ErrLog.Println("DecorateClient forward.Dial failed, err:", err, address)
 		return nil, err
 	}
 	dconn, err := DecorateConn(conn, d.decorators...)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net"
 
 	"github.com/eahydra/socks"
@@ -8,15 +9,17 @@ import (
 
 type DecorateDirect struct {
 	dnsCache *DNSCache
+	metrics  *Metrics
 }
 
-func NewDecorateDirect(dnsCacheTime int) *DecorateDirect {
+func NewDecorateDirect(dnsCacheTime int, metrics *Metrics) *DecorateDirect {
 	var dnsCache *DNSCache
 	if dnsCacheTime != 0 {
 		dnsCache = NewDNSCache(dnsCacheTime)
 	}
 	return &DecorateDirect{
 		dnsCache: dnsCache,
+		metrics:  metrics,
 	}
 }
 
@@ -34,6 +37,10 @@ func parseAddress(address string) (interface{}, string, error) {
 }
 
 func (d *DecorateDirect) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *DecorateDirect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	host, port, err := parseAddress(address)
 	if err != nil {
 		return nil, err
@@ -50,21 +57,28 @@ func (d *DecorateDirect) Dial(network, address string) (net.Conn, error) {
 		{
 			dest = h
 			if d.dnsCache != nil {
-				if p, ok := d.dnsCache.Get(h); ok {
+				p, ok := d.dnsCache.Get(h)
+				if ok {
 					dest = p.String()
 					ipCached = true
 				}
+				d.metrics.ObserveDNSCache(ok)
 			}
 		}
 	}
 	address = net.JoinHostPort(dest, port)
-	destConn, err := socks.Direct.Dial(network, address)
+	destConn, err := socks.DialContext(ctx, socks.Direct, network, address)
 	if err != nil {
 		return nil, err
 	}
 
 	if d.dnsCache != nil && !ipCached {
-		d.dnsCache.Set(host.(string), destConn.RemoteAddr().(*net.TCPAddr).IP)
+		switch addr := destConn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			d.dnsCache.Set(host.(string), addr.IP)
+		case *net.UDPAddr:
+			d.dnsCache.Set(host.(string), addr.IP)
+		}
 	}
 	return destConn, nil
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DNS messages are handled on the wire format, reading only what the forwarder needs:
+// the question, the TTLs and the EDNS payload size.
+
+const (
+	dnsHeaderSize    = 12
+	dnsTypeA         = 1
+	dnsTypeAAAA      = 28
+	dnsTypeOPT       = 41
+	dnsClassIN       = 1
+	dnsFlagQR        = 0x8000
+	dnsFlagTC        = 0x0200
+	dnsFlagRD        = 0x0100
+	dnsFlagRA        = 0x0080
+	dnsRcodeMask     = 0x000f
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+
+	// dnsMaxUDPSize is the size of UDP responses clients accept without EDNS.
+	dnsMaxUDPSize  = 512
+	maxDNSPointers = 16
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// DNSQuestion is the first question of a message.
+type DNSQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// key identifies the question in the cache. Names are case insensitive.
+func (q DNSQuestion) key() string {
+	return strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Type)) + "/" + strconv.Itoa(int(q.Class))
+}
+
+type dnsHeader struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+func parseDNSHeader(msg []byte) (dnsHeader, error) {
+	if len(msg) < dnsHeaderSize {
+		return dnsHeader{}, errDNSMalformed
+	}
+	return dnsHeader{
+		ID:      binary.BigEndian.Uint16(msg[0:]),
+		Flags:   binary.BigEndian.Uint16(msg[2:]),
+		QDCount: binary.BigEndian.Uint16(msg[4:]),
+		ANCount: binary.BigEndian.Uint16(msg[6:]),
+		NSCount: binary.BigEndian.Uint16(msg[8:]),
+		ARCount: binary.BigEndian.Uint16(msg[10:]),
+	}, nil
+}
+
+// readDNSName reads the possibly compressed name at off, returning it without the
+// trailing dot and the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(msg[off])
+		switch length & 0xc0 {
+		case 0x00:
+			if length == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, "."), next, nil
+			}
+			if off+1+length > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			if pointers++; pointers > maxDNSPointers {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, errDNSMalformed
+		}
+	}
+}
+
+// parseDNSQuestion returns the first question of msg and the offset after it.
+func parseDNSQuestion(msg []byte) (DNSQuestion, int, error) {
+	header, err := parseDNSHeader(msg)
+	if err != nil {
+		return DNSQuestion{}, 0, err
+	}
+	if header.QDCount == 0 {
+		return DNSQuestion{}, 0, errDNSMalformed
+	}
+	name, off, err := readDNSName(msg, dnsHeaderSize)
+	if err != nil {
+		return DNSQuestion{}, 0, err
+	}
+	if off+4 > len(msg) {
+		return DNSQuestion{}, 0, errDNSMalformed
+	}
+	q := DNSQuestion{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[off:]),
+		Class: binary.BigEndian.Uint16(msg[off+2:]),
+	}
+	return q, off + 4, nil
+}
+
+// dnsRecord locates a resource record in a message.
+type dnsRecord struct {
+	Type      uint16
+	Class     uint16
+	TTLOffset int
+	Data      []byte
+}
+
+// walkDNSRecords calls fn with every resource record after the questions.
+func walkDNSRecords(msg []byte, fn func(r dnsRecord)) error {
+	header, err := parseDNSHeader(msg)
+	if err != nil {
+		return err
+	}
+	off := dnsHeaderSize
+	for i := 0; i < int(header.QDCount); i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return err
+		}
+		off += 4
+	}
+	records := int(header.ANCount) + int(header.NSCount) + int(header.ARCount)
+	for i := 0; i < records; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return err
+		}
+		if off+10 > len(msg) {
+			return errDNSMalformed
+		}
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off+10+length > len(msg) {
+			return errDNSMalformed
+		}
+		fn(dnsRecord{
+			Type:      binary.BigEndian.Uint16(msg[off:]),
+			Class:     binary.BigEndian.Uint16(msg[off+2:]),
+			TTLOffset: off + 4,
+			Data:      msg[off+10 : off+10+length],
+		})
+		off += 10 + length
+	}
+	return nil
+}
+
+// dnsMinTTL returns the smallest TTL of the records of msg, not counting the EDNS
+// pseudo record. It reports false if msg has no such record.
+func dnsMinTTL(msg []byte) (uint32, bool) {
+	var min uint32
+	found := false
+	err := walkDNSRecords(msg, func(r dnsRecord) {
+		if r.Type == dnsTypeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(msg[r.TTLOffset:])
+		if !found || ttl < min {
+			min, found = ttl, true
+		}
+	})
+	return min, err == nil && found
+}
+
+// ageDNSRecords lowers the TTLs of the records of msg by elapsed seconds.
+func ageDNSRecords(msg []byte, elapsed uint32) {
+	walkDNSRecords(msg, func(r dnsRecord) {
+		if r.Type == dnsTypeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(msg[r.TTLOffset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[r.TTLOffset:], ttl)
+	})
+}
+
+// dnsUDPSize returns the size of UDP responses the sender of query accepts.
+func dnsUDPSize(query []byte) int {
+	size := dnsMaxUDPSize
+	walkDNSRecords(query, func(r dnsRecord) {
+		if r.Type == dnsTypeOPT && int(r.Class) > size {
+			size = int(r.Class)
+		}
+	})
+	return size
+}
+
+// truncateDNSResponse returns the header and question of response with the TC flag,
+// which makes the client retry over TCP.
+func truncateDNSResponse(response []byte) []byte {
+	return dnsQuestionOnly(response, binary.BigEndian.Uint16(response[2:])|dnsFlagTC)
+}
+
+// newDNSResponse returns a response to query with rcode and no records.
+func newDNSResponse(query []byte, rcode uint16) []byte {
+	return dnsQuestionOnly(query, binary.BigEndian.Uint16(query[2:])&dnsFlagRD|dnsFlagQR|dnsFlagRA|rcode)
+}
+
+// newDNSAnswer returns a response to query answering its question with one record
+// holding data.
+func newDNSAnswer(query []byte, ttl uint32, data []byte) []byte {
+	b := newDNSResponse(query, 0)
+	if binary.BigEndian.Uint16(b[4:]) == 0 {
+		return b
+	}
+	binary.BigEndian.PutUint16(b[6:], 1)
+	record := make([]byte, 12, 12+len(data))
+	// The name points at the question, and the type and class are copied from it.
+	record[0], record[1] = 0xc0, dnsHeaderSize
+	copy(record[2:6], b[len(b)-4:])
+	binary.BigEndian.PutUint32(record[6:], ttl)
+	binary.BigEndian.PutUint16(record[10:], uint16(len(data)))
+	return append(append(b, record...), data...)
+}
+
+// dnsQuestionOnly returns the header, with flags, and the question of msg, which must
+// be at least a header long.
+func dnsQuestionOnly(msg []byte, flags uint16) []byte {
+	questions := uint16(1)
+	_, off, err := parseDNSQuestion(msg)
+	if err != nil {
+		off, questions = dnsHeaderSize, 0
+	}
+	b := append([]byte(nil), msg[:off]...)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], questions)
+	for n := 6; n < dnsHeaderSize; n++ {
+		b[n] = 0
+	}
+	return b
+}
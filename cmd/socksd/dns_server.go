@@ -0,0 +1,360 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+const (
+	dnsTimeout          = 5 * time.Second
+	dnsTCPIdleTimeout   = 2 * time.Minute
+	defaultDNSCacheSize = 1024
+	maxDNSMessageSize   = 0xffff
+	fakeIPTTL           = 60
+
+	// maxDNSUDPQueries bounds the UDP queries answered at a time. Beyond it, queries are
+	// dropped, and clients retry.
+	maxDNSUDPQueries = 256
+)
+
+var defaultDNSServers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// DNSServer answers DNS queries over UDP and TCP. It forwards them over TCP through the
+// router to its servers, except that with rules, the queries for names that aren't
+// listed go directly over UDP to the direct servers. Responses are cached for their
+// smallest TTL. With fake IPs, the names that would go through the router are answered
+// with addresses of the pool instead.
+type DNSServer struct {
+	router  socks.Dialer
+	servers []string
+	direct  []string
+	rules   *DomainRules
+	fakeIPs *FakeIPPool
+	cache   *dnsResponseCache
+	logger  *Logger
+}
+
+func NewDNSServer(conf DNS, router socks.Dialer, fakeIPs *FakeIPPool, logger *Logger) (*DNSServer, error) {
+	s := &DNSServer{
+		router:  router,
+		servers: conf.Servers,
+		direct:  conf.Direct,
+		fakeIPs: fakeIPs,
+		cache:   newDNSResponseCache(conf.CacheSize),
+		logger:  logger,
+	}
+	if len(s.servers) == 0 {
+		s.servers = defaultDNSServers
+	}
+	if conf.Rules != "" {
+		if len(conf.Direct) == 0 {
+			return nil, errors.New("dns rules need direct servers")
+		}
+		rules, err := NewDomainRules(conf.Rules, logger)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = rules
+	}
+	return s, nil
+}
+
+// Exchange returns the response to query, or nil if query is too short to answer.
+func (s *DNSServer) Exchange(query []byte) []byte {
+	if len(query) < dnsHeaderSize {
+		return nil
+	}
+	q, _, err := parseDNSQuestion(query)
+	if err != nil {
+		return newDNSResponse(query, dnsRcodeFormErr)
+	}
+	upstream := s.rules == nil || s.rules.Match(q.Name)
+	if upstream && s.fakeIPs != nil && q.Name != "" && q.Class == dnsClassIN {
+		switch q.Type {
+		case dnsTypeA:
+			ip := s.fakeIPs.Lookup(q.Name)
+			s.logger.Debug("dns fake IP", "name", q.Name, "ip", ip.String())
+			return newDNSAnswer(query, fakeIPTTL, ip)
+		case dnsTypeAAAA:
+			// The pool has no IPv6 addresses. An empty answer makes clients use IPv4.
+			return newDNSResponse(query, 0)
+		}
+	}
+	if response := s.cache.get(q.key()); response != nil {
+		copy(response, query[:2])
+		return response
+	}
+
+	var response []byte
+	if upstream {
+		response, err = s.exchangeUpstream(query)
+	} else {
+		response, err = s.exchangeDirect(query)
+	}
+	if err != nil {
+		s.logger.Warn("dns query failed", "name", q.Name, "type", q.Type, "upstream", upstream, "error", err)
+		return newDNSResponse(query, dnsRcodeServFail)
+	}
+	s.logger.Debug("dns query", "name", q.Name, "type", q.Type, "upstream", upstream)
+	s.cache.put(q.key(), response)
+	return response
+}
+
+func (s *DNSServer) exchangeUpstream(query []byte) ([]byte, error) {
+	var err error
+	for _, server := range s.servers {
+		var response []byte
+		if response, err = s.exchangeTCP(s.router, server, query); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *DNSServer) exchangeDirect(query []byte) ([]byte, error) {
+	var err error
+	for _, server := range s.direct {
+		var response []byte
+		if response, err = exchangeUDP(server, query); err != nil {
+			continue
+		}
+		if binary.BigEndian.Uint16(response[2:])&dnsFlagTC == 0 {
+			return response, nil
+		}
+		if response, err = s.exchangeTCP(socks.Direct, server, query); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *DNSServer) exchangeTCP(forward socks.Dialer, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	conn, err := socks.DialContext(ctx, forward, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeDNSTCP(conn, query); err != nil {
+		return nil, err
+	}
+	response, err := readDNSTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponse(query, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func exchangeUDP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams that don't answer the query.
+		if checkDNSResponse(query, buf[:n]) == nil {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+func checkDNSResponse(query, response []byte) error {
+	header, err := parseDNSHeader(response)
+	if err != nil {
+		return err
+	}
+	if header.ID != binary.BigEndian.Uint16(query) || header.Flags&dnsFlagQR == 0 {
+		return errors.New("dns response doesn't match the query")
+	}
+	return nil
+}
+
+// writeDNSTCP writes msg with the length prefix of DNS over TCP.
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ServeUDP answers the queries received by conn until it fails, at most
+// maxDNSUDPQueries at a time.
+func (s *DNSServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxDNSMessageSize)
+	workers := make(chan struct{}, maxDNSUDPQueries)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		select {
+		case workers <- struct{}{}:
+		default:
+			s.logger.Debug("dns query dropped", "client", addr.String(), "error", "too many queries")
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-workers }()
+			response := s.Exchange(query)
+			if response == nil {
+				return
+			}
+			if len(response) > dnsUDPSize(query) {
+				response = truncateDNSResponse(response)
+			}
+			conn.WriteTo(response, addr)
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the connections accepted by listener until it fails.
+func (s *DNSServer) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+				query, err := readDNSTCP(conn)
+				if err != nil {
+					return
+				}
+				response := s.Exchange(query)
+				if response == nil {
+					return
+				}
+				conn.SetWriteDeadline(time.Now().Add(dnsTimeout))
+				if err := writeDNSTCP(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// dnsResponseCache keeps DNS responses until their smallest TTL passes, evicting the
+// least recently used ones beyond its size.
+type dnsResponseCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type dnsCacheEntry struct {
+	key      string
+	response []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+func newDNSResponseCache(size int) *dnsResponseCache {
+	if size <= 0 {
+		size = defaultDNSCacheSize
+	}
+	return &dnsResponseCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the response cached for key, with TTLs lowered by the time
+// it was cached for, or nil.
+func (c *dnsResponseCache) get(key string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*dnsCacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	response := append([]byte(nil), entry.response...)
+	ageDNSRecords(response, uint32(now.Sub(entry.stored)/time.Second))
+	return response
+}
+
+// put caches successful and NXDOMAIN responses with records.
+func (c *dnsResponseCache) put(key string, response []byte) {
+	rcode := binary.BigEndian.Uint16(response[2:]) & dnsRcodeMask
+	if rcode != 0 && rcode != dnsRcodeNXDomain {
+		return
+	}
+	ttl, ok := dnsMinTTL(response)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		key:      key,
+		response: append([]byte(nil), response...),
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+func newTestLogger(t *testing.T) *Logger {
+	t.Helper()
+	logger, err := NewLogger(ioutil.Discard, LevelDebug, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+// newTestQuery returns a query for name and typ with the RD flag.
+func newTestQuery(id uint16, name string, typ uint16) []byte {
+	b := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], dnsFlagRD)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		b = append(append(b, byte(len(label))), label...)
+	}
+	b = append(b, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-4:], typ)
+	binary.BigEndian.PutUint16(b[len(b)-2:], dnsClassIN)
+	return b
+}
+
+// withEDNS returns query with an OPT record announcing a UDP payload size of size.
+func withEDNS(query []byte, size uint16) []byte {
+	b := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(b[10:], 1)
+	opt := make([]byte, 11)
+	binary.BigEndian.PutUint16(opt[1:], dnsTypeOPT)
+	binary.BigEndian.PutUint16(opt[3:], size)
+	return append(b, opt...)
+}
+
+// answerIPs returns the addresses of the A records of response.
+func answerIPs(t *testing.T, response []byte) []string {
+	t.Helper()
+	var ips []string
+	err := walkDNSRecords(response, func(r dnsRecord) {
+		if r.Type == dnsTypeA {
+			ips = append(ips, net.IP(r.Data).String())
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ips
+}
+
+// answerTTL returns the TTL of the first record of response.
+func answerTTL(t *testing.T, response []byte) uint32 {
+	t.Helper()
+	ttl, ok := dnsMinTTL(response)
+	if !ok {
+		t.Fatal("response has no records")
+	}
+	return ttl
+}
+
+// startFakeDNS serves answer over UDP and TCP on the same port, and returns its address.
+func startFakeDNS(t *testing.T, answer func(query []byte, tcp bool) []byte) string {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		buf := make([]byte, maxDNSMessageSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(answer(buf[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readDNSTCP(conn)
+					if err != nil {
+						return
+					}
+					writeDNSTCP(conn, answer(query, true))
+				}
+			}()
+		}
+	}()
+	return packetConn.LocalAddr().String()
+}
+
+func TestDNSResponseCache(t *testing.T) {
+	query := newTestQuery(1, "example.com", dnsTypeA)
+	q, _, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newDNSResponseCache(2)
+	cache.put(q.key(), newDNSAnswer(query, 60, net.IPv4(1, 2, 3, 4).To4()))
+
+	response := cache.get(q.key())
+	if response == nil || answerTTL(t, response) != 60 {
+		t.Fatalf("got %v, want the answer with a TTL of 60", response)
+	}
+	// Names are case insensitive.
+	upper, _, _ := parseDNSQuestion(newTestQuery(1, "EXAMPLE.com", dnsTypeA))
+	if cache.get(upper.key()) == nil {
+		t.Fatal("lookup of EXAMPLE.com missed")
+	}
+
+	// TTLs are lowered by the time the response was cached for.
+	entry := cache.entries[q.key()].Value.(*dnsCacheEntry)
+	entry.stored = entry.stored.Add(-10 * time.Second)
+	if ttl := answerTTL(t, cache.get(q.key())); ttl != 50 {
+		t.Fatalf("got a TTL of %d after 10s, want 50", ttl)
+	}
+	entry.expires = time.Now().Add(-time.Second)
+	if cache.get(q.key()) != nil {
+		t.Fatal("expired response returned")
+	}
+	if _, ok := cache.entries[q.key()]; ok {
+		t.Fatal("expired response kept")
+	}
+}
+
+func TestDNSResponseCacheSkips(t *testing.T) {
+	query := newTestQuery(1, "example.com", dnsTypeA)
+	tests := []struct {
+		name     string
+		response []byte
+	}{
+		{"no records", newDNSResponse(query, 0)},
+		{"zero TTL", newDNSAnswer(query, 0, net.IPv4(1, 2, 3, 4).To4())},
+		{"server failure", newDNSResponse(query, dnsRcodeServFail)},
+	}
+	for _, test := range tests {
+		cache := newDNSResponseCache(0)
+		cache.put("key", test.response)
+		if cache.get("key") != nil {
+			t.Errorf("%s: response cached", test.name)
+		}
+	}
+}
+
+func TestDNSResponseCacheEviction(t *testing.T) {
+	cache := newDNSResponseCache(2)
+	response := newDNSAnswer(newTestQuery(1, "example.com", dnsTypeA), 60, net.IPv4(1, 2, 3, 4).To4())
+	cache.put("a", response)
+	cache.put("b", response)
+	cache.get("a")
+	cache.put("c", response)
+	if cache.get("b") != nil {
+		t.Fatal("least recently used response kept")
+	}
+	if cache.get("a") == nil || cache.get("c") == nil {
+		t.Fatal("recently used response evicted")
+	}
+}
+
+func TestDNSUDPSize(t *testing.T) {
+	query := newTestQuery(1, "example.com", dnsTypeA)
+	tests := []struct {
+		query []byte
+		want  int
+	}{
+		{query, dnsMaxUDPSize},
+		{withEDNS(query, 4096), 4096},
+		{withEDNS(query, 100), dnsMaxUDPSize},
+	}
+	for _, test := range tests {
+		if size := dnsUDPSize(test.query); size != test.want {
+			t.Errorf("got %d, want %d", size, test.want)
+		}
+	}
+}
+
+func TestTruncateDNSResponse(t *testing.T) {
+	query := newTestQuery(7, "example.com", dnsTypeA)
+	response := newDNSAnswer(query, 60, net.IPv4(1, 2, 3, 4).To4())
+	truncated := truncateDNSResponse(response)
+
+	header, err := parseDNSHeader(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ID != 7 || header.Flags&dnsFlagTC == 0 || header.Flags&dnsFlagQR == 0 {
+		t.Fatalf("got header %+v, want ID 7 with the QR and TC flags", header)
+	}
+	if header.QDCount != 1 || header.ANCount != 0 || header.NSCount != 0 || header.ARCount != 0 {
+		t.Fatalf("got header %+v, want the question alone", header)
+	}
+	if q, _, err := parseDNSQuestion(truncated); err != nil || q.Name != "example.com" {
+		t.Fatalf("got question %+v, %v, want example.com", q, err)
+	}
+}
+
+func TestDNSServerRules(t *testing.T) {
+	answer := func(ip net.IP) func(query []byte, tcp bool) []byte {
+		return func(query []byte, tcp bool) []byte {
+			return newDNSAnswer(query, 60, ip.To4())
+		}
+	}
+	upstream := startFakeDNS(t, answer(net.IPv4(10, 0, 0, 1)))
+	// The direct server truncates its UDP answers for big.org.
+	direct := startFakeDNS(t, func(query []byte, tcp bool) []byte {
+		if q, _, _ := parseDNSQuestion(query); q.Name == "big.org" && !tcp {
+			return truncateDNSResponse(newDNSResponse(query, 0))
+		}
+		return answer(net.IPv4(10, 0, 0, 2))(query, tcp)
+	})
+
+	rules := filepath.Join(t.TempDir(), "rules")
+	if err := ioutil.WriteFile(rules, []byte("# proxied\nexample.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewDNSServer(DNS{Servers: []string{upstream}, Direct: []string{direct}, Rules: rules},
+		socks.Direct, nil, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "10.0.0.1"},
+		{"www.EXAMPLE.com", "10.0.0.1"},
+		{"notexample.com", "10.0.0.2"},
+		{"other.org", "10.0.0.2"},
+		{"big.org", "10.0.0.2"},
+	}
+	for n, test := range tests {
+		response := server.Exchange(newTestQuery(uint16(n), test.name, dnsTypeA))
+		if ips := answerIPs(t, response); len(ips) != 1 || ips[0] != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, ips, test.want)
+		}
+		if id := binary.BigEndian.Uint16(response); id != uint16(n) {
+			t.Errorf("%s: got ID %d, want %d", test.name, id, n)
+		}
+	}
+
+	// A cached response gets the ID of the new query.
+	response := server.Exchange(newTestQuery(100, "example.com", dnsTypeA))
+	if id := binary.BigEndian.Uint16(response); id != 100 {
+		t.Fatalf("cached response has ID %d, want 100", id)
+	}
+}
+
+func TestDNSServerServeUDPTruncates(t *testing.T) {
+	// An answer with 40 records doesn't fit in 512 bytes.
+	upstream := startFakeDNS(t, func(query []byte, tcp bool) []byte {
+		response := newDNSAnswer(query, 60, net.IPv4(10, 0, 0, 1).To4())
+		record := response[len(response)-16:]
+		for n := 1; n < 40; n++ {
+			response = append(response, record...)
+		}
+		binary.BigEndian.PutUint16(response[6:], 40)
+		return response
+	})
+	server, err := NewDNSServer(DNS{Servers: []string{upstream}}, socks.Direct, nil, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	go server.ServeUDP(packetConn)
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tests := []struct {
+		query     []byte
+		truncated bool
+	}{
+		{newTestQuery(1, "example.com", dnsTypeA), true},
+		{withEDNS(newTestQuery(2, "example.com", dnsTypeA), 4096), false},
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	for _, test := range tests {
+		if _, err := conn.Write(test.query); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := parseDNSHeader(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if truncated := header.Flags&dnsFlagTC != 0; truncated != test.truncated || (header.ANCount == 0) != test.truncated {
+			t.Errorf("got %d bytes with header %+v, want truncated %v", n, header, test.truncated)
+		}
+	}
+}
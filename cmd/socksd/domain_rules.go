@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// DomainRules matches domain names against a rule file with one domain per line, like
+// the local PAC rule file, reloading it when it changes. A rule matches the domain and
+// its subdomains.
+type DomainRules struct {
+	reloader *fileReloader
+	domains  atomic.Value
+}
+
+func NewDomainRules(file string, logger *Logger) (*DomainRules, error) {
+	r := &DomainRules{}
+	reloader, err := newFileReloader(func() error {
+		rules, err := loadLocalRule(file)
+		if err != nil {
+			return err
+		}
+		domains := make(map[string]struct{}, len(rules))
+		for _, rule := range rules {
+			rule = strings.ToLower(strings.Trim(strings.TrimSpace(rule), "."))
+			if rule != "" && !strings.HasPrefix(rule, "#") {
+				domains[rule] = struct{}{}
+			}
+		}
+		r.domains.Store(domains)
+		return nil
+	}, logger, file)
+	if err != nil {
+		return nil, err
+	}
+	r.reloader = reloader
+	return r, nil
+}
+
+// Match reports whether name or one of its parent domains is listed.
+func (r *DomainRules) Match(name string) bool {
+	r.reloader.check()
+	domains := r.domains.Load().(map[string]struct{})
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		if _, ok := domains[name]; ok {
+			return true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return false
+		}
+		name = name[dot+1:]
+	}
+}
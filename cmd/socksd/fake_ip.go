@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+const (
+	defaultFakeIPRange = "198.18.0.0/15"
+	fakeIPSaveDelay    = 5 * time.Second
+)
+
+// FakeIPPool hands out addresses of a reserved range to domains, so that connections
+// made to them can be routed by domain. When the range is exhausted, the least recently
+// used address is given to the new domain. The mapping is saved to a file, if any, and
+// loaded back on start.
+type FakeIPPool struct {
+	network *net.IPNet
+	base    uint32
+	next    uint32
+	last    uint32
+	file    string
+	logger  *Logger
+
+	lock     sync.Mutex
+	lru      *list.List
+	byDomain map[string]*list.Element
+	byIP     map[uint32]*list.Element
+	saving   bool
+}
+
+type fakeIPEntry struct {
+	offset uint32
+	domain string
+}
+
+func NewFakeIPPool(conf FakeIP, logger *Logger) (*FakeIPPool, error) {
+	cidr := conf.Range
+	if cidr == "" {
+		cidr = defaultFakeIPRange
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, errors.New("fake IP range must be an IPv4 network of at least 4 addresses")
+	}
+	p := &FakeIPPool{
+		network:  network,
+		base:     binary.BigEndian.Uint32(network.IP.To4()),
+		file:     conf.File,
+		logger:   logger,
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[uint32]*list.Element),
+	}
+	// The network and broadcast addresses are left out.
+	p.next, p.last = 1, 1<<uint(32-ones)-2
+	if p.file != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Lookup returns the fake IP of domain, allocating one if needed.
+func (p *FakeIPPool) Lookup(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if element, ok := p.byDomain[domain]; ok {
+		p.lru.MoveToFront(element)
+		return p.ip(element.Value.(*fakeIPEntry).offset)
+	}
+
+	for p.next <= p.last && p.byIP[p.next] != nil {
+		p.next++
+	}
+	var offset uint32
+	if p.next <= p.last {
+		offset = p.next
+		p.next++
+	} else {
+		oldest := p.lru.Back()
+		entry := oldest.Value.(*fakeIPEntry)
+		p.remove(oldest)
+		offset = entry.offset
+	}
+	p.add(offset, domain)
+	p.scheduleSave()
+	return p.ip(offset)
+}
+
+// Contains reports whether ip is in the range of the pool.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+// Domain returns the domain that was given ip.
+func (p *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	if !p.Contains(ip) {
+		return "", false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	element, ok := p.byIP[binary.BigEndian.Uint32(ip.To4())-p.base]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(element)
+	return element.Value.(*fakeIPEntry).domain, true
+}
+
+func (p *FakeIPPool) ip(offset uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+offset)
+	return ip
+}
+
+func (p *FakeIPPool) add(offset uint32, domain string) {
+	element := p.lru.PushFront(&fakeIPEntry{offset: offset, domain: domain})
+	p.byDomain[domain] = element
+	p.byIP[offset] = element
+}
+
+func (p *FakeIPPool) remove(element *list.Element) {
+	entry := element.Value.(*fakeIPEntry)
+	p.lru.Remove(element)
+	delete(p.byDomain, entry.domain)
+	delete(p.byIP, entry.offset)
+}
+
+// load reads the file saved by save, with one "ip domain" line per mapping, least
+// recently used first.
+func (p *FakeIPPool) load() error {
+	lines, err := loadLocalRule(p.file)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || !p.Contains(ip) {
+			continue
+		}
+		offset := binary.BigEndian.Uint32(ip.To4()) - p.base
+		if offset == 0 || offset > p.last {
+			continue
+		}
+		if element, ok := p.byIP[offset]; ok {
+			p.remove(element)
+		}
+		if element, ok := p.byDomain[fields[1]]; ok {
+			p.remove(element)
+		}
+		p.add(offset, fields[1])
+	}
+	p.logger.Info("fake IPs loaded", "file", p.file, "count", p.lru.Len())
+	return nil
+}
+
+// scheduleSave saves the pool a little later, batching the changes made in between.
+// The lock must be held.
+func (p *FakeIPPool) scheduleSave() {
+	if p.file == "" || p.saving {
+		return
+	}
+	p.saving = true
+	time.AfterFunc(fakeIPSaveDelay, p.save)
+}
+
+func (p *FakeIPPool) save() {
+	var b bytes.Buffer
+	p.lock.Lock()
+	p.saving = false
+	for element := p.lru.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*fakeIPEntry)
+		b.WriteString(p.ip(entry.offset).String() + " " + entry.domain + "\n")
+	}
+	p.lock.Unlock()
+
+	// Written aside and renamed, so that a crash doesn't leave a partial file.
+	tmp := p.file + ".tmp"
+	err := ioutil.WriteFile(tmp, b.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(tmp, p.file)
+	}
+	if err != nil {
+		p.logger.Warn("failed to save fake IPs", "file", p.file, "error", err)
+	}
+}
+
+// Close saves the changes waiting for a scheduled save now, since it may come too late.
+// A pool without changes leaves its file alone, so that closing one built for a
+// rejected config doesn't overwrite the file of the running pool.
+func (p *FakeIPPool) Close() error {
+	p.lock.Lock()
+	pending := p.saving
+	p.lock.Unlock()
+	if pending {
+		p.save()
+	}
+	return nil
+}
+
+// FakeIPDialer dials the domains of the fake IPs of pool instead of the addresses.
+type FakeIPDialer struct {
+	forward socks.Dialer
+	pool    *FakeIPPool
+}
+
+func NewFakeIPDialer(forward socks.Dialer, pool *FakeIPPool) *FakeIPDialer {
+	return &FakeIPDialer{forward: forward, pool: pool}
+}
+
+func (d *FakeIPDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *FakeIPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && d.pool.Contains(ip) {
+		domain, ok := d.pool.Domain(ip)
+		if !ok {
+			return nil, errors.New("no domain for fake IP " + host)
+		}
+		address = net.JoinHostPort(domain, port)
+	}
+	return socks.DialContext(ctx, d.forward, network, address)
+}
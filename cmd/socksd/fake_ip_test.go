@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFakeIPPoolReuse(t *testing.T) {
+	// A /30 has two usable addresses.
+	pool, err := NewFakeIPPool(FakeIP{Range: "10.1.0.0/30"}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookups := []struct {
+		domain string
+		want   string
+	}{
+		{"a.com", "10.1.0.1"},
+		{"b.com", "10.1.0.2"},
+		{"A.com.", "10.1.0.1"},
+		// b.com is the least recently used, so c.com gets its address.
+		{"c.com", "10.1.0.2"},
+		// Then a.com is.
+		{"b.com", "10.1.0.1"},
+	}
+	for _, lookup := range lookups {
+		if ip := pool.Lookup(lookup.domain); ip.String() != lookup.want {
+			t.Fatalf("%s: got %s, want %s", lookup.domain, ip, lookup.want)
+		}
+	}
+	for ip, want := range map[string]string{"10.1.0.1": "b.com", "10.1.0.2": "c.com"} {
+		if domain, ok := pool.Domain(net.ParseIP(ip)); !ok || domain != want {
+			t.Errorf("%s: got %q, %v, want %s", ip, domain, ok, want)
+		}
+	}
+	if _, ok := pool.Domain(net.ParseIP("10.1.0.3")); ok {
+		t.Error("broadcast address has a domain")
+	}
+	if pool.Contains(net.ParseIP("10.1.0.4")) {
+		t.Error("address out of the range is contained")
+	}
+}
+
+func TestFakeIPPoolRange(t *testing.T) {
+	for _, cidr := range []string{"10.1.0.0/31", "fd00::/64", "10.1.0.0"} {
+		if _, err := NewFakeIPPool(FakeIP{Range: cidr}, newTestLogger(t)); err == nil {
+			t.Errorf("%s: range accepted", cidr)
+		}
+	}
+}
+
+func TestFakeIPPoolSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fakeip")
+	conf := FakeIP{Range: "10.1.0.0/29", File: file}
+	pool, err := NewFakeIPPool(conf, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := pool.Lookup("a.com"), pool.Lookup("b.com")
+	pool.Lookup("a.com")
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10.1.0.2 b.com\n10.1.0.1 a.com\n"; string(saved) != want {
+		t.Fatalf("saved %q, want %q", saved, want)
+	}
+
+	// Lines that don't fit the range are skipped.
+	extra := "garbage\n10.2.0.1 out.com\n10.1.0.0 network.com\n10.1.0.3 c.com\n"
+	if err := ioutil.WriteFile(file, append(saved, extra...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewFakeIPPool(conf, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := loaded.Lookup("a.com"); !ip.Equal(a) {
+		t.Errorf("a.com: got %s after load, want %s", ip, a)
+	}
+	if ip := loaded.Lookup("b.com"); !ip.Equal(b) {
+		t.Errorf("b.com: got %s after load, want %s", ip, b)
+	}
+	if domain, ok := loaded.Domain(net.ParseIP("10.1.0.3")); !ok || domain != "c.com" {
+		t.Errorf("10.1.0.3: got %q, %v, want c.com", domain, ok)
+	}
+	for _, domain := range []string{"out.com", "network.com"} {
+		if ip := loaded.Lookup(domain); ip.Equal(net.ParseIP("10.1.0.0")) || !loaded.Contains(ip) {
+			t.Errorf("%s: got %s", domain, ip)
+		}
+	}
+	// New domains don't take the loaded addresses.
+	if ip := loaded.Lookup("d.com"); ip.Equal(a) || ip.Equal(b) || ip.String() == "10.1.0.3" {
+		t.Errorf("d.com: got the loaded address %s", ip)
+	}
+}
+
+// recordingDialer records the addresses it is asked for and fails.
+type recordingDialer struct {
+	addresses []string
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	d.addresses = append(d.addresses, address)
+	return nil, errors.New("not dialing")
+}
+
+func TestFakeIPDialer(t *testing.T) {
+	pool, err := NewFakeIPPool(FakeIP{Range: "10.1.0.0/29"}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := pool.Lookup("example.com")
+	forward := &recordingDialer{}
+	dialer := NewFakeIPDialer(forward, pool)
+	dialer.Dial("tcp", net.JoinHostPort(ip.String(), "443"))
+	dialer.Dial("tcp", "192.0.2.1:80")
+	if _, err := dialer.Dial("tcp", "10.1.0.5:80"); err == nil || !strings.Contains(err.Error(), "no domain") {
+		t.Fatalf("got %v for an unknown fake IP, want no domain", err)
+	}
+	want := []string{"example.com:443", "192.0.2.1:80"}
+	if strings.Join(forward.addresses, " ") != strings.Join(want, " ") {
+		t.Fatalf("dialed %v, want %v", forward.addresses, want)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+// BuildForwards returns the service of the port forwards of conf, which relay every
+// connection, or the datagrams of every client, to a fixed target through an upstream,
+// or directly for udp. Forwards naming the same upstream share its dialer.
+func BuildForwards(conf *Config, ds []ConnDecorator, global *socks.ConnLimiter, logger *Logger, metrics *Metrics) (*service, error) {
+	svc := &service{}
+	dialers := make(map[string]socks.Dialer)
+	for _, forward := range conf.Forwards {
+		switch forward.Network {
+		case "", "tcp", "udp":
+		default:
+			svc.stop(0)
+			return nil, errors.New("forward " + forward.Listen + ": unknown network " + forward.Network)
+		}
+		if forward.Network == "udp" && forward.Upstream != "" {
+			svc.stop(0)
+			return nil, errors.New("forward " + forward.Listen + ": udp can't go through upstream " + forward.Upstream)
+		}
+		if _, ok := dialers[forward.Upstream]; ok {
+			continue
+		}
+		dialer, closer, err := BuildForwardDialer(conf, forward.Upstream, logger, metrics)
+		if err != nil {
+			svc.stop(0)
+			return nil, errors.New("forward " + forward.Listen + ": " + err.Error())
+		}
+		svc.resources.add(closer)
+		dialers[forward.Upstream] = dialer
+	}
+	svc.start = func(st *startup) error {
+		for _, forward := range conf.Forwards {
+			var err error
+			if forward.Network == "udp" {
+				err = runForwardUDP(forward, dialers[forward.Upstream], logger, st)
+			} else {
+				err = runForwardTCP(forward, dialers[forward.Upstream], ds, global, logger, metrics, st)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return svc, nil
+}
+
+// BuildForwardDialer returns a dialer through the upstream of conf named name, or a
+// direct dialer if name is empty, and the closer of the connections it keeps.
+func BuildForwardDialer(conf *Config, name string, logger *Logger, metrics *Metrics) (socks.Dialer, io.Closer, error) {
+	if name == "" {
+		return &namedDialer{name: "direct", forward: NewDecorateDirect(0, metrics), metrics: metrics}, closers(nil), nil
+	}
+	upstream, ok := conf.FindUpstream(name)
+	if !ok {
+		return nil, nil, errors.New("unknown upstream " + name)
+	}
+	forward, closer, err := BuildUpstream(upstream, "forwards", NewDecorateDirect(0, metrics), logger, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &namedDialer{name: upstream.Address, forward: forward, metrics: metrics}, closer, nil
+}
+
+func runForwardTCP(forward Forward, dialer socks.Dialer, ds []ConnDecorator, global *socks.ConnLimiter, logger *Logger, metrics *Metrics, st *startup) error {
+	listener, err := net.Listen("tcp", forward.Listen)
+	if err != nil {
+		return err
+	}
+	listener = NewDecorateListener(st.track(listener), ds...)
+	target := func(net.Conn) (string, error) {
+		return forward.Target, nil
+	}
+	server := socks.NewForwardServer("forward", dialer, target,
+		socks.WithConnLimiter(global),
+		socks.WithLogger(logger),
+		socks.WithListenerName(forward.Listen),
+		socks.WithObserver(metrics.ListenerObserver("forward", forward.Listen)))
+	st.serve(listener, func() {
+		server.Serve(listener)
+	})
+	return nil
+}
+
+// runForwardUDP relays the datagrams of each client to the target in a session of its
+// own, which ends after a minute without datagrams.
+func runForwardUDP(forward Forward, dialer socks.Dialer, logger *Logger, st *startup) error {
+	conn, err := net.ListenPacket("udp", forward.Listen)
+	if err != nil {
+		return err
+	}
+	st.serve(conn, func() {
+		var sessions udpSessions
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				if !isClosedError(err) {
+					logger.Error("failed to read UDP", "address", forward.Listen, "error", err)
+				}
+				return
+			}
+			sessions.dispatch(client.String(), append([]byte(nil), buf[:n]...), func(packets <-chan []byte) {
+				relayForwardUDP(conn, client, forward.Target, dialer, packets, logger)
+			})
+		}
+	})
+	return nil
+}
+
+func relayForwardUDP(conn net.PacketConn, client net.Addr, target string, dialer socks.Dialer, packets <-chan []byte, logger *Logger) {
+	start := time.Now()
+	fields := []interface{}{"protocol", "forward-udp", "client", client.String(), "dest", target}
+	remote, err := socks.DialContext(context.Background(), dialer, "udp", target)
+	if err != nil {
+		logger.Warn("dial failed", append(fields, "error", err)...)
+		return
+	}
+	defer remote.Close()
+	up, down := relayUDP(remote, packets, func(b []byte) error {
+		_, err := conn.WriteTo(b, client)
+		return err
+	})
+	logger.Info("session closed", append(fields, "up", up, "down", down, "duration", time.Since(start))...)
+}
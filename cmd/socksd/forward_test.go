@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks"
+	"github.com/eahydra/socks/sockstest"
+)
+
+// freeAddress returns a local address of network that nothing listens on.
+func freeAddress(t *testing.T, network string) string {
+	t.Helper()
+	var closer interface{ Close() error }
+	var address string
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closer, address = conn, conn.LocalAddr().String()
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closer, address = listener, listener.Addr().String()
+	}
+	closer.Close()
+	return address
+}
+
+// startService starts svc, and stops it when the test ends.
+func startService(t *testing.T, svc *service) {
+	t.Helper()
+	st, err := svc.bind()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.run()
+	t.Cleanup(func() { svc.stop(0) })
+}
+
+// startUpstream starts a SOCKS5 server dialing directly, which sends the destinations
+// it is asked for to dests.
+func startUpstream(t *testing.T) (address string, dests chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	dests = make(chan string, 16)
+	connect := socks.ConnectHandler(socks.Direct)
+	server, err := socks.NewSocks5Server(nil, socks.WithHandler(socks.Socks5HandlerFunc(func(r *socks.Socks5Request) {
+		dests <- r.Addr.String()
+		connect.ServeSocks5(r)
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String(), dests
+}
+
+// startUDPEcho starts a server sending every datagram back, and returns its address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestForwardTCP(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	upstream, dests := startUpstream(t)
+
+	direct, proxied := freeAddress(t, "tcp"), freeAddress(t, "tcp")
+	conf := &Config{
+		Upstreams: []Upstream{{Name: "up", Type: "socks5", Address: upstream}},
+		Forwards: []Forward{
+			{Listen: direct, Target: echo.Addr()},
+			{Listen: proxied, Target: echo.Addr(), Upstream: "up"},
+		},
+	}
+	svc, err := BuildForwards(conf, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startService(t, svc)
+
+	for _, listen := range []string{direct, proxied} {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sockstest.AssertEcho(t, conn, 10000)
+		conn.Close()
+	}
+	select {
+	case dest := <-dests:
+		if dest != echo.Addr() {
+			t.Fatalf("upstream got %s, want %s", dest, echo.Addr())
+		}
+	default:
+		t.Fatal("forward through up didn't use the upstream")
+	}
+	if len(dests) != 0 {
+		t.Fatal("direct forward used the upstream")
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	echo := startUDPEcho(t)
+	listen := freeAddress(t, "udp")
+	conf := &Config{Forwards: []Forward{{Listen: listen, Target: echo, Network: "udp"}}}
+	svc, err := BuildForwards(conf, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startService(t, svc)
+
+	// Each client gets answers of its own.
+	for _, message := range []string{"first", "second"} {
+		conn, err := net.Dial("udp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 2; i++ {
+			if _, err := conn.Write([]byte(message)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 100)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != message {
+				t.Fatalf("got %q, want %q", buf[:n], message)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestBuildForwardsErrors(t *testing.T) {
+	tests := []struct {
+		forward Forward
+		err     string
+	}{
+		{Forward{Listen: "127.0.0.1:1", Target: "127.0.0.1:2", Network: "sctp"}, "unknown network sctp"},
+		{Forward{Listen: "127.0.0.1:1", Target: "127.0.0.1:2", Upstream: "missing"}, "unknown upstream missing"},
+		{Forward{Listen: "127.0.0.1:1", Target: "127.0.0.1:2", Upstream: "up", Network: "udp"}, "udp can't go through upstream up"},
+	}
+	for _, test := range tests {
+		conf := &Config{
+			Upstreams: []Upstream{{Name: "up", Type: "socks5", Address: "127.0.0.1:1080"}},
+			Forwards:  []Forward{test.forward},
+		}
+		_, err := BuildForwards(conf, nil, nil, newTestLogger(t), nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got %v, want %q", err, test.err)
+		}
+	}
+}
+
+func TestBuildForwardsSharesUpstreams(t *testing.T) {
+	conf := &Config{
+		Upstreams: []Upstream{{Name: "up", Type: "socks5", Address: "127.0.0.1:1080"}},
+		Forwards: []Forward{
+			{Listen: "127.0.0.1:1", Target: "127.0.0.1:3", Upstream: "up"},
+			{Listen: "127.0.0.1:2", Target: "127.0.0.1:4", Upstream: "up"},
+		},
+	}
+	svc, err := BuildForwards(conf, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.stop(0)
+	if len(svc.resources) != 1 {
+		t.Fatalf("got %d upstream dialers, want 1", len(svc.resources))
+	}
+}
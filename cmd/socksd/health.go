@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthFailures = 3
+	defaultHealthCooldown = 30 * time.Second
+)
+
+// HealthChecker tracks which upstreams of a router are up. It checks them every
+// interval, and counts the failed dials through them: an upstream is taken out after
+// failures dials in a row fail, or as soon as a check fails, and put back when a check
+// or a trial dial, allowed once per cooldown, succeeds.
+type HealthChecker struct {
+	interval  time.Duration
+	timeout   time.Duration
+	probe     string
+	failures  int
+	cooldown  time.Duration
+	upstreams []*upstreamHealth
+	logger    *Logger
+	watches   closers
+	done      chan struct{}
+	once      sync.Once
+}
+
+type upstreamHealth struct {
+	name     string
+	address  string
+	forward  socks.Dialer
+	lock     sync.Mutex
+	failures int
+	down     bool
+	retry    time.Time
+	trial    bool
+}
+
+// NewHealthChecker starts checking the upstreams of proxy named names, listening at
+// addresses and dialed through forwards.
+func NewHealthChecker(conf HealthCheck, proxy string, names, addresses []string, forwards []socks.Dialer, logger *Logger, metrics *Metrics) *HealthChecker {
+	h := &HealthChecker{
+		interval: time.Duration(conf.Interval) * time.Second,
+		timeout:  time.Duration(conf.Timeout) * time.Second,
+		probe:    conf.Probe,
+		failures: conf.Failures,
+		cooldown: time.Duration(conf.Cooldown) * time.Second,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	if h.interval <= 0 {
+		h.interval = defaultHealthInterval
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultHealthTimeout
+	}
+	if h.failures <= 0 {
+		h.failures = defaultHealthFailures
+	}
+	if h.cooldown <= 0 {
+		h.cooldown = defaultHealthCooldown
+	}
+	for i, name := range names {
+		u := &upstreamHealth{name: name, address: addresses[i], forward: forwards[i]}
+		h.upstreams = append(h.upstreams, u)
+		h.watches.add(metrics.WatchUpstreamUp(proxy, name, u.up))
+	}
+	go h.run()
+	return h
+}
+
+// Close stops the checks.
+func (h *HealthChecker) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.once.Do(func() {
+		close(h.done)
+		h.watches.Close()
+	})
+	return nil
+}
+
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll()
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HealthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range h.upstreams {
+		wg.Add(1)
+		go func(u *upstreamHealth) {
+			defer wg.Done()
+			if err := h.check(u); err != nil {
+				h.setDown(u, time.Now(), err)
+				return
+			}
+			h.setUp(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// check fetches the probe through the upstream if there is one, so that its TLS,
+// websocket, mux and handshake are checked too: any HTTP response will do. Without a
+// probe, it only connects to the address of the upstream.
+func (h *HealthChecker) check(u *upstreamHealth) error {
+	if h.probe == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		conn, err := socks.DialContext(ctx, socks.Direct, "tcp", u.address)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return socks.DialContext(ctx, u.forward, network, address)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: h.timeout,
+	}
+	resp, err := client.Get(h.probe)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// acquire reports whether upstream i may be dialed at now. A down upstream may be
+// dialed once per cooldown, as a trial; release must follow the dial.
+func (h *HealthChecker) acquire(i int, now time.Time) bool {
+	if h == nil {
+		return true
+	}
+	u := h.upstreams[i]
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !u.down {
+		return true
+	}
+	if u.trial || now.Before(u.retry) {
+		return false
+	}
+	u.trial = true
+	return true
+}
+
+// release records the result of a dial through upstream i. Dials cancelled by the
+// caller and failure replies of the upstream don't count against it.
+func (h *HealthChecker) release(ctx context.Context, i int, err error) {
+	if h == nil {
+		return
+	}
+	u := h.upstreams[i]
+	var replyErr *socks.ReplyError
+	switch {
+	case err == nil || errors.As(err, &replyErr):
+		h.setUp(u)
+	case ctx.Err() != nil:
+		u.lock.Lock()
+		u.trial = false
+		u.lock.Unlock()
+	default:
+		h.failure(u, time.Now(), err)
+	}
+}
+
+func (h *HealthChecker) failure(u *upstreamHealth, now time.Time, err error) {
+	u.lock.Lock()
+	u.failures++
+	open := u.down || u.failures >= h.failures
+	u.lock.Unlock()
+	if open {
+		h.setDown(u, now, err)
+	}
+}
+
+func (h *HealthChecker) setDown(u *upstreamHealth, now time.Time, err error) {
+	u.lock.Lock()
+	changed := !u.down
+	u.down = true
+	u.trial = false
+	u.retry = now.Add(h.cooldown)
+	u.lock.Unlock()
+	if changed {
+		h.logger.Warn("upstream down", "upstream", u.name, "error", err, "retry", h.cooldown)
+	}
+}
+
+func (h *HealthChecker) setUp(u *upstreamHealth) {
+	u.lock.Lock()
+	changed := u.down
+	u.down = false
+	u.trial = false
+	u.failures = 0
+	u.lock.Unlock()
+	if changed {
+		h.logger.Info("upstream up", "upstream", u.name)
+	}
+}
+
+func (u *upstreamHealth) up() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return !u.down
+}
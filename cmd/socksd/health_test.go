@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+func newTestHealthChecker(t *testing.T, forwards ...socks.Dialer) *HealthChecker {
+	t.Helper()
+	h := &HealthChecker{
+		timeout:  5 * time.Second,
+		failures: 3,
+		cooldown: time.Minute,
+		logger:   newTestLogger(t),
+	}
+	for _, forward := range forwards {
+		h.upstreams = append(h.upstreams, &upstreamHealth{name: "upstream", forward: forward})
+	}
+	return h
+}
+
+func TestHealthCheckerBreaker(t *testing.T) {
+	h := newTestHealthChecker(t, nil)
+	u := h.upstreams[0]
+	ctx := context.Background()
+	failed := errors.New("connection refused")
+
+	// Failure replies show the upstream works, and reset the count.
+	h.release(ctx, 0, failed)
+	h.release(ctx, 0, failed)
+	h.release(ctx, 0, &socks.ReplyError{Reply: 5})
+	h.release(ctx, 0, failed)
+	h.release(ctx, 0, failed)
+	if !u.up() || !h.acquire(0, time.Now()) {
+		t.Fatal("down after two failures in a row")
+	}
+	h.release(ctx, 0, failed)
+	if u.up() {
+		t.Fatal("up after three failures in a row")
+	}
+
+	// One trial per cooldown.
+	now := time.Now()
+	if h.acquire(0, now) {
+		t.Fatal("acquired before the cooldown")
+	}
+	now = now.Add(h.cooldown)
+	if !h.acquire(0, now) {
+		t.Fatal("no trial after the cooldown")
+	}
+	if h.acquire(0, now) {
+		t.Fatal("second trial while the first one runs")
+	}
+
+	// A cancelled trial doesn't count, and lets another one through.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	h.release(cancelled, 0, context.Canceled)
+	if u.up() || !h.acquire(0, now) {
+		t.Fatal("cancelled trial not released")
+	}
+
+	// A failed trial waits for a new cooldown.
+	before := time.Now()
+	h.release(ctx, 0, failed)
+	if u.up() || u.retry.Before(before.Add(h.cooldown)) {
+		t.Fatalf("failed trial: retry at %v, want after %v", u.retry, before.Add(h.cooldown))
+	}
+	if h.acquire(0, now) {
+		t.Fatal("trial allowed before the new cooldown")
+	}
+
+	if !h.acquire(0, u.retry) {
+		t.Fatal("no trial after the new cooldown")
+	}
+	h.release(ctx, 0, nil)
+	if !u.up() || u.failures != 0 {
+		t.Fatal("down after a successful trial")
+	}
+}
+
+func TestHealthCheckerCheck(t *testing.T) {
+	address, dests := startUpstream(t)
+	client, err := socks.NewSocks5Client("tcp", address, "", "", socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHealthChecker(t, client)
+	h.upstreams[0].address = address
+
+	// Without a probe, the upstream is only connected to.
+	h.checkAll()
+	if !h.upstreams[0].up() {
+		t.Fatal("working upstream down")
+	}
+	select {
+	case dest := <-dests:
+		t.Fatalf("checked through the upstream to %s", dest)
+	default:
+	}
+
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer probe.Close()
+	h.probe = probe.URL
+	h.checkAll()
+	if !h.upstreams[0].up() {
+		t.Fatal("working upstream down with a probe")
+	}
+	if dest := <-dests; dest != strings.TrimPrefix(probe.URL, "http://") {
+		t.Fatalf("probed %s, want %s", dest, probe.URL)
+	}
+
+	// An upstream not listening is down.
+	h = newTestHealthChecker(t, client)
+	h.upstreams[0].address = freeAddress(t, "tcp")
+	h.checkAll()
+	if h.upstreams[0].up() {
+		t.Fatal("upstream not listening up")
+	}
+
+	// With a probe, a server taking connections but not speaking SOCKS5 is down.
+	greeter := startGreeter(t, "not socks")
+	client, err = socks.NewSocks5Client("tcp", greeter, "", "", socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newTestHealthChecker(t, client)
+	h.upstreams[0].address = greeter
+	h.probe = probe.URL
+	h.checkAll()
+	if h.upstreams[0].up() {
+		t.Fatal("upstream not speaking SOCKS5 up")
+	}
+}
+
+func TestUpstreamDialerFailover(t *testing.T) {
+	target := startGreeter(t, "hello")
+	failing := &recordingDialer{}
+	dialers := []socks.Dialer{failing, socks.Direct}
+
+	// A dial tries one upstream by default.
+	router := NewUpstreamDialer(dialers, 0, newTestLogger(t))
+	failures := 0
+	for i := 0; i < 2; i++ {
+		conn, err := router.Dial("tcp", target)
+		if err != nil {
+			failures++
+			continue
+		}
+		conn.Close()
+	}
+	if failures != 1 {
+		t.Fatalf("got %d failed dials with one attempt each, want 1", failures)
+	}
+
+	router = NewUpstreamDialer(dialers, 2, newTestLogger(t))
+	failing.addresses = nil
+	for i := 0; i < 2; i++ {
+		conn, err := router.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+	}
+	if len(failing.addresses) != 1 {
+		t.Fatalf("failing upstream tried %d times, want 1", len(failing.addresses))
+	}
+
+	// A failure reply is about the destination, so the next upstream isn't tried.
+	address, _ := startUpstream(t)
+	client, err := socks.NewSocks5Client("tcp", address, "", "", socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &recordingDialer{}
+	router = NewUpstreamDialer([]socks.Dialer{other, client}, 2, newTestLogger(t))
+	_, err = router.Dial("tcp", freeAddress(t, "tcp"))
+	var replyErr *socks.ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("got %v, want a failure reply", err)
+	}
+	if len(other.addresses) != 0 {
+		t.Fatalf("dial tried again through another upstream after a failure reply")
+	}
+}
+
+func TestUpstreamName(t *testing.T) {
+	upstreams := []Upstream{
+		{Address: "a:1"},
+		{Address: "a:1", Name: "second"},
+		{Address: "b:1"},
+		{Address: "b:1", Crypto: "rc4"},
+	}
+	want := []string{"a:1", "second", "b:1#2", "b:1#3"}
+	for i := range upstreams {
+		if name := UpstreamName(upstreams, i); name != want[i] {
+			t.Errorf("upstream %d: got %q, want %q", i, name, want[i])
+		}
+	}
+}
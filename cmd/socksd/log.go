@@ -1,12 +1,141 @@
 package main
 
 import (
-	"log"
-	"os"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
-var (
-	InfoLog = log.New(os.Stdout, "INFO  ", log.LstdFlags)
-	ErrLog  = log.New(os.Stderr, "ERROR ", log.LstdFlags)
-	WarnLog = log.New(os.Stdout, "WARN  ", log.LstdFlags)
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
 )
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for n, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(n), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level " + s)
+}
+
+// Logger implements socks.Logger, writing one line per event in text or JSON format.
+type Logger struct {
+	lock   *sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	json   bool
+	fields []interface{}
+}
+
+func NewLogger(w io.Writer, level LogLevel, format string) (*Logger, error) {
+	l := &Logger{
+		lock:  &sync.Mutex{},
+		w:     w,
+		level: level,
+	}
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		l.json = true
+	default:
+		return nil, errors.New("unknown log format " + format)
+	}
+	return l, nil
+}
+
+// With returns a Logger that adds keyvals to every event.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	return &Logger{
+		lock:   l.lock,
+		w:      l.w,
+		level:  l.level,
+		json:   l.json,
+		fields: append(append([]interface{}(nil), l.fields...), keyvals...),
+	}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *Logger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	keyvals = append(l.fields[:len(l.fields):len(l.fields)], keyvals...)
+	buff := bytes.NewBuffer(nil)
+	now := time.Now().Format(time.RFC3339)
+	if l.json {
+		buff.WriteString(`{"time":`)
+		writeJSON(buff, now)
+		buff.WriteString(`,"level":`)
+		writeJSON(buff, level.String())
+		buff.WriteString(`,"msg":`)
+		writeJSON(buff, msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			buff.WriteByte(',')
+			writeJSON(buff, fmt.Sprint(keyvals[i]))
+			buff.WriteByte(':')
+			writeJSON(buff, logValue(keyvals, i+1))
+		}
+		buff.WriteString("}\n")
+	} else {
+		fmt.Fprintf(buff, "%s %-5s %s", now, level, msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			v := fmt.Sprint(logValue(keyvals, i+1))
+			if strings.ContainsAny(v, " \"=") || v == "" {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(buff, " %v=%s", keyvals[i], v)
+		}
+		buff.WriteByte('\n')
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.w.Write(buff.Bytes())
+}
+
+// logValue returns keyvals[i] in a form suitable for both formats.
+func logValue(keyvals []interface{}, i int) interface{} {
+	if i >= len(keyvals) {
+		return "!MISSING"
+	}
+	switch v := keyvals[i].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return keyvals[i]
+}
+
+func writeJSON(buff *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buff.Write(data)
+}
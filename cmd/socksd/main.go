@@ -2,149 +2,497 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
 	"flag"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/eahydra/socks"
 )
 
 func main() {
-	var configFile string
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
+	var configFile, format string
+	var watch bool
 	flag.StringVar(&configFile, "c", "socks.config", "config file path")
+	flag.StringVar(&format, "f", "", "config format: json, yaml or toml (default by file extension, else json)")
+	flag.BoolVar(&watch, "watch", false, "reload the config file when it changes")
 	flag.Parse()
 
-	conf, err := LoadConfig(configFile)
+	logger, _ := NewLogger(os.Stderr, LevelInfo, "text")
+	conf, err := LoadConfig(configFile, format)
 	if err != nil {
-		ErrLog.Println("initGlobalConfig failed, err:", err)
+		logConfigError(logger, "failed to load config", configFile, err)
+		return
+	}
+	if logger, err = BuildLogger(conf.Log); err != nil {
+		os.Stderr.WriteString("failed to build logger: " + err.Error() + "\n")
 		return
 	}
-	InfoLog.Println("load config succeeded")
+	logger.Info("load config succeeded", "file", configFile)
 
-	for _, c := range conf.Proxies {
-		router := BuildUpstreamRouter(c)
-		runHTTPProxyServer(c, router)
-		runSOCKS4Server(c, router)
-		runSOCKS5Server(c, router)
+	var metrics *Metrics
+	if conf.Metrics != "" {
+		metrics = NewMetrics()
+		runMetricsServer(conf.Metrics, metrics, logger)
 	}
-	runPACServer(conf.PAC)
 
+	server := NewServer(logger, metrics)
+	if err := server.Reload(conf); err != nil {
+		logger.Error("invalid config", "file", configFile, "error", err)
+		return
+	}
+	defer server.Close()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	changed := make(chan struct{}, 1)
+	if watch {
+		go watchConfig(configFile, changed)
+	}
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Kill, os.Interrupt)
-	<-sigChan
+	for {
+		select {
+		case <-reload:
+		case <-changed:
+		case <-sigChan:
+			return
+		}
+		conf, err := LoadConfig(configFile, format)
+		if err == nil {
+			err = server.Reload(conf)
+		}
+		if err != nil {
+			logConfigError(logger, "failed to reload config, keeping the running one", configFile, err)
+			continue
+		}
+		logger.Info("reload config succeeded", "file", configFile)
+	}
 }
 
-func BuildUpstream(upstream Upstream, forward socks.Dialer) (socks.Dialer, error) {
-	cipherDecorator := NewCipherConnDecorator(upstream.Crypto, upstream.Password)
-	forward = NewDecorateClient(forward, cipherDecorator)
+// runCheck validates a config file like socksd does when loading it, and prints its
+// problems, one per line.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configFile := flags.String("c", "socks.config", "config file path")
+	format := flags.String("f", "", "config format: json, yaml or toml (default by file extension, else json)")
+	flags.Parse(args)
+	_, err := LoadConfig(*configFile, *format)
+	if err == nil {
+		os.Stdout.WriteString(*configFile + ": ok\n")
+		return 0
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		errs = ConfigErrors{{Err: err.Error()}}
+	}
+	for _, err := range errs {
+		os.Stderr.WriteString(*configFile + ": " + err.Error() + "\n")
+	}
+	return 1
+}
 
-	switch strings.ToLower(upstream.Type) {
-	case "socks5":
-		{
-			return socks.NewSocks5Client("tcp", upstream.Address, "", "", forward)
+// logConfigError logs err, one line per problem for ConfigErrors.
+func logConfigError(logger *Logger, msg, file string, err error) {
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		logger.Error(msg, "file", file, "error", err)
+		return
+	}
+	for _, err := range errs {
+		logger.Error(msg, "file", file, "path", err.Path, "error", err.Err)
+	}
+}
+
+// watchConfig signals changed when the modification time of file changes, checking it
+// every reloadCheckInterval.
+func watchConfig(file string, changed chan<- struct{}) {
+	var modTime time.Time
+	if fi, err := os.Stat(file); err == nil {
+		modTime = fi.ModTime()
+	}
+	for range time.Tick(reloadCheckInterval) {
+		fi, err := os.Stat(file)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
 		}
-	case "shadowsocks":
-		{
-			return socks.NewShadowSocksClient("tcp", upstream.Address, forward)
+		modTime = fi.ModTime()
+		select {
+		case changed <- struct{}{}:
+		default:
 		}
 	}
-	return nil, errors.New("unknown upstream type" + upstream.Type)
 }
 
-func BuildUpstreamRouter(conf Proxy) socks.Dialer {
+func BuildLogger(conf Log) (*Logger, error) {
+	level, err := ParseLogLevel(conf.Level)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(os.Stderr, level, conf.Format)
+}
+
+// BuildUpstream returns a Dialer through upstream, and the closer of the connections it
+// keeps, like those of its warm pool or mux sessions. proxy names the user of upstream in
+// metrics.
+func BuildUpstream(upstream Upstream, proxy string, forward socks.Dialer, logger *Logger, metrics *Metrics) (socks.Dialer, io.Closer, error) {
+	upstreamType := strings.ToLower(upstream.Type)
+	if upstreamType != "socks5" && upstreamType != "shadowsocks" {
+		return nil, nil, errors.New("unknown upstream type " + upstream.Type)
+	}
+	if upstream.Pool != nil && upstream.Mux != nil {
+		return nil, nil, errors.New("pool and mux can't be combined")
+	}
+	policy, err := socks.ParseResolvePolicy(upstream.Resolve)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []socks.Option{socks.WithLogger(logger), socks.WithResolvePolicy(policy)}
+	tlsConfig, pins, err := BuildUpstreamTLSConfig(upstream, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	// TLS belongs to the outermost layer: the WebSocket connection, which makes it wss,
+	// else the mux connection, else the upstream protocol.
+	if tlsConfig != nil && upstream.WebSocket == nil && upstream.Mux == nil && upstreamType != "socks5" {
+		return nil, nil, errors.New("tls is not supported by upstream type " + upstream.Type)
+	}
+	var tlsOpts []socks.Option
+	if tlsConfig != nil {
+		tlsOpts = []socks.Option{socks.WithTLSConfig(tlsConfig), socks.WithCertificatePins(pins...)}
+	}
+	if upstream.WebSocket != nil {
+		forward, err = socks.NewWebSocketClient(upstream.WebSocket.Path, upstream.WebSocket.Host, forward,
+			append([]socks.Option{socks.WithLogger(logger)}, tlsOpts...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsOpts = nil
+	}
+	cipherDecorator := NewCipherConnDecorator(upstream.Crypto, upstream.Password)
+	forward = NewDecorateClient(forward, cipherDecorator)
+	var closer closers
+	if upstream.Pool != nil {
+		pool := socks.NewWarmPool(forward, socks.PoolConfig{
+			Size:    upstream.Pool.Size,
+			MaxIdle: time.Duration(upstream.Pool.MaxIdle) * time.Second,
+		}, socks.WithLogger(logger))
+		pool.Warm("tcp", upstream.Address)
+		closer = append(closer, pool, metrics.WatchUpstreamPool(proxy, upstream.Address, pool.Idle))
+		forward = pool
+	}
+	if upstream.Mux != nil {
+		mux := socks.NewMuxClient(forward, BuildMuxConfig(*upstream.Mux),
+			append([]socks.Option{socks.WithLogger(logger)}, tlsOpts...)...)
+		closer = append(closer, mux)
+		forward = mux
+		tlsOpts = nil
+	}
+	opts = append(opts, tlsOpts...)
+
+	if upstreamType == "socks5" {
+		client, err := socks.NewSocks5Client("tcp", upstream.Address, "", "", forward, opts...)
+		return client, closer, err
+	}
+	client, err := socks.NewShadowSocksClient("tcp", upstream.Address, forward, opts...)
+	return client, closer, err
+}
+
+// BuildUpstreamRouter returns the dialer spreading the connections of conf over its
+// upstreams, and the closer of the connections they keep and of their health checks.
+func BuildUpstreamRouter(conf Proxy, logger *Logger, metrics *Metrics) (socks.Dialer, io.Closer, error) {
 	var allForward []socks.Dialer
-	for _, upstream := range conf.Upstreams {
-		var forward socks.Dialer
-		var err error
-		forward = NewDecorateDirect(conf.DNSCacheTimeout)
-		forward, err = BuildUpstream(upstream, forward)
+	var names, addresses []string
+	var closer closers
+	for i, upstream := range conf.Upstreams {
+		forward, upstreamCloser, err := BuildUpstream(upstream, ProxyName(conf), NewDecorateDirect(conf.DNSCacheTimeout, metrics), logger, metrics)
 		if err != nil {
-			ErrLog.Println("failed to BuildUpstream, err:", err)
-			continue
+			closer.Close()
+			return nil, nil, errors.New("upstream " + upstream.Address + ": " + err.Error())
 		}
-		allForward = append(allForward, forward)
+		closer.add(upstreamCloser)
+		name := UpstreamName(conf.Upstreams, i)
+		allForward = append(allForward, &namedDialer{name: name, forward: forward, metrics: metrics})
+		names = append(names, name)
+		addresses = append(addresses, upstream.Address)
 	}
 	if len(allForward) == 0 {
-		router := NewDecorateDirect(conf.DNSCacheTimeout)
-		allForward = append(allForward, router)
+		router := NewDecorateDirect(conf.DNSCacheTimeout, metrics)
+		allForward = append(allForward, &namedDialer{name: "direct", forward: router, metrics: metrics})
 	}
-	return NewUpstreamDialer(allForward)
+	router := NewUpstreamDialer(allForward, conf.Attempts, logger)
+	if conf.HealthCheck != nil && len(names) != 0 {
+		router.CheckHealth(NewHealthChecker(*conf.HealthCheck, ProxyName(conf), names, addresses, allForward, logger, metrics))
+		closer.add(router)
+	}
+	return router, closer, nil
 }
 
-func runHTTPProxyServer(conf Proxy, router socks.Dialer) {
+// UpstreamName names upstreams[i] in logs and metrics by its name, or else by its
+// address, followed by its index if another unnamed one of upstreams has the same
+// address.
+func UpstreamName(upstreams []Upstream, i int) string {
+	upstream := upstreams[i]
+	if upstream.Name != "" {
+		return upstream.Name
+	}
+	for j, other := range upstreams {
+		if j != i && other.Name == "" && other.Address == upstream.Address {
+			return upstream.Address + "#" + strconv.Itoa(i)
+		}
+	}
+	return upstream.Address
+}
+
+// ProxyName names conf in metrics by its first listen address.
+func ProxyName(conf Proxy) string {
+	for _, address := range []string{conf.SOCKS5, conf.SOCKS4, conf.HTTP, conf.Redir} {
+		if address != "" {
+			return address
+		}
+	}
+	if conf.DNS != nil {
+		return conf.DNS.Address
+	}
+	return ""
+}
+
+func BuildListenerDecorators(conf Proxy, global *RateLimiter) []ConnDecorator {
+	var ds []ConnDecorator
+	if global != nil {
+		ds = append(ds, NewRateLimitDecorator(global))
+	}
+	if limiter := NewRateLimiter(conf.RateLimit); limiter != nil {
+		ds = append(ds, NewRateLimitDecorator(limiter))
+	}
+	if conf.ConnRateLimit.Upload > 0 || conf.ConnRateLimit.Download > 0 {
+		ds = append(ds, NewConnRateLimitDecorator(conf.ConnRateLimit))
+	}
+	return ds
+}
+
+func BuildServerOptions(conf Proxy, global *socks.ConnLimiter, logger *Logger) []socks.Option {
+	opts := []socks.Option{socks.WithConnLimiter(global), socks.WithLogger(logger)}
+	if len(conf.UserRateLimits) != 0 {
+		opts = append(opts, socks.WithSessionDecorator(NewUserRateLimitDecorator(conf.UserRateLimits)))
+	}
+	if len(conf.Users) != 0 {
+		opts = append(opts, socks.WithAuthenticators(NewUsersAuthenticator(conf.Users)))
+	}
+	return opts
+}
+
+// NewUsersAuthenticator returns a USERNAME/PASSWORD authenticator accepting users,
+// a map from username to password.
+func NewUsersAuthenticator(users map[string]string) socks.Authenticator {
+	return &socks.UserPassAuthenticator{
+		Verify: func(username, password string) bool {
+			want, ok := users[username]
+			return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+		},
+	}
+}
+
+func BuildConnLimiter(limit ConnLimit) *socks.ConnLimiter {
+	if limit == (ConnLimit{}) {
+		return nil
+	}
+	return socks.NewConnLimiter(limit.MaxSessions, limit.MaxSessionsPerIP, limit.AcceptRate, limit.AcceptBurst)
+}
+
+// BuildWebSocketListener returns listener accepting WebSocket connections if conf has a
+// websocket section. TLS is then served by the WebSocket listener, so it is taken out of
+// the returned options.
+func BuildWebSocketListener(conf Proxy, listener net.Listener, opts []socks.Option) (net.Listener, []socks.Option) {
+	if conf.WebSocket == nil {
+		return listener, opts
+	}
+	listener = socks.NewWebSocketListener(listener, conf.WebSocket.Path, opts...)
+	return listener, append(opts[:len(opts):len(opts)], socks.WithTLSConfig(nil))
+}
+
+// BuildMuxListener returns listener accepting mux streams if conf has a mux section.
+// TLS is then served by the mux listener, so it is taken out of the returned options.
+func BuildMuxListener(conf Proxy, listener net.Listener, opts []socks.Option) (net.Listener, []socks.Option) {
+	if conf.Mux == nil {
+		return listener, opts
+	}
+	listener = socks.NewMuxListener(listener, BuildMuxConfig(*conf.Mux), opts...)
+	return listener, append(opts[:len(opts):len(opts)], socks.WithTLSConfig(nil))
+}
+
+func BuildMuxConfig(conf Mux) socks.MuxConfig {
+	return socks.MuxConfig{
+		Sessions:  conf.Sessions,
+		KeepAlive: time.Duration(conf.KeepAlive) * time.Second,
+	}
+}
+
+// listenerOptions returns opts plus the options that belong to one listener of conf.
+func listenerOptions(conf Proxy, opts []socks.Option, extra ...socks.Option) []socks.Option {
+	lopts := append([]socks.Option(nil), opts...)
+	lopts = append(lopts, socks.WithConnLimiter(BuildConnLimiter(conf.ConnLimit)))
+	return append(lopts, extra...)
+}
+
+func runHTTPProxyServer(conf Proxy, router socks.Dialer, ds []ConnDecorator, opts []socks.Option, metrics *Metrics, st *startup) error {
 	if conf.HTTP != "" {
 		listener, err := net.Listen("tcp", conf.HTTP)
 		if err != nil {
-			ErrLog.Println("net.Listen at ", conf.HTTP, " failed, err:", err)
-			return
+			return err
 		}
-		go func() {
-			defer listener.Close()
-			httpProxy := socks.NewHTTPProxy(router)
+		listener = NewDecorateListener(st.track(listener), ds...)
+		httpProxy := socks.NewHTTPProxy(router, listenerOptions(conf, opts,
+			socks.WithListenerName(conf.HTTP),
+			socks.WithObserver(metrics.ListenerObserver("http", conf.HTTP)))...)
+		st.serve(listener, func() {
 			http.Serve(listener, httpProxy)
-		}()
+		})
 	}
+	return nil
 }
 
-func runSOCKS4Server(conf Proxy, forward socks.Dialer) {
+func runSOCKS4Server(conf Proxy, forward socks.Dialer, ds []ConnDecorator, opts []socks.Option, metrics *Metrics, st *startup) error {
 	if conf.SOCKS4 != "" {
 		listener, err := net.Listen("tcp", conf.SOCKS4)
 		if err != nil {
-			ErrLog.Println("net.Listen failed, err:", err, conf.SOCKS4)
-			return
+			return err
 		}
 		cipherDecorator := NewCipherConnDecorator(conf.Crypto, conf.Password)
+		listener = NewDecorateListener(st.track(listener), ds...)
+		listener, opts = BuildWebSocketListener(conf, listener, opts)
 		listener = NewDecorateListener(listener, cipherDecorator)
-		socks4Svr, err := socks.NewSocks4Server(forward)
+		listener, opts = BuildMuxListener(conf, listener, opts)
+		socks4Svr, err := socks.NewSocks4Server(forward, listenerOptions(conf, opts,
+			socks.WithListenerName(conf.SOCKS4),
+			socks.WithObserver(metrics.ListenerObserver("socks4", conf.SOCKS4)))...)
 		if err != nil {
 			listener.Close()
-			ErrLog.Println("socks.NewSocks4Server failed, err:", err)
+			return errors.New("socks4 " + conf.SOCKS4 + ": " + err.Error())
 		}
-		go func() {
-			defer listener.Close()
+		st.serve(listener, func() {
 			socks4Svr.Serve(listener)
-		}()
+		})
 	}
+	return nil
 }
 
-func runSOCKS5Server(conf Proxy, forward socks.Dialer) {
+func runSOCKS5Server(conf Proxy, forward socks.Dialer, ds []ConnDecorator, opts []socks.Option, metrics *Metrics, st *startup) error {
 	if conf.SOCKS5 != "" {
 		listener, err := net.Listen("tcp", conf.SOCKS5)
 		if err != nil {
-			ErrLog.Println("net.Listen failed, err:", err, conf.SOCKS5)
-			return
+			return err
 		}
 		cipherDecorator := NewCipherConnDecorator(conf.Crypto, conf.Password)
+		listener = NewDecorateListener(st.track(listener), ds...)
+		listener, opts = BuildWebSocketListener(conf, listener, opts)
 		listener = NewDecorateListener(listener, cipherDecorator)
-		socks5Svr, err := socks.NewSocks5Server(forward)
+		listener, opts = BuildMuxListener(conf, listener, opts)
+		socks5Svr, err := socks.NewSocks5Server(forward, listenerOptions(conf, opts,
+			socks.WithHandler(BuildListenHandler(conf, forward)),
+			socks.WithListenerName(conf.SOCKS5),
+			socks.WithObserver(metrics.ListenerObserver("socks5", conf.SOCKS5)))...)
 		if err != nil {
 			listener.Close()
-			ErrLog.Println("socks.NewSocks5Server failed, err:", err)
-			return
+			return errors.New("socks5 " + conf.SOCKS5 + ": " + err.Error())
 		}
-		go func() {
-			defer listener.Close()
+		st.serve(listener, func() {
 			socks5Svr.Serve(listener)
-		}()
+		})
 	}
+	return nil
 }
 
-func runPACServer(pac PAC) {
-	pu, err := NewPACUpdater(pac)
+// BuildListenHandler returns the handler serving LISTEN requests for the addresses listed
+// in the bind of conf, or nil if there are none.
+func BuildListenHandler(conf Proxy, forward socks.Dialer) socks.Socks5Handler {
+	if len(conf.Bind) == 0 {
+		return nil
+	}
+	return socks.ListenHandler(socks.ConnectHandler(forward), func(address string) bool {
+		for _, allowed := range conf.Bind {
+			if address == allowed {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// BuildDNSServer returns the DNS forwarder of conf, or nil if it has none.
+func BuildDNSServer(conf Proxy, router socks.Dialer, fakeIPs *FakeIPPool, logger *Logger) (*DNSServer, error) {
+	if conf.DNS == nil {
+		return nil, nil
+	}
+	return NewDNSServer(*conf.DNS, router, fakeIPs, logger)
+}
+
+func runDNSServer(conf Proxy, server *DNSServer, st *startup) error {
+	if server == nil {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", conf.DNS.Address)
 	if err != nil {
-		ErrLog.Println("failed to NewPACUpdater, err:", err)
-		return
+		return err
 	}
+	st.serve(conn, func() {
+		server.ServeUDP(conn)
+	})
+	listener, err := net.Listen("tcp", conf.DNS.Address)
+	if err != nil {
+		return err
+	}
+	listener = st.track(listener)
+	st.serve(listener, func() {
+		server.ServeTCP(listener)
+	})
+	return nil
+}
+
+func runPACServer(pac PAC, logger *Logger, metrics *Metrics, st *startup) error {
+	listener, err := net.Listen("tcp", pac.Address)
+	if err != nil {
+		return err
+	}
+	pu, err := NewPACUpdater(pac, logger, metrics)
+	if err != nil {
+		listener.Close()
+		return errors.New("pac: " + err.Error())
+	}
+	st.listeners.add(pu)
 
-	http.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/x-ns-proxy-autoconfig")
 		data, time := pu.get()
 		reader := bytes.NewReader(data)
 		http.ServeContent(w, r, "proxy.pac", time, reader)
 	})
-	go http.ListenAndServe(pac.Address, nil)
+	listener = st.track(listener)
+	st.serve(listener, func() {
+		http.Serve(listener, mux)
+	})
+	return nil
+}
+
+func runMetricsServer(address string, metrics *Metrics, logger *Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Error("failed to serve metrics", "address", address, "error", err)
+		}
+	}()
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+var dialDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects socksd metrics and serves them in the Prometheus text format.
+// A nil *Metrics discards everything, so callers don't need to check whether
+// metrics are enabled.
+type Metrics struct {
+	lock    sync.Mutex
+	metrics []*metric
+
+	sessionsActive   *metric
+	accepted         *metric
+	rejected         *metric
+	bytes            *metric
+	upstreamDials    *metric
+	upstreamFailures *metric
+	upstreamDuration *metric
+	upstreamPoolIdle *metric
+	upstreamUp       *metric
+	dnsCacheHits     *metric
+	dnsCacheMisses   *metric
+	pacLastSuccess   *metric
+	pacRules         *metric
+
+	// watches are the gauges read when the metrics are written, by metric and labels.
+	watches map[string]*gaugeWatch
+}
+
+type gaugeWatch struct {
+	metric      *metric
+	labelValues []string
+	value       func() float64
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{watches: make(map[string]*gaugeWatch)}
+	m.sessionsActive = m.newMetric("socksd_sessions_active", "Number of active sessions.", "gauge", "protocol", "listener")
+	m.accepted = m.newMetric("socksd_connections_accepted_total", "Number of accepted connections.", "counter", "protocol", "listener")
+	m.rejected = m.newMetric("socksd_connections_rejected_total", "Number of connections rejected by limits.", "counter", "protocol", "listener")
+	m.bytes = m.newMetric("socksd_bytes_total", "Bytes relayed, up is from clients and down is to clients.", "counter", "protocol", "listener", "direction")
+	m.upstreamDials = m.newMetric("socksd_upstream_dials_total", "Number of dial attempts through an upstream.", "counter", "upstream")
+	m.upstreamFailures = m.newMetric("socksd_upstream_dial_failures_total", "Number of failed dials through an upstream.", "counter", "upstream")
+	m.upstreamDuration = m.newMetric("socksd_upstream_dial_duration_seconds", "Latency of dials through an upstream.", "histogram", "upstream")
+	m.upstreamDuration.buckets = dialDurationBuckets
+	m.upstreamPoolIdle = m.newMetric("socksd_upstream_pool_idle_connections", "Number of idle connections in the warm pool of an upstream.", "gauge", "proxy", "upstream")
+	m.upstreamUp = m.newMetric("socksd_upstream_up", "Whether health checks find an upstream up.", "gauge", "proxy", "upstream")
+	m.dnsCacheHits = m.newMetric("socksd_dns_cache_hits_total", "Number of DNS cache lookups that hit.", "counter")
+	m.dnsCacheMisses = m.newMetric("socksd_dns_cache_misses_total", "Number of DNS cache lookups that missed.", "counter")
+	m.newMetric("socksd_dns_cache_hit_ratio", "Ratio of DNS cache lookups that hit.", "gauge").fn = func() float64 {
+		hits, misses := m.dnsCacheHits.get(), m.dnsCacheMisses.get()
+		if hits+misses == 0 {
+			return 0
+		}
+		return hits / (hits + misses)
+	}
+	m.pacLastSuccess = m.newMetric("socksd_pac_last_success_timestamp_seconds", "Unix time of the last successful PAC rule update.", "gauge", "source")
+	m.pacRules = m.newMetric("socksd_pac_rules", "Number of rules loaded by the last successful PAC rule update.", "gauge", "source")
+	return m
+}
+
+func (m *Metrics) newMetric(name, help, typ string, labels ...string) *metric {
+	metric := &metric{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+	m.lock.Lock()
+	m.metrics = append(m.metrics, metric)
+	m.lock.Unlock()
+	return metric
+}
+
+// ListenerObserver returns a socks.Observer that records the sessions of one listener.
+func (m *Metrics) ListenerObserver(protocol, listener string) socks.Observer {
+	if m == nil {
+		return nil
+	}
+	return &metricsObserver{metrics: m, protocol: protocol, listener: listener}
+}
+
+func (m *Metrics) ObserveUpstreamDial(upstream string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.upstreamDials.add(1, upstream)
+	if err != nil {
+		m.upstreamFailures.add(1, upstream)
+	}
+	m.upstreamDuration.observe(duration.Seconds(), upstream)
+}
+
+// WatchUpstreamPool makes the metrics report idle, the number of idle connections in
+// the warm pool of upstream, until the returned closer is closed.
+func (m *Metrics) WatchUpstreamPool(proxy, upstream string, idle func() int) io.Closer {
+	return m.watch(m.upstreamPoolIdle, func() float64 { return float64(idle()) }, proxy, upstream)
+}
+
+// WatchUpstreamUp makes the metrics report whether health checks find upstream up,
+// until the returned closer is closed.
+func (m *Metrics) WatchUpstreamUp(proxy, upstream string, up func() bool) io.Closer {
+	return m.watch(m.upstreamUp, func() float64 {
+		if up() {
+			return 1
+		}
+		return 0
+	}, proxy, upstream)
+}
+
+// watch makes the metrics set the gauge metric to value when they are written, until
+// the returned closer is closed. A later watch of the same series replaces it, and
+// isn't removed by the closer of the earlier one, so that reloads can overlap.
+func (m *Metrics) watch(metric *metric, value func() float64, labelValues ...string) io.Closer {
+	if m == nil {
+		return closers(nil)
+	}
+	key := metric.name + "\xff" + strings.Join(labelValues, "\xff")
+	w := &gaugeWatch{metric: metric, labelValues: labelValues, value: value}
+	m.lock.Lock()
+	m.watches[key] = w
+	m.lock.Unlock()
+	return closerFunc(func() error {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if m.watches[key] == w {
+			delete(m.watches, key)
+			metric.remove(labelValues...)
+		}
+		return nil
+	})
+}
+
+func (m *Metrics) ObserveDNSCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.dnsCacheHits.add(1)
+	} else {
+		m.dnsCacheMisses.add(1)
+	}
+}
+
+func (m *Metrics) ObservePACUpdate(source string, rules int) {
+	if m == nil {
+		return
+	}
+	m.pacLastSuccess.set(float64(time.Now().Unix()), source)
+	m.pacRules.set(float64(rules), source)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) error {
+	m.lock.Lock()
+	metrics := append([]*metric(nil), m.metrics...)
+	for _, w := range m.watches {
+		w.metric.set(w.value(), w.labelValues...)
+	}
+	m.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		metric.write(bw)
+	}
+	return bw.Flush()
+}
+
+type metricsObserver struct {
+	metrics  *Metrics
+	protocol string
+	listener string
+}
+
+func (o *metricsObserver) OnAccept(clientAddr string) {
+	o.metrics.accepted.add(1, o.protocol, o.listener)
+}
+
+func (o *metricsObserver) OnReject(clientAddr string) {
+	o.metrics.rejected.add(1, o.protocol, o.listener)
+}
+
+func (o *metricsObserver) OnSessionStart(info *socks.SessionInfo) {
+	o.metrics.sessionsActive.add(1, o.protocol, o.listener)
+}
+
+// OnTraffic counts the bytes of sessions as they are relayed, so that long sessions
+// show up before they end.
+func (o *metricsObserver) OnTraffic(info *socks.SessionInfo, bytesUp, bytesDown int64) {
+	if bytesUp != 0 {
+		o.metrics.bytes.add(float64(bytesUp), o.protocol, o.listener, "up")
+	}
+	if bytesDown != 0 {
+		o.metrics.bytes.add(float64(bytesDown), o.protocol, o.listener, "down")
+	}
+}
+
+func (o *metricsObserver) OnSessionEnd(info *socks.SessionInfo, bytesUp, bytesDown int64, duration time.Duration, err error) {
+	o.metrics.sessionsActive.add(-1, o.protocol, o.listener)
+}
+
+func (o *metricsObserver) OnDialFailed(info *socks.SessionInfo, err error) {}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func (m *metric) getSeries(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.lock.Lock()
+	m.getSeries(labelValues).value += v
+	m.lock.Unlock()
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.lock.Lock()
+	m.getSeries(labelValues).value = v
+	m.lock.Unlock()
+}
+
+func (m *metric) remove(labelValues ...string) {
+	m.lock.Lock()
+	delete(m.series, strings.Join(labelValues, "\xff"))
+	m.lock.Unlock()
+}
+
+// get returns the value of the metric without labels.
+func (m *metric) get() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.getSeries(nil).value
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.getSeries(labelValues)
+	for n, bound := range m.buckets {
+		if v <= bound {
+			s.counts[n]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	if m.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+			continue
+		}
+		names := append(append([]string(nil), m.labels...), "le")
+		values := append(append([]string(nil), s.labelValues...), "")
+		for n, bound := range m.buckets {
+			values[len(values)-1] = formatFloat(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.counts[n])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for n, name := range names {
+		pairs[n] = name + `="` + labelEscaper.Replace(values[n]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
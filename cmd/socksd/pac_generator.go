@@ -79,7 +79,7 @@ func (p *PACGenerator) Generate(rules []string) ([]byte, error) {
 	}
 	t, err := template.New("proxy.pac").Parse(pacTemplate)
 	if err != nil {
-		ErrLog.Println("failed to parse pacTempalte, err:", err)
+		return nil, err
 	}
 	buff := bytes.NewBuffer(nil)
 	err = t.Execute(buff, &data)
@@ -13,15 +13,22 @@ import (
 
 type PACUpdater struct {
 	pac     PAC
+	logger  *Logger
+	metrics *Metrics
 	lock    sync.RWMutex
 	data    []byte
 	modtime time.Time
 	timer   *time.Timer
+	done    chan struct{}
+	once    sync.Once
 }
 
-func NewPACUpdater(pac PAC) (*PACUpdater, error) {
+func NewPACUpdater(pac PAC, logger *Logger, metrics *Metrics) (*PACUpdater, error) {
 	p := &PACUpdater{
-		pac: pac,
+		pac:     pac,
+		logger:  logger,
+		metrics: metrics,
+		done:    make(chan struct{}),
 	}
 	go p.backgroundUpdate()
 	return p, nil
@@ -53,11 +60,12 @@ func loadLocalRule(filepath string) ([]string, error) {
 	return parseRule(f)
 }
 
-func loadRemoteRule(ruleURL string, upstream Upstream) ([]string, error) {
-	forward, err := BuildUpstream(upstream, socks.Direct)
+func loadRemoteRule(ruleURL string, upstream Upstream, logger *Logger) ([]string, error) {
+	forward, closer, err := BuildUpstream(upstream, "pac", socks.Direct, logger, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer closer.Close()
 	client := &http.Client{
 		Transport: &http.Transport{
 			Dial: forward.Dial,
@@ -94,17 +102,37 @@ func (p *PACUpdater) backgroundUpdate() {
 		if rules, err := loadLocalRule(p.pac.LocalRules); err == nil {
 			if data, err := pg.Generate(rules); err == nil {
 				p.set(data)
-				InfoLog.Println("update rules from", p.pac.LocalRules, "succeeded")
+				p.metrics.ObservePACUpdate(p.pac.LocalRules, len(rules))
+				p.logger.Info("update rules succeeded", "source", p.pac.LocalRules, "rules", len(rules))
+			} else {
+				p.logger.Error("failed to generate PAC", "source", p.pac.LocalRules, "error", err)
 			}
+		} else {
+			p.logger.Debug("failed to load rules", "source", p.pac.LocalRules, "error", err)
 		}
 
-		if rules, err := loadRemoteRule(p.pac.RemoteRules, p.pac.Upstream); err == nil {
+		if rules, err := loadRemoteRule(p.pac.RemoteRules, p.pac.Upstream, p.logger); err == nil {
 			if data, err := pg.Generate(rules); err == nil {
 				p.set(data)
 				duration = 1 * time.Hour
-				InfoLog.Println("update rules from", p.pac.RemoteRules, "succeeded")
+				p.metrics.ObservePACUpdate(p.pac.RemoteRules, len(rules))
+				p.logger.Info("update rules succeeded", "source", p.pac.RemoteRules, "rules", len(rules))
+			} else {
+				p.logger.Error("failed to generate PAC", "source", p.pac.RemoteRules, "error", err)
 			}
+		} else {
+			p.logger.Warn("failed to load rules", "source", p.pac.RemoteRules, "error", err)
+		}
+		select {
+		case <-time.After(duration):
+		case <-p.done:
+			return
 		}
-		time.Sleep(duration)
 	}
 }
+
+// Close stops the updates.
+func (p *PACUpdater) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+
+	"github.com/eahydra/socks"
+)
+
+type RateLimiter struct {
+	upload   *socks.TokenBucket
+	download *socks.TokenBucket
+}
+
+// NewRateLimiter returns a RateLimiter for limit, or nil if limit is unlimited in both directions.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Upload <= 0 && limit.Download <= 0 {
+		return nil
+	}
+	r := &RateLimiter{}
+	if limit.Upload > 0 {
+		r.upload = socks.NewTokenBucket(limit.Upload, limit.Burst)
+	}
+	if limit.Download > 0 {
+		r.download = socks.NewTokenBucket(limit.Download, limit.Burst)
+	}
+	return r
+}
+
+// NewGlobalRateLimiter returns a RateLimiter for limit that is never nil, even if limit
+// is unlimited, so that Set can change the limit of the connections it already limits.
+func NewGlobalRateLimiter(limit RateLimit) *RateLimiter {
+	r := &RateLimiter{
+		upload:   socks.NewTokenBucket(0, 0),
+		download: socks.NewTokenBucket(0, 0),
+	}
+	r.Set(limit)
+	return r
+}
+
+// Set changes the limit of r, made by NewGlobalRateLimiter, and of its connections.
+func (r *RateLimiter) Set(limit RateLimit) {
+	r.upload.SetRate(limit.Upload, limit.Burst)
+	r.download.SetRate(limit.Download, limit.Burst)
+}
+
+// Limit wraps conn, a client side connection, so that reads from the client count
+// as upload and writes to the client count as download.
+func (r *RateLimiter) Limit(conn net.Conn) net.Conn {
+	if r == nil {
+		return conn
+	}
+	return socks.NewRateLimitedConn(conn, r.upload, r.download)
+}
+
+// NewRateLimitDecorator returns a ConnDecorator that limits all decorated connections
+// together by the buckets of limiter.
+func NewRateLimitDecorator(limiter *RateLimiter) ConnDecorator {
+	return func(conn net.Conn) (net.Conn, error) {
+		return limiter.Limit(conn), nil
+	}
+}
+
+// NewConnRateLimitDecorator returns a ConnDecorator that limits every decorated connection on its own.
+func NewConnRateLimitDecorator(limit RateLimit) ConnDecorator {
+	return func(conn net.Conn) (net.Conn, error) {
+		return NewRateLimiter(limit).Limit(conn), nil
+	}
+}
+
+// NewUserRateLimitDecorator returns a socks.SessionDecorator that limits all sessions of
+// a user together by limits[user]. Sessions of other users are not limited. SOCKS4 user
+// ids are chosen by the client, unless its TLS certificate names it, so a SOCKS4 client
+// can claim any limit, or none.
+func NewUserRateLimitDecorator(limits map[string]RateLimit) socks.SessionDecorator {
+	limiters := make(map[string]*RateLimiter)
+	for user, limit := range limits {
+		limiters[user] = NewRateLimiter(limit)
+	}
+	return func(conn net.Conn, info *socks.SessionInfo) (net.Conn, error) {
+		return limiters[info.User].Limit(conn), nil
+	}
+}
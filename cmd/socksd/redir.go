@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/eahydra/socks"
+)
+
+// runRedirServer relays the connections redirected to conf.Redir by the firewall to
+// their original destination, and with TPROXY also the UDP datagrams.
+func runRedirServer(conf Proxy, router socks.Dialer, ds []ConnDecorator, opts []socks.Option, logger *Logger, metrics *Metrics, st *startup) error {
+	if conf.Redir == "" {
+		return nil
+	}
+	listener, err := ListenRedir(conf.Redir, conf.TProxy)
+	if err != nil {
+		return err
+	}
+	listener = NewDecorateListener(st.track(listener), ds...)
+	server := socks.NewForwardServer("redir", router, socks.LocalDestination, listenerOptions(conf, opts,
+		socks.WithListenerName(conf.Redir),
+		socks.WithObserver(metrics.ListenerObserver("redir", conf.Redir)))...)
+	st.serve(listener, func() {
+		server.Serve(listener)
+	})
+
+	if conf.TProxy {
+		conn, err := ListenTProxyUDP(conf.Redir)
+		if err != nil {
+			return err
+		}
+		st.serve(conn, func() {
+			ServeTProxyUDP(conn, router, logger)
+		})
+	}
+	return nil
+}
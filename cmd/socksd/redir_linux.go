@@ -0,0 +1,256 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/eahydra/socks"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at SOL_IPV6
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+	ipv6OrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, and IPV6_ORIGDSTADDR as control message
+)
+
+// ListenRedir listens for TCP connections redirected by iptables or nftables. The
+// LocalAddr of the accepted connections is their original destination, read with
+// SO_ORIGINAL_DST for REDIRECT rules, or kept by the transparent socket for TPROXY rules.
+func ListenRedir(address string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = transparentControl
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &redirectListener{TCPListener: listener.(*net.TCPListener), tproxy: tproxy}, nil
+}
+
+type redirectListener struct {
+	*net.TCPListener
+	tproxy bool
+}
+
+func (l *redirectListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.tproxy {
+		// A connection made to the listener itself would be relayed back to it.
+		if conn.LocalAddr().(*net.TCPAddr).Port == l.Addr().(*net.TCPAddr).Port {
+			conn.Close()
+			return nil, &redirectError{err: errors.New("connection was not redirected")}
+		}
+		return conn, nil
+	}
+	dest, err := originalDestination(conn)
+	if err != nil {
+		conn.Close()
+		return nil, &redirectError{err: err}
+	}
+	return &redirectConn{TCPConn: conn, dest: dest}, nil
+}
+
+// redirectError is a temporary error, so that a connection that wasn't redirected
+// doesn't stop the server.
+type redirectError struct {
+	err error
+}
+
+func (e *redirectError) Error() string {
+	return "failed to get original destination: " + e.err.Error()
+}
+
+func (e *redirectError) Timeout() bool   { return false }
+func (e *redirectError) Temporary() bool { return true }
+
+type redirectConn struct {
+	*net.TCPConn
+	dest *net.TCPAddr
+}
+
+func (c *redirectConn) LocalAddr() net.Addr {
+	return c.dest
+}
+
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var dest *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// The getsockopt wrappers of package syscall with results large enough for a
+		// sockaddr_in and a sockaddr_in6 carry the address.
+		if ipv4 {
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			dest = parseSockaddr(mreq.Multiaddr[:])
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dest = parseSockaddr((*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return dest, nil
+}
+
+// parseSockaddr parses a raw sockaddr_in, or a sockaddr_in6 if b is long enough.
+func parseSockaddr(b []byte) *net.TCPAddr {
+	port := int(b[2])<<8 | int(b[3])
+	if len(b) >= syscall.SizeofSockaddrInet6 {
+		return &net.TCPAddr{IP: append(net.IP(nil), b[8:24]...), Port: port}
+	}
+	return &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: port}
+}
+
+// transparentControl makes a socket transparent, which lets it accept connections and
+// datagrams for foreign addresses, and bind to them.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+	if strings.HasSuffix(network, "6") {
+		level, opt = syscall.SOL_IPV6, ipv6Transparent
+	}
+	return setsockopt(c, level, opt)
+}
+
+func setsockopt(c syscall.RawConn, level, opt int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// ListenTProxyUDP listens for UDP datagrams redirected by TPROXY rules, which keep their
+// original destination in a control message.
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := transparentControl(network, address, c); err != nil {
+			return err
+		}
+		if strings.HasSuffix(network, "6") {
+			return setsockopt(c, syscall.SOL_IPV6, ipv6OrigDstAddr)
+		}
+		return setsockopt(c, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR)
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// ServeTProxyUDP relays the datagrams received by conn through router, one session per
+// client and original destination. Replies are sent from the original destination.
+// A session ends after a minute without datagrams.
+func ServeTProxyUDP(conn *net.UDPConn, router socks.Dialer, logger *Logger) {
+	var sessions udpSessions
+	buf := make([]byte, maxUDPPacketSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			if !isClosedError(err) {
+				logger.Error("failed to read UDP", "address", conn.LocalAddr().String(), "error", err)
+			}
+			return
+		}
+		dest, err := udpOriginalDestination(oob[:oobn])
+		if err != nil {
+			logger.Debug("redir udp destination unknown", "client", client.String(), "error", err)
+			continue
+		}
+
+		session := &tproxyUDPSession{client: client, dest: dest}
+		sessions.dispatch(client.String()+" "+dest.String(), append([]byte(nil), buf[:n]...), func(packets <-chan []byte) {
+			session.run(router, packets, logger)
+		})
+	}
+}
+
+func udpOriginalDestination(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(msg.Data) >= syscall.SizeofSockaddrInet4:
+			addr := parseSockaddr(msg.Data[:syscall.SizeofSockaddrInet4])
+			return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6OrigDstAddr && len(msg.Data) >= syscall.SizeofSockaddrInet6:
+			addr := parseSockaddr(msg.Data[:syscall.SizeofSockaddrInet6])
+			return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+		}
+	}
+	return nil, errors.New("no original destination in control messages")
+}
+
+type tproxyUDPSession struct {
+	client *net.UDPAddr
+	dest   *net.UDPAddr
+}
+
+func (s *tproxyUDPSession) run(router socks.Dialer, packets <-chan []byte, logger *Logger) {
+	start := time.Now()
+	fields := []interface{}{"protocol", "redir-udp", "client", s.client.String(), "dest", s.dest.String()}
+
+	remote, err := socks.DialContext(context.Background(), router, "udp", s.dest.String())
+	if err != nil {
+		logger.Warn("dial failed", append(fields, "error", err)...)
+		return
+	}
+	defer remote.Close()
+	// Replies must come from the original destination, which needs a transparent
+	// socket bound to it.
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := transparentControl(network, address, c); err != nil {
+			return err
+		}
+		return setsockopt(c, syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+	}}
+	reply, err := lc.ListenPacket(context.Background(), "udp", s.dest.String())
+	if err != nil {
+		logger.Warn("failed to bind reply socket", append(fields, "error", err)...)
+		return
+	}
+	defer reply.Close()
+
+	up, down := relayUDP(remote, packets, func(b []byte) error {
+		_, err := reply.WriteTo(b, s.client)
+		return err
+	})
+	logger.Info("session closed", append(fields, "up", up, "down", down, "duration", time.Since(start))...)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/eahydra/socks"
+)
+
+var errRedirUnsupported = errors.New("redir is only supported on Linux")
+
+func ListenRedir(address string, tproxy bool) (net.Listener, error) {
+	return nil, errRedirUnsupported
+}
+
+func ListenTProxyUDP(address string) (*net.UDPConn, error) {
+	return nil, errRedirUnsupported
+}
+
+func ServeTProxyUDP(conn *net.UDPConn, router socks.Dialer, logger *Logger) {}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+const (
+	reversePending  = 2
+	reverseRetryMin = time.Second
+	reverseRetryMax = 30 * time.Second
+)
+
+// BuildReverses returns the service of the reverse forwards of conf, which expose their
+// local targets on the ports that socksd proxies upstream listen on for their LISTEN
+// requests.
+func BuildReverses(conf *Config, ds []ConnDecorator, global *socks.ConnLimiter, logger *Logger, metrics *Metrics) (*service, error) {
+	svc := &service{}
+	clients := make([]*socks.Socks5Client, len(conf.Reverses))
+	for i, reverse := range conf.Reverses {
+		client, closer, err := BuildReverseClient(conf, reverse.Upstream, logger, metrics)
+		if err != nil {
+			svc.stop(0)
+			return nil, errors.New("reverse " + reverse.Remote + ": " + err.Error())
+		}
+		svc.resources.add(closer)
+		clients[i] = client
+	}
+	svc.start = func(st *startup) error {
+		direct, _, _ := BuildForwardDialer(conf, "", logger, metrics)
+		for i, reverse := range conf.Reverses {
+			reverse := reverse
+			listener := NewDecorateListener(st.track(NewReverseListener(clients[i], reverse.Remote, logger)), ds...)
+			target := func(net.Conn) (string, error) {
+				return reverse.Target, nil
+			}
+			server := socks.NewForwardServer("reverse", direct, target,
+				socks.WithConnLimiter(global),
+				socks.WithLogger(logger),
+				socks.WithListenerName(reverse.Remote),
+				socks.WithObserver(metrics.ListenerObserver("reverse", reverse.Remote)))
+			st.serve(listener, func() {
+				server.Serve(listener)
+			})
+		}
+		return nil
+	}
+	return svc, nil
+}
+
+// BuildReverseClient returns the client of the upstream of conf named name, which must
+// be a socks5 upstream, and the closer of the connections it keeps.
+func BuildReverseClient(conf *Config, name string, logger *Logger, metrics *Metrics) (*socks.Socks5Client, io.Closer, error) {
+	upstream, ok := conf.FindUpstream(name)
+	if !ok {
+		return nil, nil, errors.New("unknown upstream " + name)
+	}
+	forward, closer, err := BuildUpstream(upstream, "reverses", NewDecorateDirect(0, metrics), logger, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, ok := forward.(*socks.Socks5Client)
+	if !ok {
+		closer.Close()
+		return nil, nil, errors.New("reverse forwards need a socks5 upstream")
+	}
+	return client, closer, nil
+}
+
+// ReverseListener accepts the connections made to a port of a remote SOCKS5 server,
+// keeping a few LISTEN requests for it waiting there. A failed request is retried with
+// a growing delay, so that the port comes back once the server is reachable again.
+type ReverseListener struct {
+	client *socks.Socks5Client
+	remote string
+	logger *Logger
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewReverseListener(client *socks.Socks5Client, remote string, logger *Logger) *ReverseListener {
+	l := &ReverseListener{
+		client: client,
+		remote: remote,
+		logger: logger,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < reversePending; i++ {
+		go l.bind()
+	}
+	return l
+}
+
+func (l *ReverseListener) bind() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-l.done
+		cancel()
+	}()
+
+	delay := reverseRetryMin
+	for {
+		conn, err := l.accept(ctx)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			l.logger.Warn("reverse listen failed", "remote", l.remote, "retry", delay, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+				return
+			}
+			delay = nextReverseDelay(delay)
+			continue
+		}
+		delay = reverseRetryMin
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// nextReverseDelay returns the delay before the retry following one made after delay.
+func nextReverseDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > reverseRetryMax {
+		delay = reverseRetryMax
+	}
+	return delay
+}
+
+// accept waits for a connection through a new LISTEN request.
+func (l *ReverseListener) accept(ctx context.Context) (net.Conn, error) {
+	listen, err := l.client.Listen(ctx, l.remote)
+	if err != nil {
+		return nil, err
+	}
+	l.logger.Debug("reverse listen ready", "remote", l.remote, "bound", listen.Addr.String())
+	accepted := make(chan struct{})
+	defer close(accepted)
+	go func() {
+		select {
+		case <-l.done:
+			listen.Close()
+		case <-accepted:
+		}
+	}()
+	return listen.Accept()
+}
+
+func (l *ReverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("reverse listener closed")
+	}
+}
+
+func (l *ReverseListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *ReverseListener) Addr() net.Addr {
+	return reverseAddr(l.remote)
+}
+
+// reverseAddr is the address of the remote port of a ReverseListener.
+type reverseAddr string
+
+func (a reverseAddr) Network() string { return "tcp" }
+func (a reverseAddr) String() string  { return string(a) }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks"
+	"github.com/eahydra/socks/sockstest"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveListen serves SOCKS5 requests on listener, with LISTEN allowed on any address.
+func serveListen(t *testing.T, listener net.Listener) {
+	t.Helper()
+	t.Cleanup(func() { listener.Close() })
+	handler := socks.ListenHandler(socks.ConnectHandler(socks.Direct), func(string) bool { return true })
+	server, err := socks.NewSocks5Server(nil, socks.WithHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+}
+
+// reverseConfig returns a config with a reverse forward of remote to target, through a
+// socks5 upstream at upstream.
+func reverseConfig(upstream, remote, target string) *Config {
+	return &Config{
+		Upstreams: []Upstream{{Name: "up", Type: "socks5", Address: upstream}},
+		Reverses:  []Reverse{{Remote: remote, Target: target, Upstream: "up"}},
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListen(t, listener)
+
+	remote := freeAddress(t, "tcp")
+	svc, err := BuildReverses(reverseConfig(listener.Addr().String(), remote, echo.Addr()), nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startService(t, svc)
+
+	// More connections than the pending LISTEN requests, so that they are renewed.
+	for i := 0; i < 2*reversePending+1; i++ {
+		var conn net.Conn
+		waitFor(t, "the remote port", func() bool {
+			conn, err = net.Dial("tcp", remote)
+			return err == nil
+		})
+		sockstest.AssertEcho(t, conn, 1000)
+		conn.Close()
+	}
+}
+
+func TestReverseListenerReconnect(t *testing.T) {
+	// The upstream is down at first.
+	upstream, remote := freeAddress(t, "tcp"), freeAddress(t, "tcp")
+	client, _, err := BuildReverseClient(reverseConfig(upstream, remote, ""), "up", newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse := NewReverseListener(client, remote, newTestLogger(t))
+	defer reverse.Close()
+	go func() {
+		for {
+			conn, err := reverse.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	listener, err := net.Listen("tcp", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListen(t, listener)
+	waitFor(t, "the remote port after the upstream came up", func() bool {
+		conn, err := net.Dial("tcp", remote)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		b, _ := ioutil.ReadAll(conn)
+		return string(b) == "hello"
+	})
+}
+
+func TestReverseListenerBackoff(t *testing.T) {
+	tests := []struct {
+		delay, want time.Duration
+	}{
+		{reverseRetryMin, 2 * time.Second},
+		{8 * time.Second, 16 * time.Second},
+		{16 * time.Second, reverseRetryMax},
+		{reverseRetryMax, reverseRetryMax},
+	}
+	for _, test := range tests {
+		if delay := nextReverseDelay(test.delay); delay != test.want {
+			t.Errorf("after %s: got %s, want %s", test.delay, delay, test.want)
+		}
+	}
+
+	// An upstream that hangs up on every request.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var attempts int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&attempts, 1)
+			conn.Close()
+		}
+	}()
+	client, _, err := BuildReverseClient(reverseConfig(listener.Addr().String(), "127.0.0.1:1", ""), "up", newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse := NewReverseListener(client, "127.0.0.1:1", newTestLogger(t))
+
+	// Each pending request is retried after a second, then two.
+	time.Sleep(reverseRetryMin + reverseRetryMin/2)
+	if n := atomic.LoadInt32(&attempts); n != 2*reversePending {
+		t.Fatalf("got %d attempts in 1.5s, want %d", n, 2*reversePending)
+	}
+	reverse.Close()
+	if _, err := reverse.Accept(); err == nil {
+		t.Fatal("closed reverse listener accepted")
+	}
+}
+
+func TestBuildReverseClientNeedsSocks5(t *testing.T) {
+	conf := &Config{Upstreams: []Upstream{{Name: "ss", Type: "shadowsocks", Crypto: "aes-256-cfb", Password: "secret", Address: "127.0.0.1:1"}}}
+	if _, _, err := BuildReverseClient(conf, "ss", newTestLogger(t), nil); err == nil {
+		t.Fatal("shadowsocks upstream accepted")
+	}
+	if _, _, err := BuildReverseClient(conf, "missing", newTestLogger(t), nil); err == nil {
+		t.Fatal("unknown upstream accepted")
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+// closers closes a group of resources together, the last added first.
+type closers []io.Closer
+
+func (c *closers) add(closer io.Closer) {
+	*c = append(*c, closer)
+}
+
+func (c closers) Close() error {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if e := c[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// closerFunc adapts a function to an io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// SwitchDialer dials through a Dialer that can be replaced while in use, which lets a
+// reload change the upstreams of a proxy without restarting its listeners.
+type SwitchDialer struct {
+	forward atomic.Value // switchTarget
+}
+
+// switchTarget wraps the Dialers of a SwitchDialer, since an atomic.Value only holds
+// values of one type.
+type switchTarget struct {
+	socks.Dialer
+}
+
+func NewSwitchDialer(forward socks.Dialer) *SwitchDialer {
+	d := &SwitchDialer{}
+	d.Set(forward)
+	return d
+}
+
+// Set makes d dial through forward from now on. The connections made before are kept.
+func (d *SwitchDialer) Set(forward socks.Dialer) {
+	d.forward.Store(switchTarget{forward})
+}
+
+func (d *SwitchDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *SwitchDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return socks.DialContext(ctx, d.forward.Load().(switchTarget).Dialer, network, address)
+}
+
+// service runs the listeners of a part of the config. A reload keeps the services of
+// the parts that are unchanged, so that their sessions carry on.
+type service struct {
+	start     func(st *startup) error
+	listeners closers
+	resources closers
+	sessions  sessions
+
+	// The router of a proxy, which a reload replaces when only its upstreams changed.
+	router       *SwitchDialer
+	routing      string
+	routerCloser io.Closer
+}
+
+// bind binds the listeners of s, which serve once run is called on the returned
+// startup. If one fails, those bound are closed.
+func (s *service) bind() (*startup, error) {
+	st := &startup{sessions: &s.sessions}
+	if err := s.start(st); err != nil {
+		st.listeners.Close()
+		return nil, err
+	}
+	s.listeners = st.listeners
+	return st, nil
+}
+
+// pause closes the listeners of s, which bind can open again.
+func (s *service) pause() {
+	s.listeners.Close()
+	s.listeners = nil
+}
+
+// stop closes the listeners of s, and the connections kept by its upstreams once they
+// are idle. The sessions in progress are left to end, or closed after drain if it is
+// positive.
+func (s *service) stop(drain time.Duration) {
+	s.listeners.Close()
+	s.resources.Close()
+	if s.routerCloser != nil {
+		s.routerCloser.Close()
+	}
+	if drain > 0 {
+		time.AfterFunc(drain, s.sessions.close)
+	}
+}
+
+// startup collects the listeners bound by the start of a service, and the loops that
+// serve them, which only run once every listener of a reload is bound.
+type startup struct {
+	sessions  *sessions
+	listeners closers
+	loops     []func()
+}
+
+// track returns listener, with the connections it accepts tracked as sessions of the
+// service. It wraps the listener as bound, so that the connections keep the types the
+// decorators and servers above expect.
+func (st *startup) track(listener net.Listener) net.Listener {
+	return &sessionListener{Listener: listener, sessions: st.sessions}
+}
+
+// serve adds listener, which loop serves once run is called. Listeners that can shut
+// down, like mux listeners, are shut down rather than closed, so that the sessions they
+// carry can drain.
+func (st *startup) serve(listener io.Closer, loop func()) {
+	if l, ok := listener.(interface{ Shutdown() error }); ok {
+		st.listeners.add(closerFunc(l.Shutdown))
+	} else {
+		st.listeners.add(listener)
+	}
+	st.loops = append(st.loops, func() {
+		defer listener.Close()
+		loop()
+	})
+}
+
+// run starts the loops of st.
+func (st *startup) run() {
+	for _, loop := range st.loops {
+		go loop()
+	}
+}
+
+// sessions are the connections accepted by the listeners of a service.
+type sessions struct {
+	lock   sync.Mutex
+	conns  map[*sessionConn]struct{}
+	closed bool
+}
+
+func (s *sessions) add(conn net.Conn) net.Conn {
+	c := &sessionConn{Conn: conn, sessions: s}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		conn.Close()
+		return c
+	}
+	if s.conns == nil {
+		s.conns = make(map[*sessionConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return c
+}
+
+func (s *sessions) remove(c *sessionConn) {
+	s.lock.Lock()
+	delete(s.conns, c)
+	s.lock.Unlock()
+}
+
+// close closes the sessions in progress, and those accepted from now on.
+func (s *sessions) close() {
+	s.lock.Lock()
+	conns := s.conns
+	s.conns, s.closed = nil, true
+	s.lock.Unlock()
+	for c := range conns {
+		c.Conn.Close()
+	}
+}
+
+type sessionListener struct {
+	net.Listener
+	sessions *sessions
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.sessions.add(conn), nil
+}
+
+type sessionConn struct {
+	net.Conn
+	sessions *sessions
+}
+
+func (c *sessionConn) Close() error {
+	c.sessions.remove(c)
+	return c.Conn.Close()
+}
+
+// Server runs the services of a config, and reloads it keeping the services of the
+// parts that did not change.
+type Server struct {
+	logger  *Logger
+	metrics *Metrics
+
+	// The global limits, which a reload changes in place rather than restarting the
+	// services they limit.
+	globalLimiter     *RateLimiter
+	globalConnLimiter *socks.ConnLimiter
+
+	lock     sync.Mutex
+	conf     *Config
+	services map[string]*service
+	fakeIPs  map[string]*FakeIPPool
+}
+
+func NewServer(logger *Logger, metrics *Metrics) *Server {
+	return &Server{
+		logger:            logger,
+		metrics:           metrics,
+		globalLimiter:     NewGlobalRateLimiter(RateLimit{}),
+		globalConnLimiter: socks.NewConnLimiter(0, 0, 0, 0),
+		services:          make(map[string]*service),
+		fakeIPs:           make(map[string]*FakeIPPool),
+	}
+}
+
+// signature identifies a part of a config: parts with the same signature run the same
+// services.
+func signature(kind string, parts ...interface{}) string {
+	data, _ := json.Marshal(parts)
+	return kind + " " + string(data)
+}
+
+// Reload switches s to conf. The services of the parts of conf that are new or changed
+// are built first, and if one fails conf is rejected, leaving the running services
+// alone. Then the listeners of the removed or changed parts are closed, since the new
+// ones may take their addresses, and those of the new services are bound. If one fails
+// to listen, the new services are stopped, the old listeners are bound again, and conf
+// is rejected. Otherwise the new services start serving, the old ones stop, proxies
+// whose upstreams alone changed switch to their new routers, and the global limits
+// change in place.
+func (s *Server) Reload(conf *Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conf != nil && (!reflect.DeepEqual(s.conf.Log, conf.Log) || s.conf.Metrics != conf.Metrics) {
+		s.logger.Warn("log and metrics changes take effect on restart")
+	}
+
+	r := &reload{
+		Server:   s,
+		services: make(map[string]*service),
+		fakeIPs:  make(map[string]*FakeIPPool),
+	}
+	if err := r.build(conf); err != nil {
+		r.abort()
+		return err
+	}
+
+	var stopped []*service
+	for key, svc := range s.services {
+		if r.services[key] != svc {
+			svc.pause()
+			stopped = append(stopped, svc)
+		}
+	}
+	if err := r.bind(); err != nil {
+		r.abort()
+		for _, svc := range stopped {
+			st, err := svc.bind()
+			if err != nil {
+				s.logger.Error("failed to restore listeners", "error", err)
+				continue
+			}
+			st.run()
+		}
+		return err
+	}
+	for _, st := range r.startups {
+		st.run()
+	}
+	for _, svc := range stopped {
+		svc.stop(time.Duration(conf.DrainTimeout) * time.Second)
+	}
+	for _, sw := range r.switches {
+		sw.svc.router.Set(sw.router)
+		sw.svc.routerCloser.Close()
+		sw.svc.routerCloser = sw.closer
+		sw.svc.routing = sw.routing
+	}
+	for key, pool := range s.fakeIPs {
+		if r.fakeIPs[key] != pool {
+			pool.Close()
+		}
+	}
+	s.globalLimiter.Set(conf.RateLimit)
+	limit := conf.ConnLimit
+	s.globalConnLimiter.SetLimits(limit.MaxSessions, limit.MaxSessionsPerIP, limit.AcceptRate, limit.AcceptBurst)
+	s.conf = conf
+	s.services = r.services
+	s.fakeIPs = r.fakeIPs
+	s.logger.Info("config applied", "started", len(r.started), "stopped", len(stopped),
+		"kept", len(r.services)-len(r.started), "routers", len(r.switches))
+	return nil
+}
+
+// Close stops every service.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var drain time.Duration
+	if s.conf != nil {
+		drain = time.Duration(s.conf.DrainTimeout) * time.Second
+	}
+	for _, svc := range s.services {
+		svc.stop(drain)
+	}
+	for _, pool := range s.fakeIPs {
+		pool.Close()
+	}
+	s.services = make(map[string]*service)
+	s.fakeIPs = make(map[string]*FakeIPPool)
+	s.conf = nil
+	return nil
+}
+
+// reload holds what Reload builds for a new config until it is applied.
+type reload struct {
+	*Server
+	services map[string]*service
+	fakeIPs  map[string]*FakeIPPool
+	started  []*service
+	startups []*startup
+	switches []routerSwitch
+}
+
+// routerSwitch is a new router for a proxy service that is kept.
+type routerSwitch struct {
+	svc     *service
+	router  socks.Dialer
+	closer  io.Closer
+	routing string
+}
+
+// build builds the services of conf, reusing the running ones whose signature is
+// unchanged.
+func (r *reload) build(conf *Config) error {
+	for i, c := range conf.Proxies {
+		if err := r.buildProxy(c); err != nil {
+			return errors.New("proxies[" + strconv.Itoa(i) + "]: " + err.Error())
+		}
+	}
+
+	globalDs := BuildListenerDecorators(Proxy{}, r.globalLimiter)
+	if len(conf.Forwards) != 0 {
+		key := signature("forwards", conf.Forwards, forwardUpstreams(conf))
+		if err := r.add(key, func() (*service, error) {
+			return BuildForwards(conf, globalDs, r.globalConnLimiter, r.logger, r.metrics)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(conf.Reverses) != 0 {
+		key := signature("reverses", conf.Reverses, reverseUpstreams(conf))
+		if err := r.add(key, func() (*service, error) {
+			return BuildReverses(conf, globalDs, r.globalConnLimiter, r.logger, r.metrics)
+		}); err != nil {
+			return err
+		}
+	}
+	pac := conf.PAC
+	logger, metrics := r.logger, r.metrics
+	return r.add(signature("pac", pac), func() (*service, error) {
+		return &service{start: func(st *startup) error {
+			return runPACServer(pac, logger, metrics, st)
+		}}, nil
+	})
+}
+
+// add keeps the running service of key, or builds a new one.
+func (r *reload) add(key string, build func() (*service, error)) error {
+	if svc := r.Server.services[key]; svc != nil {
+		r.services[key] = svc
+		return nil
+	}
+	svc, err := build()
+	if err != nil {
+		return err
+	}
+	r.services[key] = svc
+	r.started = append(r.started, svc)
+	return nil
+}
+
+// buildProxy keys the service of a proxy by its config without the upstreams, so that
+// a change of upstreams alone only switches its router.
+func (r *reload) buildProxy(conf Proxy) error {
+	routing := signature("routing", conf.Upstreams, conf.HealthCheck, conf.Attempts, conf.DNSCacheTimeout)
+	listening := conf
+	listening.Upstreams, listening.HealthCheck, listening.Attempts, listening.DNSCacheTimeout = nil, nil, 0, 0
+	key := signature("proxy", listening)
+	for n := 2; r.services[key] != nil; n++ {
+		key = signature("proxy", listening, n)
+	}
+
+	if svc := r.Server.services[key]; svc != nil {
+		r.services[key] = svc
+		if _, err := r.fakeIPPool(conf); err != nil {
+			return err
+		}
+		if svc.routing != routing {
+			router, closer, err := BuildUpstreamRouter(conf, r.logger, r.metrics)
+			if err != nil {
+				return err
+			}
+			r.switches = append(r.switches, routerSwitch{svc: svc, router: router, closer: closer, routing: routing})
+		}
+		return nil
+	}
+	svc, err := r.newProxyService(conf)
+	if err != nil {
+		return err
+	}
+	svc.routing = routing
+	r.services[key] = svc
+	r.started = append(r.started, svc)
+	return nil
+}
+
+func (r *reload) newProxyService(conf Proxy) (svc *service, err error) {
+	router, closer, err := BuildUpstreamRouter(conf, r.logger, r.metrics)
+	if err != nil {
+		return nil, err
+	}
+	svc = &service{router: NewSwitchDialer(router), routerCloser: closer}
+	defer func() {
+		if err != nil {
+			svc.stop(0)
+		}
+	}()
+
+	var forward socks.Dialer = svc.router
+	fakeIPs, err := r.fakeIPPool(conf)
+	if err != nil {
+		return nil, err
+	}
+	if fakeIPs != nil {
+		forward = NewFakeIPDialer(forward, fakeIPs)
+	}
+	dnsServer, err := BuildDNSServer(conf, forward, fakeIPs, r.logger)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := BuildServerTLSConfig(conf, r.logger)
+	if err != nil {
+		return nil, err
+	}
+	ds := BuildListenerDecorators(conf, r.globalLimiter)
+	opts := BuildServerOptions(conf, r.globalConnLimiter, r.logger)
+	httpDs := ds
+	if tlsConfig != nil {
+		httpDs = append(ds[:len(ds):len(ds)], NewTLSServerDecorator(tlsConfig))
+		opts = append(opts, socks.WithTLSConfig(tlsConfig))
+	}
+	logger, metrics := r.logger, r.metrics
+	svc.start = func(st *startup) error {
+		if err := runHTTPProxyServer(conf, forward, httpDs, opts, metrics, st); err != nil {
+			return err
+		}
+		if err := runSOCKS4Server(conf, forward, ds, opts, metrics, st); err != nil {
+			return err
+		}
+		if err := runSOCKS5Server(conf, forward, ds, opts, metrics, st); err != nil {
+			return err
+		}
+		if err := runRedirServer(conf, forward, ds, opts, logger, metrics, st); err != nil {
+			return err
+		}
+		return runDNSServer(conf, dnsServer, st)
+	}
+	return svc, nil
+}
+
+// fakeIPPool returns the fake IP pool of the DNS forwarder of conf, or nil if it has
+// none. Proxies with the same fake IP config share their pool, which is kept across
+// reloads.
+func (r *reload) fakeIPPool(conf Proxy) (*FakeIPPool, error) {
+	if conf.DNS == nil || conf.DNS.FakeIP == nil {
+		return nil, nil
+	}
+	key := signature("fakeIP", *conf.DNS.FakeIP)
+	pool := r.fakeIPs[key]
+	if pool == nil {
+		pool = r.Server.fakeIPs[key]
+	}
+	if pool == nil {
+		var err error
+		if pool, err = NewFakeIPPool(*conf.DNS.FakeIP, r.logger); err != nil {
+			return nil, err
+		}
+	}
+	r.fakeIPs[key] = pool
+	return pool, nil
+}
+
+// bind binds the listeners of the new services.
+func (r *reload) bind() error {
+	for _, svc := range r.started {
+		st, err := svc.bind()
+		if err != nil {
+			return err
+		}
+		r.startups = append(r.startups, st)
+	}
+	return nil
+}
+
+// abort releases what was built for a rejected config.
+func (r *reload) abort() {
+	for _, svc := range r.started {
+		svc.stop(0)
+	}
+	for _, sw := range r.switches {
+		sw.closer.Close()
+	}
+	for key, pool := range r.fakeIPs {
+		if r.Server.fakeIPs[key] != pool {
+			pool.Close()
+		}
+	}
+}
+
+// forwardUpstreams returns the upstreams the forwards of conf go through, which are
+// part of their signature.
+func forwardUpstreams(conf *Config) []Upstream {
+	var upstreams []Upstream
+	for _, forward := range conf.Forwards {
+		var upstream Upstream
+		if forward.Upstream != "" {
+			upstream, _ = conf.FindUpstream(forward.Upstream)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
+// reverseUpstreams returns the upstreams the reverse forwards of conf go through, which
+// are part of their signature.
+func reverseUpstreams(conf *Config) []Upstream {
+	var upstreams []Upstream
+	for _, reverse := range conf.Reverses {
+		upstream, _ := conf.FindUpstream(reverse.Upstream)
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+// startGreeter starts a server writing greeting to every connection and closing it,
+// and returns its address.
+func startGreeter(t *testing.T, greeting string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// greeting returns what the server at address writes before closing the connection.
+func greeting(t *testing.T, address string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, _ := ioutil.ReadAll(conn)
+	return string(b)
+}
+
+func newTestServer(t *testing.T, conf *Config) *Server {
+	t.Helper()
+	server := NewServer(newTestLogger(t), nil)
+	if err := server.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestReloadRestoresListeners(t *testing.T) {
+	old, changed := startGreeter(t, "old"), startGreeter(t, "new")
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	listen := freeAddress(t, "tcp")
+	pac := PAC{Address: "127.0.0.1:0"}
+	server := newTestServer(t, &Config{PAC: pac, Forwards: []Forward{{Listen: listen, Target: old}}})
+
+	// The second forward can't listen, so the first one must keep its old target.
+	conf := &Config{PAC: pac, Forwards: []Forward{
+		{Listen: listen, Target: changed},
+		{Listen: busy.Addr().String(), Target: changed},
+	}}
+	if err := server.Reload(conf); err == nil {
+		t.Fatal("config with a busy address applied")
+	}
+	if got := greeting(t, listen); got != "old" {
+		t.Fatalf("got %q after the rejected reload, want old", got)
+	}
+
+	conf.Forwards = conf.Forwards[:1]
+	if err := server.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	if got := greeting(t, listen); got != "new" {
+		t.Fatalf("got %q after the reload, want new", got)
+	}
+}
+
+func TestReloadDrainsSessions(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	listen := freeAddress(t, "tcp")
+	pac := PAC{Address: "127.0.0.1:0"}
+	server := newTestServer(t, &Config{PAC: pac, Forwards: []Forward{{Listen: listen, Target: echo.Addr()}}})
+	var old *service
+	for _, svc := range server.services {
+		if len(svc.resources) != 0 {
+			old = svc
+		}
+	}
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sockstest.AssertEcho(t, conn, 100)
+
+	// The session outlives the reload that stops its listener, until the drain ends.
+	if err := server.Reload(&Config{PAC: pac, DrainTimeout: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 100)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("session still open after the drain")
+	}
+	old.sessions.lock.Lock()
+	defer old.sessions.lock.Unlock()
+	if len(old.sessions.conns) != 0 {
+		t.Fatalf("%d sessions left after the drain", len(old.sessions.conns))
+	}
+}
+
+func TestReloadChangesGlobalLimitsInPlace(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	listen := freeAddress(t, "tcp")
+	conf := &Config{
+		PAC:      PAC{Address: "127.0.0.1:0"},
+		Forwards: []Forward{{Listen: listen, Target: echo.Addr()}},
+	}
+	server := newTestServer(t, conf)
+	services := make(map[string]*service)
+	for key, svc := range server.services {
+		services[key] = svc
+	}
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sockstest.AssertEcho(t, conn, 100)
+
+	limited := *conf
+	limited.ConnLimit = ConnLimit{MaxSessions: 1}
+	if err := server.Reload(&limited); err != nil {
+		t.Fatal(err)
+	}
+	for key, svc := range server.services {
+		if services[key] != svc {
+			t.Fatalf("service %s restarted by a global limit change", key)
+		}
+	}
+	// The session in progress counts against the new limit.
+	sockstest.AssertEcho(t, conn, 100)
+	second, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Write([]byte("x")); err == nil {
+		if _, err := second.Read(make([]byte, 1)); err == nil {
+			t.Fatal("session beyond the new limit served")
+		}
+	}
+}
+
+func TestReloadAbortKeepsFakeIPFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fakeip")
+	proxy := Proxy{DNS: &DNS{Address: freeAddress(t, "udp"), FakeIP: &FakeIP{Range: "10.1.0.0/29", File: file}}}
+	pac := PAC{Address: "127.0.0.1:0"}
+	server := newTestServer(t, &Config{PAC: pac, Proxies: []Proxy{proxy}})
+	for _, pool := range server.fakeIPs {
+		pool.Lookup("example.com")
+		pool.Close()
+	}
+	saved, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new range for the same file builds a new pool, which the failing upstream of the
+	// second proxy makes the reload drop.
+	changed := proxy
+	changed.DNS = &DNS{Address: proxy.DNS.Address, FakeIP: &FakeIP{Range: "10.2.0.0/29", File: file}}
+	broken := Proxy{Upstreams: []Upstream{{Type: "bogus", Address: "127.0.0.1:1"}}}
+	if err := server.Reload(&Config{PAC: pac, Proxies: []Proxy{changed, broken}}); err == nil {
+		t.Fatal("config with a bogus upstream applied")
+	}
+	if len(server.fakeIPs) != 1 {
+		t.Fatalf("got %d fake IP pools, want the running one", len(server.fakeIPs))
+	}
+	server.Close()
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != string(saved) {
+		t.Fatalf("got %q, %v, want the file of the running pool %q", b, err, saved)
+	}
+}
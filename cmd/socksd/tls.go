@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eahydra/socks"
+)
+
+// reloadCheckInterval is how often files loaded by a fileReloader are checked for changes.
+const reloadCheckInterval = time.Second
+
+// fileReloader calls load again when one of its files changes, checking the
+// modification times at most once per reloadCheckInterval.
+type fileReloader struct {
+	files   []string
+	load    func() error
+	logger  *Logger
+	lock    sync.Mutex
+	modTime time.Time
+	checked time.Time
+}
+
+func newFileReloader(load func() error, logger *Logger, files ...string) (*fileReloader, error) {
+	r := &fileReloader{
+		files:  files,
+		load:   load,
+		logger: logger,
+	}
+	r.modTime = r.latestModTime()
+	r.checked = time.Now()
+	if err := load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range r.files {
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// check reloads the files if they changed. If loading fails, the previous
+// contents stay in use.
+func (r *fileReloader) check() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checked) < reloadCheckInterval {
+		return
+	}
+	r.checked = time.Now()
+	modTime := r.latestModTime()
+	if !modTime.After(r.modTime) {
+		return
+	}
+	if err := r.load(); err != nil {
+		r.logger.Error("failed to reload", "files", r.files, "error", err)
+		return
+	}
+	r.modTime = modTime
+	r.logger.Info("reloaded", "files", r.files)
+}
+
+// CertReloader serves a certificate and its key from files, reloading them when they change.
+type CertReloader struct {
+	reloader *fileReloader
+	cert     atomic.Value
+}
+
+func NewCertReloader(certFile, keyFile string, logger *Logger) (*CertReloader, error) {
+	c := &CertReloader{}
+	reloader, err := newFileReloader(func() error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.cert.Store(&cert)
+		return nil
+	}, logger, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.reloader = reloader
+	return c, nil
+}
+
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.reloader.check()
+	return c.cert.Load().(*tls.Certificate)
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// CertPoolReloader serves the certificates of a PEM file as a pool, reloading it when it changes.
+type CertPoolReloader struct {
+	reloader *fileReloader
+	pool     atomic.Value
+}
+
+func NewCertPoolReloader(file string, logger *Logger) (*CertPoolReloader, error) {
+	p := &CertPoolReloader{}
+	reloader, err := newFileReloader(func() error {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificates found in " + file)
+		}
+		p.pool.Store(pool)
+		return nil
+	}, logger, file)
+	if err != nil {
+		return nil, err
+	}
+	p.reloader = reloader
+	return p, nil
+}
+
+func (p *CertPoolReloader) Pool() *x509.CertPool {
+	p.reloader.check()
+	return p.pool.Load().(*x509.CertPool)
+}
+
+// VerifyServer returns a tls.Config.VerifyPeerCertificate function that verifies the
+// certificate chain of serverName against the current pool. It is used with
+// InsecureSkipVerify, which is how a tls.Config can verify against a changing pool.
+func (p *CertPoolReloader) VerifyServer(serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs, err := parseCertificates(rawCerts)
+		if err != nil {
+			return err
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         p.Pool(),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = certs[0].Verify(opts)
+		return err
+	}
+}
+
+// VerifyClient returns a tls.Config.VerifyConnection function that verifies a client
+// certificate chain against the current pool and, if crl is not nil, checks that the
+// certificate isn't revoked. Unlike VerifyPeerCertificate, VerifyConnection also runs
+// when a session is resumed, so that a revoked certificate can't resume one.
+func (p *CertPoolReloader) VerifyClient(crl *CRLReloader) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		certs := state.PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("no certificate presented")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         p.Pool(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := certs[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		if crl != nil {
+			return crl.Check(chains[0])
+		}
+		return nil
+	}
+}
+
+// CRLReloader holds a certificate revocation list loaded from a PEM or DER file,
+// reloading it when it changes.
+type CRLReloader struct {
+	reloader *fileReloader
+	crl      atomic.Value
+}
+
+func NewCRLReloader(file string, logger *Logger) (*CRLReloader, error) {
+	c := &CRLReloader{}
+	reloader, err := newFileReloader(func() error {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return err
+		}
+		c.crl.Store(crl)
+		return nil
+	}, logger, file)
+	if err != nil {
+		return nil, err
+	}
+	c.reloader = reloader
+	return c, nil
+}
+
+// Check returns an error if the leaf of chain was revoked by the list. The list only
+// applies to certificates of its issuer, whose signature it must carry.
+func (c *CRLReloader) Check(chain []*x509.Certificate) error {
+	c.reloader.check()
+	crl := c.crl.Load().(*x509.RevocationList)
+	if len(chain) < 2 || !bytes.Equal(crl.RawIssuer, chain[1].RawSubject) {
+		return nil
+	}
+	if err := crl.CheckSignatureFrom(chain[1]); err != nil {
+		return errors.New("invalid CRL: " + err.Error())
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(chain[0].SerialNumber) == 0 {
+			return errors.New("certificate of " + socks.CertificateIdentity(chain[0]) + " is revoked")
+		}
+	}
+	return nil
+}
+
+func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for n, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs[n] = cert
+	}
+	return certs, nil
+}
+
+// BuildServerTLSConfig returns the TLS config of the listeners of conf, nil if TLS is off.
+func BuildServerTLSConfig(conf Proxy, logger *Logger) (*tls.Config, error) {
+	if !conf.TLS {
+		return nil, nil
+	}
+	if conf.Cert == "" || conf.Key == "" {
+		return nil, errors.New("tls requires cert and key")
+	}
+	cert, err := NewCertReloader(conf.Cert, conf.Key, logger)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: cert.GetCertificate}
+	if conf.ClientCA == "" {
+		if conf.CRL != "" {
+			return nil, errors.New("crl requires clientCA")
+		}
+		return config, nil
+	}
+	pool, err := NewCertPoolReloader(conf.ClientCA, logger)
+	if err != nil {
+		return nil, err
+	}
+	var crl *CRLReloader
+	if conf.CRL != "" {
+		if crl, err = NewCRLReloader(conf.CRL, logger); err != nil {
+			return nil, err
+		}
+	}
+	// Go only verifies client certificates against a fixed pool, so the chain is verified
+	// by VerifyClient instead.
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyConnection = pool.VerifyClient(crl)
+	return config, nil
+}
+
+// BuildUpstreamTLSConfig returns the TLS config and certificate pins to connect to
+// upstream, nil if TLS is off.
+func BuildUpstreamTLSConfig(upstream Upstream, logger *Logger) (*tls.Config, [][]byte, error) {
+	if !upstream.TLS {
+		return nil, nil, nil
+	}
+	config := &tls.Config{ServerName: upstream.ServerName}
+	if upstream.CA != "" {
+		pool, err := NewCertPoolReloader(upstream.CA, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		serverName := upstream.ServerName
+		if serverName == "" {
+			if serverName, _, err = net.SplitHostPort(upstream.Address); err != nil {
+				return nil, nil, err
+			}
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = pool.VerifyServer(serverName)
+	}
+	if upstream.Cert != "" || upstream.Key != "" {
+		cert, err := NewCertReloader(upstream.Cert, upstream.Key, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.GetClientCertificate = cert.GetClientCertificate
+	}
+	var pins [][]byte
+	for _, s := range upstream.Pins {
+		pin, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(pin) != 32 {
+			return nil, nil, errors.New("invalid pin " + s + ", want the base64 of a SHA-256 hash")
+		}
+		pins = append(pins, pin)
+	}
+	return config, pins, nil
+}
+
+func NewTLSServerDecorator(config *tls.Config) ConnDecorator {
+	return func(conn net.Conn) (net.Conn, error) {
+		return tls.Server(conn, config), nil
+	}
+}
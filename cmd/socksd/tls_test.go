@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a certificate for 127.0.0.1 named cn, signed by parent,
+// or self-signed CA if parent is nil.
+func newTestCertificate(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeCRL writes a CRL of ca revoking revoked, dated in the future so that reloaders
+// see it changed.
+func writeCRL(t *testing.T, file string, ca tls.Certificate, number int64, revoked ...*x509.Certificate) {
+	t.Helper()
+	list := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, ca.Leaf, ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, file, "X509 CRL", der)
+	modTime := time.Now().Add(time.Duration(number) * time.Minute)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLSRevokedCertificateCantResume(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "server", &ca)
+	client := newTestCertificate(t, "client", &ca)
+	key, err := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Proxy{
+		TLS:      true,
+		Cert:     filepath.Join(dir, "cert.pem"),
+		Key:      filepath.Join(dir, "key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+		CRL:      filepath.Join(dir, "crl.pem"),
+	}
+	writePEM(t, conf.Cert, "CERTIFICATE", server.Certificate[0])
+	writePEM(t, conf.Key, "EC PRIVATE KEY", key)
+	writePEM(t, conf.ClientCA, "CERTIFICATE", ca.Certificate[0])
+	writeCRL(t, conf.CRL, ca, 1)
+
+	config, err := BuildServerTLSConfig(conf, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{client},
+		RootCAs:            roots,
+		ServerName:         "127.0.0.1",
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	// dial reports whether the server accepted the client, and whether the session
+	// was resumed.
+	dial := func() (accepted, resumed bool) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return false, false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		b, _ := ioutil.ReadAll(conn)
+		return string(b) == "ok", conn.ConnectionState().DidResume
+	}
+
+	if accepted, _ := dial(); !accepted {
+		t.Fatal("valid certificate rejected")
+	}
+	if accepted, resumed := dial(); !accepted || !resumed {
+		t.Fatalf("got accepted %v, resumed %v, want a resumed session", accepted, resumed)
+	}
+
+	writeCRL(t, conf.CRL, ca, 2, client.Leaf)
+	time.Sleep(reloadCheckInterval + 100*time.Millisecond)
+	if accepted, _ := dial(); accepted {
+		t.Fatal("revoked certificate accepted on a resumed session")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpSessionIdle   = time.Minute
+	udpSessionQueue  = 64
+	maxUDPPacketSize = 64 << 10
+)
+
+// udpSessions hands the datagrams of each client to a session of its own.
+type udpSessions struct {
+	lock     sync.Mutex
+	sessions map[string]chan []byte
+}
+
+// dispatch queues packet to the session of key, starting it with run if there is none.
+// Like the network, it drops datagrams that can't be queued.
+func (s *udpSessions) dispatch(key string, packet []byte, run func(packets <-chan []byte)) {
+	s.lock.Lock()
+	packets, ok := s.sessions[key]
+	if !ok {
+		if s.sessions == nil {
+			s.sessions = make(map[string]chan []byte)
+		}
+		packets = make(chan []byte, udpSessionQueue)
+		s.sessions[key] = packets
+		go func() {
+			run(packets)
+			s.lock.Lock()
+			delete(s.sessions, key)
+			s.lock.Unlock()
+		}()
+	}
+	s.lock.Unlock()
+
+	select {
+	case packets <- packet:
+	default:
+	}
+}
+
+// relayUDP writes packets to remote, and the datagrams read from remote with reply,
+// until no datagram has come from either side for udpSessionIdle.
+func relayUDP(remote net.Conn, packets <-chan []byte, reply func([]byte) error) (up, down int64) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := reply(buf[:n]); err != nil {
+				return
+			}
+			atomic.AddInt64(&down, int64(n))
+			remote.SetReadDeadline(time.Now().Add(udpSessionIdle))
+		}
+	}()
+
+	remote.SetReadDeadline(time.Now().Add(udpSessionIdle))
+	for {
+		select {
+		case packet := <-packets:
+			if _, err := remote.Write(packet); err == nil {
+				up += int64(len(packet))
+			}
+			remote.SetReadDeadline(time.Now().Add(udpSessionIdle))
+		case <-done:
+			return up, atomic.LoadInt64(&down)
+		}
+	}
+}
+
+// isClosedError reports whether err comes from a closed connection, which is how the
+// listeners stopped by a reload end their loops.
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/eahydra/socks"
 )
@@ -10,25 +13,110 @@ import (
 type UpstreamDialer struct {
 	nextRouter     uint64
 	forwardDialers []socks.Dialer
+	health         *HealthChecker
+	attempts       int
+	logger         *Logger
 }
 
-func NewUpstreamDialer(forwardDialers []socks.Dialer) *UpstreamDialer {
+// NewUpstreamDialer returns a dialer rotating over forwardDialers, which tries up to
+// attempts of them for a dial, one if zero.
+func NewUpstreamDialer(forwardDialers []socks.Dialer, attempts int, logger *Logger) *UpstreamDialer {
+	if attempts <= 0 {
+		attempts = 1
+	}
+	if attempts > len(forwardDialers) {
+		attempts = len(forwardDialers)
+	}
 	return &UpstreamDialer{
 		forwardDialers: forwardDialers,
+		attempts:       attempts,
+		logger:         logger,
 	}
 }
 
-func (u *UpstreamDialer) getNextDialer() socks.Dialer {
-	old := atomic.AddUint64(&u.nextRouter, 1)
-	return u.forwardDialers[old%uint64(len(u.forwardDialers))]
+// CheckHealth takes the upstreams out of the rotation while health finds them down.
+func (u *UpstreamDialer) CheckHealth(health *HealthChecker) {
+	u.health = health
+}
+
+// Close stops the health checks.
+func (u *UpstreamDialer) Close() error {
+	return u.health.Close()
 }
 
 func (u *UpstreamDialer) Dial(network, address string) (net.Conn, error) {
-	router := u.getNextDialer()
-	conn, err := router.Dial(network, address)
+	return u.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials through the next upstream in the rotation, skipping those found
+// down, and tries the following ones when the upstream fails, up to attempts in all.
+// A failure reply of the upstream is about the destination, which the others would
+// fail to reach too, so it is returned right away. If all are down, it tries the next
+// anyway, since failing outright helps no one.
+func (u *UpstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n := uint64(len(u.forwardDialers))
+	start := atomic.AddUint64(&u.nextRouter, 1)
+	var err error
+	tried := 0
+	for i := uint64(0); i < n && tried < u.attempts; i++ {
+		index := int((start + i) % n)
+		if !u.health.acquire(index, time.Now()) {
+			continue
+		}
+		tried++
+		var conn net.Conn
+		var replyErr *socks.ReplyError
+		if conn, err = u.dial(ctx, index, network, address); err == nil || ctx.Err() != nil || errors.As(err, &replyErr) {
+			return conn, err
+		}
+	}
+	if tried == 0 {
+		return u.dial(ctx, int(start%n), network, address)
+	}
+	return nil, err
+}
+
+func (u *UpstreamDialer) dial(ctx context.Context, index int, network, address string) (net.Conn, error) {
+	conn, err := socks.DialContext(ctx, u.forwardDialers[index], network, address)
+	u.health.release(ctx, index, err)
 	if err != nil {
-		ErrLog.Println("UpstreamDialer router.Dial failed, err:", err, network, address)
+		fields := []interface{}{"network", network, "dest", address, "error", err}
+		if info := socks.SessionInfoFromContext(ctx); info != nil {
+			fields = append(fields, "conn", info.ID, "client", info.ClientAddr)
+		}
+		u.logger.Warn("upstream dial failed", fields...)
 		return nil, err
 	}
 	return conn, nil
 }
+
+// upstreamConn tags a connection with the name of the upstream carrying it,
+// so that servers can report it in socks.SessionInfo.
+type upstreamConn struct {
+	net.Conn
+	upstream string
+}
+
+func (c *upstreamConn) Upstream() string {
+	return c.upstream
+}
+
+type namedDialer struct {
+	name    string
+	forward socks.Dialer
+	metrics *Metrics
+}
+
+func (d *namedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *namedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := socks.DialContext(ctx, d.forward, network, address)
+	d.metrics.ObserveUpstreamDial(d.name, time.Since(start), err)
+	if err != nil {
+		return nil, &socks.UpstreamError{Upstream: d.name, Err: err}
+	}
+	return &upstreamConn{Conn: conn, upstream: d.name}, nil
+}
@@ -0,0 +1,564 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 commands. SOCKS4 uses the same codes for CONNECT and BIND. CmdListen is a
+// private command of this package, served by ListenHandler.
+const (
+	CmdConnect      = 1
+	CmdBind         = 2
+	CmdUDPAssociate = 3
+	CmdListen       = 0x80
+)
+
+// SOCKS5 authentication methods.
+const (
+	MethodNoAuth       = 0
+	MethodGSSAPI       = 1
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
+)
+
+// SOCKS5 address types.
+const (
+	AddrTypeIPv4   = 1
+	AddrTypeDomain = 3
+	AddrTypeIPv6   = 4
+)
+
+// SOCKS5 reply codes.
+const (
+	ReplySucceeded           = 0
+	ReplyGeneralFailure      = 1
+	ReplyNotAllowed          = 2
+	ReplyNetworkUnreachable  = 3
+	ReplyHostUnreachable     = 4
+	ReplyConnectionRefused   = 5
+	ReplyTTLExpired          = 6
+	ReplyCommandNotSupported = 7
+	ReplyAddressNotSupported = 8
+)
+
+const userPassVersion = 1
+
+// Addr is the address field of SOCKS5 and shadowsocks messages: an IPv4 or IPv6
+// address or a domain name, followed by a port. Exactly one of IP and Name is set.
+type Addr struct {
+	IP   net.IP
+	Name string
+	Port uint16
+}
+
+// ParseAddr parses address in host:port form. Hosts that are not IP addresses are domain names.
+func ParseAddr(address string) (*Addr, error) {
+	return parseAddr(address, 1)
+}
+
+// parseAddr is ParseAddr with ports from minPort, which is 0 for the addresses of LISTEN
+// requests, letting the server pick the port.
+func parseAddr(address string, minPort int) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("socks: failed to parse port number: " + portStr)
+	}
+	if port < minPort || port > 0xffff {
+		return nil, errors.New("socks: port number out of range: " + portStr)
+	}
+	a := &Addr{Port: uint16(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IP = ip
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, errors.New("socks: invalid destination hostname: " + host)
+		}
+		a.Name = host
+	}
+	return a, nil
+}
+
+// Type returns the SOCKS5 address type of a.
+func (a *Addr) Type() byte {
+	switch {
+	case a.IP == nil:
+		return AddrTypeDomain
+	case a.IP.To4() != nil:
+		return AddrTypeIPv4
+	default:
+		return AddrTypeIPv6
+	}
+}
+
+// Host returns the IP address or the domain name of a.
+func (a *Addr) Host() string {
+	if a.IP != nil {
+		return a.IP.String()
+	}
+	return a.Name
+}
+
+// String returns a in host:port form.
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+func (a *Addr) appendTo(b []byte) ([]byte, error) {
+	switch a.Type() {
+	case AddrTypeIPv4:
+		b = append(b, AddrTypeIPv4)
+		b = append(b, a.IP.To4()...)
+	case AddrTypeIPv6:
+		if len(a.IP) != net.IPv6len {
+			return nil, errors.New("socks: invalid IP address: " + a.IP.String())
+		}
+		b = append(b, AddrTypeIPv6)
+		b = append(b, a.IP...)
+	default:
+		if len(a.Name) == 0 || len(a.Name) > 255 {
+			return nil, errors.New("socks: invalid destination hostname: " + a.Name)
+		}
+		b = append(b, AddrTypeDomain, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port)), nil
+}
+
+// WriteTo writes the address type, the address and the port.
+func (a *Addr) WriteTo(w io.Writer) (int64, error) {
+	b, err := a.appendTo(nil)
+	if err != nil {
+		return 0, err
+	}
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the address type, the address and the port.
+func (a *Addr) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 1)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	return a.readAfterType(r, b[0], n)
+}
+
+// readAfterType reads the rest of an address of type addrType, n bytes having been read so far.
+func (a *Addr) readAfterType(r io.Reader, addrType byte, n int64) (int64, error) {
+	*a = Addr{}
+	switch addrType {
+	case AddrTypeIPv4, AddrTypeIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == AddrTypeIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if err := readFull(r, ip, &n); err != nil {
+			return n, err
+		}
+		a.IP = ip
+	case AddrTypeDomain:
+		b := make([]byte, 1)
+		if err := readFull(r, b, &n); err != nil {
+			return n, err
+		}
+		if b[0] == 0 {
+			return n, errors.New("socks: empty domain name")
+		}
+		name := make([]byte, b[0])
+		if err := readFull(r, name, &n); err != nil {
+			return n, err
+		}
+		a.Name = string(name)
+	default:
+		return n, &UnsupportedAddrTypeError{Type: addrType}
+	}
+	port := make([]byte, 2)
+	if err := readFull(r, port, &n); err != nil {
+		return n, err
+	}
+	a.Port = uint16(port[0])<<8 | uint16(port[1])
+	return n, nil
+}
+
+// UnsupportedAddrTypeError is returned when a message has an unknown address type.
+type UnsupportedAddrTypeError struct {
+	Type byte
+}
+
+func (e *UnsupportedAddrTypeError) Error() string {
+	return "socks: unknown address type " + strconv.Itoa(int(e.Type))
+}
+
+// MethodSelection is the version identifier/method selection message a SOCKS5 client sends first.
+type MethodSelection struct {
+	Methods []byte
+}
+
+// WriteTo writes the message.
+func (m *MethodSelection) WriteTo(w io.Writer) (int64, error) {
+	if len(m.Methods) == 0 || len(m.Methods) > 255 {
+		return 0, errors.New("socks: invalid number of authentication methods: " + strconv.Itoa(len(m.Methods)))
+	}
+	b := append([]byte{socks5Version, byte(len(m.Methods))}, m.Methods...)
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the message.
+func (m *MethodSelection) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 2)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], socks5Version); err != nil {
+		return n, err
+	}
+	if b[1] == 0 {
+		return n, errors.New("socks: no authentication methods")
+	}
+	m.Methods = make([]byte, b[1])
+	err := readFull(r, m.Methods, &n)
+	return n, err
+}
+
+// MethodSelectionReply is the METHOD selection message a SOCKS5 server answers with.
+type MethodSelectionReply struct {
+	Method byte
+}
+
+// WriteTo writes the message.
+func (m *MethodSelectionReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAll(w, []byte{socks5Version, m.Method})
+}
+
+// ReadFrom reads the message.
+func (m *MethodSelectionReply) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 2)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], socks5Version); err != nil {
+		return n, err
+	}
+	m.Method = b[1]
+	return n, nil
+}
+
+// UserPassAuth is the USERNAME/PASSWORD authentication request (RFC 1929).
+type UserPassAuth struct {
+	Username string
+	Password string
+}
+
+// WriteTo writes the message.
+func (m *UserPassAuth) WriteTo(w io.Writer) (int64, error) {
+	if len(m.Username) == 0 || len(m.Username) > 255 || len(m.Password) > 255 {
+		return 0, errors.New("socks: username must be 1 to 255 bytes long, password at most 255")
+	}
+	b := make([]byte, 0, 3+len(m.Username)+len(m.Password))
+	b = append(b, userPassVersion, byte(len(m.Username)))
+	b = append(b, m.Username...)
+	b = append(b, byte(len(m.Password)))
+	b = append(b, m.Password...)
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the message.
+func (m *UserPassAuth) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 2)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], userPassVersion); err != nil {
+		return n, err
+	}
+	if b[1] == 0 {
+		return n, errors.New("socks: empty username")
+	}
+	username, err := readString(r, b[1], &n)
+	if err != nil {
+		return n, err
+	}
+	if err := readFull(r, b[:1], &n); err != nil {
+		return n, err
+	}
+	password, err := readString(r, b[0], &n)
+	if err != nil {
+		return n, err
+	}
+	m.Username, m.Password = username, password
+	return n, nil
+}
+
+// UserPassAuthReply is the reply to UserPassAuth. Status 0 means success.
+type UserPassAuthReply struct {
+	Status byte
+}
+
+// WriteTo writes the message.
+func (m *UserPassAuthReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAll(w, []byte{userPassVersion, m.Status})
+}
+
+// ReadFrom reads the message.
+func (m *UserPassAuthReply) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 2)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], userPassVersion); err != nil {
+		return n, err
+	}
+	m.Status = b[1]
+	return n, nil
+}
+
+// Request is a SOCKS5 request.
+type Request struct {
+	Command byte
+	Addr    Addr
+}
+
+// WriteTo writes the message.
+func (m *Request) WriteTo(w io.Writer) (int64, error) {
+	return writeCommand(w, m.Command, &m.Addr)
+}
+
+// ReadFrom reads the message. If the address type is unknown, the error is
+// an *UnsupportedAddrTypeError and the command has been read.
+func (m *Request) ReadFrom(r io.Reader) (int64, error) {
+	return readCommand(r, &m.Command, &m.Addr)
+}
+
+// Reply is a SOCKS5 reply, Addr is the server bound address.
+type Reply struct {
+	Reply byte
+	Addr  Addr
+}
+
+// WriteTo writes the message.
+func (m *Reply) WriteTo(w io.Writer) (int64, error) {
+	return writeCommand(w, m.Reply, &m.Addr)
+}
+
+// ReadFrom reads the message.
+func (m *Reply) ReadFrom(r io.Reader) (int64, error) {
+	return readCommand(r, &m.Reply, &m.Addr)
+}
+
+// writeCommand writes the common layout of requests and replies: VER, a code, RSV and an address.
+func writeCommand(w io.Writer, code byte, addr *Addr) (int64, error) {
+	b, err := addr.appendTo([]byte{socks5Version, code, 0})
+	if err != nil {
+		return 0, err
+	}
+	return writeAll(w, b)
+}
+
+func readCommand(r io.Reader, code *byte, addr *Addr) (int64, error) {
+	var n int64
+	b := make([]byte, 4)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], socks5Version); err != nil {
+		return n, err
+	}
+	if b[2] != 0 {
+		return n, errors.New("socks: reserved field must be 0")
+	}
+	*code = b[1]
+	return addr.readAfterType(r, b[3], n)
+}
+
+// UDPHeader is the header of a UDP datagram relayed by a SOCKS5 server.
+type UDPHeader struct {
+	Frag byte
+	Addr Addr
+}
+
+// WriteTo writes the header.
+func (m *UDPHeader) WriteTo(w io.Writer) (int64, error) {
+	b, err := m.Addr.appendTo([]byte{0, 0, m.Frag})
+	if err != nil {
+		return 0, err
+	}
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the header, leaving the data in r.
+func (m *UDPHeader) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 4)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return n, errors.New("socks: reserved field must be 0")
+	}
+	m.Frag = b[2]
+	return m.Addr.readAfterType(r, b[3], n)
+}
+
+// Socks4Request is a SOCKS4 request. If Name is set, it is a SOCKS4a request and IP
+// is ignored when writing.
+type Socks4Request struct {
+	Command byte
+	Port    uint16
+	IP      net.IP
+	UserID  string
+	Name    string
+}
+
+// Addr returns the destination in host:port form.
+func (m *Socks4Request) Addr() string {
+	host := m.Name
+	if host == "" {
+		host = m.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(m.Port)))
+}
+
+// WriteTo writes the message.
+func (m *Socks4Request) WriteTo(w io.Writer) (int64, error) {
+	ip := net.IPv4(0, 0, 0, 1).To4()
+	if m.Name == "" {
+		if ip = m.IP.To4(); ip == nil {
+			return 0, errors.New("socks: destination ip must be ipv4: " + m.IP.String())
+		}
+	}
+	if len(m.UserID) > 255 || len(m.Name) > 255 {
+		return 0, errors.New("socks: SOCKS4 user id or domain name too long")
+	}
+	b := make([]byte, 0, 10+len(m.UserID)+len(m.Name))
+	b = append(b, socks4Version, m.Command, byte(m.Port>>8), byte(m.Port))
+	b = append(b, ip...)
+	b = append(b, m.UserID...)
+	b = append(b, 0)
+	if m.Name != "" {
+		b = append(b, m.Name...)
+		b = append(b, 0)
+	}
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the message, including the domain name of SOCKS4a requests.
+func (m *Socks4Request) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 8)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if err := checkVersion(b[0], socks4Version); err != nil {
+		return n, err
+	}
+	*m = Socks4Request{
+		Command: b[1],
+		Port:    uint16(b[2])<<8 | uint16(b[3]),
+		IP:      net.IP(b[4:8]),
+	}
+	var err error
+	if m.UserID, err = readNullTerminated(r, &n); err != nil {
+		return n, err
+	}
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		if m.Name, err = readNullTerminated(r, &n); err != nil {
+			return n, err
+		}
+		if m.Name == "" {
+			return n, errors.New("socks: empty domain name")
+		}
+	}
+	return n, nil
+}
+
+// Socks4Reply is a SOCKS4 reply.
+type Socks4Reply struct {
+	Code byte
+	Port uint16
+	IP   net.IP
+}
+
+// WriteTo writes the message.
+func (m *Socks4Reply) WriteTo(w io.Writer) (int64, error) {
+	b := []byte{0, m.Code, byte(m.Port >> 8), byte(m.Port), 0, 0, 0, 0}
+	if ip := m.IP.To4(); ip != nil {
+		copy(b[4:], ip)
+	}
+	return writeAll(w, b)
+}
+
+// ReadFrom reads the message.
+func (m *Socks4Reply) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	b := make([]byte, 8)
+	if err := readFull(r, b, &n); err != nil {
+		return n, err
+	}
+	if b[0] != 0 {
+		return n, errors.New("socks: invalid SOCKS4 reply version " + strconv.Itoa(int(b[0])))
+	}
+	*m = Socks4Reply{
+		Code: b[1],
+		Port: uint16(b[2])<<8 | uint16(b[3]),
+		IP:   net.IP(b[4:8]),
+	}
+	return n, nil
+}
+
+func checkVersion(got, want byte) error {
+	if got != want {
+		return errors.New("socks: invalid version " + strconv.Itoa(int(got)) + ", want " + strconv.Itoa(int(want)))
+	}
+	return nil
+}
+
+func writeAll(w io.Writer, b []byte) (int64, error) {
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// readFull fills b from r and adds the bytes read to *n.
+func readFull(r io.Reader, b []byte, n *int64) error {
+	m, err := io.ReadFull(r, b)
+	*n += int64(m)
+	return err
+}
+
+// readString reads a string of length bytes, which RFC 1929 allows to be empty for
+// passwords.
+func readString(r io.Reader, length byte, n *int64) (string, error) {
+	b := make([]byte, length)
+	if err := readFull(r, b, n); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readNullTerminated reads a NULL terminated string of at most 255 bytes.
+func readNullTerminated(r io.Reader, n *int64) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if err := readFull(r, b, n); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) >= 255 {
+			return "", errors.New("socks: SOCKS4 field too long")
+		}
+		s = append(s, b[0])
+	}
+}
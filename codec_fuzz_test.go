@@ -0,0 +1,68 @@
+//go:build go1.18
+// +build go1.18
+
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzCodec checks that every message read from data can be written, and that reading
+// back what was written gives the same bytes again. The first write may differ from
+// data, as IPv4-mapped IPv6 addresses are written as IPv4.
+func fuzzCodec(f *testing.F, new func() message, seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := new()
+		n, err := msg.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buff := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buff); err != nil {
+			t.Fatalf("WriteTo of %+v read from %v: %v", msg, data[:n], err)
+		}
+		written := append([]byte(nil), buff.Bytes()...)
+		again := new()
+		if _, err := again.ReadFrom(buff); err != nil {
+			t.Fatalf("ReadFrom of %v written from %v: %v", written, data[:n], err)
+		}
+		buff.Reset()
+		again.WriteTo(buff)
+		if !bytes.Equal(buff.Bytes(), written) {
+			t.Fatalf("wrote %v, then %v", written, buff.Bytes())
+		}
+	})
+}
+
+func FuzzMethodSelection(f *testing.F) {
+	fuzzCodec(f, func() message { return &MethodSelection{} }, []byte{5, 2, 0, 2})
+}
+
+func FuzzUserPassAuth(f *testing.F) {
+	fuzzCodec(f, func() message { return &UserPassAuth{} }, []byte{1, 3, 'b', 'o', 'b', 2, 'p', 'w'})
+}
+
+func FuzzRequest(f *testing.F) {
+	fuzzCodec(f, func() message { return &Request{} },
+		[]byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+		[]byte{5, 1, 0, 3, 4, 'a', '.', 'i', 'o', 1, 187},
+		append([]byte{5, 1, 0, 4}, make([]byte, 18)...))
+}
+
+func FuzzReply(f *testing.F) {
+	fuzzCodec(f, func() message { return &Reply{} }, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0x22, 0x22})
+}
+
+func FuzzUDPHeader(f *testing.F) {
+	fuzzCodec(f, func() message { return &UDPHeader{} }, []byte{0, 0, 0, 3, 1, 'a', 0, 53})
+}
+
+func FuzzSocks4Request(f *testing.F) {
+	fuzzCodec(f, func() message { return &Socks4Request{} },
+		[]byte{4, 1, 0, 80, 1, 2, 3, 4, 'u', 0},
+		[]byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 'a', '.', 'i', 'o', 0})
+}
@@ -0,0 +1,125 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type message interface {
+	io.ReaderFrom
+	io.WriterTo
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		new  func() message
+		wire []byte
+	}{
+		{"method selection", &MethodSelection{Methods: []byte{MethodNoAuth, MethodUserPass}}, func() message { return &MethodSelection{} },
+			[]byte{5, 2, 0, 2}},
+		{"method selection reply", &MethodSelectionReply{Method: MethodUserPass}, func() message { return &MethodSelectionReply{} },
+			[]byte{5, 2}},
+		{"user pass", &UserPassAuth{Username: "bob", Password: "pw"}, func() message { return &UserPassAuth{} },
+			[]byte{1, 3, 'b', 'o', 'b', 2, 'p', 'w'}},
+		{"user empty pass", &UserPassAuth{Username: "bob"}, func() message { return &UserPassAuth{} },
+			[]byte{1, 3, 'b', 'o', 'b', 0}},
+		{"user pass reply", &UserPassAuthReply{Status: 1}, func() message { return &UserPassAuthReply{} },
+			[]byte{1, 1}},
+		{"request ipv4", &Request{Command: CmdConnect, Addr: Addr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 80}}, func() message { return &Request{} },
+			[]byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80}},
+		{"request domain", &Request{Command: CmdConnect, Addr: Addr{Name: "a.io", Port: 443}}, func() message { return &Request{} },
+			[]byte{5, 1, 0, 3, 4, 'a', '.', 'i', 'o', 1, 187}},
+		{"reply ipv6", &Reply{Reply: ReplySucceeded, Addr: Addr{IP: net.ParseIP("::1"), Port: 1}}, func() message { return &Reply{} },
+			append(append([]byte{5, 0, 0, 4}, net.ParseIP("::1")...), 0, 1)},
+		{"udp header", &UDPHeader{Frag: 1, Addr: Addr{IP: net.IPv4(8, 8, 8, 8).To4(), Port: 53}}, func() message { return &UDPHeader{} },
+			[]byte{0, 0, 1, 1, 8, 8, 8, 8, 0, 53}},
+		{"socks4 request", &Socks4Request{Command: CmdConnect, Port: 80, IP: net.IPv4(1, 2, 3, 4).To4(), UserID: "u"}, func() message { return &Socks4Request{} },
+			[]byte{4, 1, 0, 80, 1, 2, 3, 4, 'u', 0}},
+		{"socks4a request", &Socks4Request{Command: CmdConnect, Port: 80, IP: net.IPv4(0, 0, 0, 1).To4(), Name: "a.io"}, func() message { return &Socks4Request{} },
+			[]byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 'a', '.', 'i', 'o', 0}},
+		{"socks4 reply", &Socks4Reply{Code: socks4Granted, IP: net.IPv4zero.To4()}, func() message { return &Socks4Reply{} },
+			[]byte{0, 90, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		buff := &bytes.Buffer{}
+		n, err := test.msg.WriteTo(buff)
+		if err != nil || n != int64(len(test.wire)) || !bytes.Equal(buff.Bytes(), test.wire) {
+			t.Errorf("%s: WriteTo wrote %v, %d, %v, want %v", test.name, buff.Bytes(), n, err, test.wire)
+			continue
+		}
+		got := test.new()
+		n, err = got.ReadFrom(bytes.NewReader(test.wire))
+		if err != nil || n != int64(len(test.wire)) {
+			t.Errorf("%s: ReadFrom returned %d, %v", test.name, n, err)
+			continue
+		}
+		buff.Reset()
+		got.WriteTo(buff)
+		if !bytes.Equal(buff.Bytes(), test.wire) {
+			t.Errorf("%s: read %+v, want %+v", test.name, got, test.msg)
+		}
+	}
+}
+
+func TestCodecRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		wire []byte
+	}{
+		{"wrong version", &MethodSelection{}, []byte{4, 1, 0}},
+		{"no methods", &MethodSelection{}, []byte{5, 0}},
+		{"truncated methods", &MethodSelection{}, []byte{5, 2, 0}},
+		{"wrong auth version", &UserPassAuth{}, []byte{5, 1, 'a', 1, 'b'}},
+		{"empty username", &UserPassAuth{}, []byte{1, 0, 1, 'b'}},
+		{"reserved set", &Request{}, []byte{5, 1, 1, 1, 1, 2, 3, 4, 0, 80}},
+		{"empty domain", &Request{}, []byte{5, 1, 0, 3, 0, 0, 80}},
+		{"truncated port", &Reply{}, []byte{5, 0, 0, 1, 1, 2, 3, 4, 0}},
+		{"udp reserved set", &UDPHeader{}, []byte{0, 1, 0, 1, 1, 2, 3, 4, 0, 80}},
+		{"socks4 version", &Socks4Request{}, []byte{5, 1, 0, 80, 1, 2, 3, 4, 0}},
+		{"socks4 unterminated", &Socks4Request{}, []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u'}},
+	}
+	for _, test := range tests {
+		if _, err := test.msg.ReadFrom(bytes.NewReader(test.wire)); err == nil {
+			t.Errorf("%s: ReadFrom accepted %v", test.name, test.wire)
+		}
+	}
+
+	var addrErr *UnsupportedAddrTypeError
+	request := &Request{}
+	_, err := request.ReadFrom(bytes.NewReader([]byte{5, 1, 0, 9}))
+	if !errors.As(err, &addrErr) || addrErr.Type != 9 || request.Command != CmdConnect {
+		t.Errorf("unknown address type: got %v, command %d", err, request.Command)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		typ     byte
+		ok      bool
+	}{
+		{"1.2.3.4:80", AddrTypeIPv4, true},
+		{"[::1]:80", AddrTypeIPv6, true},
+		{"example.com:443", AddrTypeDomain, true},
+		{"example.com", 0, false},
+		{"example.com:0", 0, false},
+		{"example.com:65536", 0, false},
+		{":80", 0, false},
+	}
+	for _, test := range tests {
+		addr, err := ParseAddr(test.address)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseAddr(%q) returned error %v", test.address, err)
+			continue
+		}
+		if err == nil && (addr.Type() != test.typ || addr.String() != test.address) {
+			t.Errorf("ParseAddr(%q) = %v of type %d, want type %d", test.address, addr, addr.Type(), test.typ)
+		}
+	}
+}
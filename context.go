@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// A ContextDialer is a Dialer that can also dial with a context. Servers pass their
+// forward a context carrying the SessionInfo of the request, see SessionInfoFromContext.
+type ContextDialer interface {
+	Dialer
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext dials address through d with ctx if d is a ContextDialer, or with d.Dial
+// otherwise. Dialers that wrap another Dialer use it to pass the context on.
+func DialContext(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	if cd, ok := d.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	return d.Dial(network, address)
+}
+
+type sessionInfoKey struct{}
+
+// ContextWithSessionInfo returns a copy of ctx that carries info.
+func ContextWithSessionInfo(ctx context.Context, info *SessionInfo) context.Context {
+	return context.WithValue(ctx, sessionInfoKey{}, info)
+}
+
+// SessionInfoFromContext returns the SessionInfo of the request a server is dialing for,
+// or nil if ctx carries none. Routing and accounting Dialers use it to learn the client
+// address, listener, user, protocol and requested domain. It must not be modified.
+func SessionInfoFromContext(ctx context.Context) *SessionInfo {
+	info, _ := ctx.Value(sessionInfoKey{}).(*SessionInfo)
+	return info
+}
+
+// WithListenerName names the listener a server serves, reported in SessionInfo.Listener.
+func WithListenerName(name string) Option {
+	return func(o *options) {
+		o.listener = name
+	}
+}
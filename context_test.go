@@ -0,0 +1,58 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+type recordDialer struct {
+	infos chan SessionInfo
+}
+
+func (d *recordDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if info := SessionInfoFromContext(ctx); info != nil {
+		d.infos <- *info
+	}
+	return DialContext(ctx, Direct, network, address)
+}
+
+func TestSocks5ServerDialContext(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	forward := &recordDialer{infos: make(chan SessionInfo, 1)}
+	server, err := NewSocks5Server(forward, WithListenerName("inbound"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(echo.Addr())
+	conn, err := client.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 10)
+	conn.Close()
+
+	info := <-forward.infos
+	if info.Protocol != "socks5" || info.Listener != "inbound" || info.Domain != "localhost" || info.ClientAddr != conn.LocalAddr().String() {
+		t.Fatalf("forward got session info %+v", info)
+	}
+}
@@ -1,6 +1,9 @@
 package socks
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 // A Dialer is a means to establish a connection.
 type Dialer interface {
@@ -10,9 +13,14 @@ type Dialer interface {
 
 type direct struct{}
 
-// Direct is a direct proxy which implements Dialer interface: one that makes connections directly.
+// Direct is a direct proxy which implements the Dialer and ContextDialer interfaces: one that makes connections directly.
 var Direct = direct{}
 
 func (direct) Dial(network, address string) (net.Conn, error) {
 	return net.Dial(network, address)
 }
+
+func (direct) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
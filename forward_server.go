@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"net"
+)
+
+// ForwardServer relays every accepted connection to a destination known without a
+// proxy handshake, like the fixed target of a port forward or the original destination
+// of a connection redirected by a firewall.
+type ForwardServer struct {
+	protocol    string
+	forward     Dialer
+	destination func(net.Conn) (string, error)
+	opts        options
+}
+
+// NewForwardServer returns a ForwardServer that dials through forward the address
+// returned by destination for each connection. protocol names its sessions.
+func NewForwardServer(protocol string, forward Dialer, destination func(conn net.Conn) (string, error), opts ...Option) *ForwardServer {
+	return &ForwardServer{
+		protocol:    protocol,
+		forward:     forward,
+		destination: destination,
+		opts:        newOptions(opts),
+	}
+}
+
+// LocalDestination returns the local address of conn, which is the original
+// destination of connections redirected by TPROXY.
+func LocalDestination(conn net.Conn) (string, error) {
+	return conn.LocalAddr().String(), nil
+}
+
+// Serve accepts connections on listener and relays them until listener fails.
+func (s *ForwardServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			} else {
+				return err
+			}
+		}
+
+		// There is no handshake to answer, so a rejected connection is closed right away.
+		if !s.opts.acquire(conn.RemoteAddr().String()) {
+			s.opts.logger.Warn("session rejected", "conn", nextConnID(), "client", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go s.serveClient(conn)
+	}
+}
+
+func (s *ForwardServer) serveClient(conn net.Conn) {
+	defer conn.Close()
+
+	id := nextConnID()
+	clientAddr := conn.RemoteAddr().String()
+	defer s.opts.release(clientAddr)
+
+	host, err := s.destination(conn)
+	if err != nil {
+		s.opts.logger.Debug(s.protocol+" destination unknown", "conn", id, "client", clientAddr, "error", err)
+		return
+	}
+
+	info := s.opts.newSessionInfo(id, s.protocol, clientAddr, host)
+	dest, err := s.opts.dialForward(s.forward, info, "tcp", host)
+	if err != nil {
+		s.opts.endSession(info, 0, 0, err)
+		return
+	}
+	defer dest.Close()
+
+	client, err := s.opts.decorateSession(conn, info)
+	if err != nil {
+		s.opts.endSession(info, 0, 0, err)
+		return
+	}
+	up, down, err := s.opts.relay(info, client, dest)
+	s.opts.endSession(info, up, down, err)
+}
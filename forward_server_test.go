@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestForwardServer(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	observer := newRecordObserver()
+	server := NewForwardServer("forward", Direct, func(net.Conn) (string, error) {
+		return echo.Addr(), nil
+	}, WithObserver(observer))
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+	conn.Close()
+
+	select {
+	case r := <-observer.ended:
+		if r.info.Protocol != "forward" || r.info.Destination != echo.Addr() {
+			t.Fatalf("unexpected session info: %+v", r.info)
+		}
+		if r.up != 1000 || r.down != 1000 {
+			t.Fatalf("got %d bytes up and %d bytes down, want 1000", r.up, r.down)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSessionEnd not called")
+	}
+}
@@ -1,5 +1,9 @@
 module github.com/eahydra/socks
 
-go 1.13
+go 1.21
 
-require github.com/codahale/chacha20 v0.0.0-20151107025005-ec07b4f69a3f
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/codahale/chacha20 v0.0.0-20151107025005-ec07b4f69a3f
+	gopkg.in/yaml.v3 v3.0.1
+)
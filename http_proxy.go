@@ -1,12 +1,22 @@
 package socks
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	httpIdleConnTimeout     = 90 * time.Second
+	httpMaxIdleConnsPerHost = 4
 )
 
 // HTTPProxy is an HTTP Handler that serve CONNECT method and
@@ -14,21 +24,27 @@ import (
 type HTTPProxy struct {
 	*httputil.ReverseProxy
 	forward Dialer
+	opts    options
 }
 
 // NewHTTPProxy constructs one HTTPProxy
-func NewHTTPProxy(forward Dialer) *HTTPProxy {
-	return &HTTPProxy{
-		ReverseProxy: &httputil.ReverseProxy{
-			Director: director,
-			Transport: &http.Transport{
-				Dial: func(network, addr string) (net.Conn, error) {
-					return forward.Dial(network, addr)
-				},
-			},
-		},
+func NewHTTPProxy(forward Dialer, opts ...Option) *HTTPProxy {
+	h := &HTTPProxy{
 		forward: forward,
+		opts:    newOptions(opts),
+	}
+	h.ReverseProxy = &httputil.ReverseProxy{
+		Director: director,
+		// Upstream connections are kept alive for the client connection they were
+		// dialed for only, so that they go through the upstream chosen for its
+		// sessions and are accounted to its client.
+		Transport: &httpTransports{
+			dial:     h.dialContext,
+			byClient: make(map[string]*clientTransport),
+		},
+		ErrorHandler: handleProxyError,
 	}
+	return h
 }
 
 func director(request *http.Request) {
@@ -45,8 +61,91 @@ func director(request *http.Request) {
 	}
 }
 
+type httpSessionKey struct{}
+
+// httpSession tracks one plain HTTP request proxied by the ReverseProxy.
+type httpSession struct {
+	info *SessionInfo
+	err  error
+}
+
+func (h *HTTPProxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, ok := ctx.Value(httpSessionKey{}).(*httpSession)
+	if ok {
+		ctx = ContextWithSessionInfo(ctx, s.info)
+	}
+	conn, err := DialContext(ctx, h.forward, network, addr)
+	if err != nil {
+		if ok {
+			s.info.setUpstream(err)
+			h.opts.observer.OnDialFailed(s.info, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpTransports is a RoundTripper with a Transport of its own per client connection.
+type httpTransports struct {
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	lock     sync.Mutex
+	byClient map[string]*clientTransport
+	swept    time.Time
+}
+
+type clientTransport struct {
+	*http.Transport
+	used time.Time
+}
+
+func (t *httpTransports) RoundTrip(request *http.Request) (*http.Response, error) {
+	client := ""
+	if s, ok := request.Context().Value(httpSessionKey{}).(*httpSession); ok {
+		client = s.info.ClientAddr
+	}
+	return t.transport(client, time.Now()).RoundTrip(request)
+}
+
+// transport returns the Transport of client. Once per idle timeout, it drops those
+// unused for longer than their connections are kept idle.
+func (t *httpTransports) transport(client string, now time.Time) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.swept) > httpIdleConnTimeout {
+		t.swept = now
+		for key, ct := range t.byClient {
+			if now.Sub(ct.used) > httpIdleConnTimeout {
+				ct.CloseIdleConnections()
+				delete(t.byClient, key)
+			}
+		}
+	}
+	ct, ok := t.byClient[client]
+	if !ok {
+		ct = &clientTransport{Transport: &http.Transport{
+			DialContext:         t.dial,
+			MaxIdleConnsPerHost: httpMaxIdleConnsPerHost,
+			IdleConnTimeout:     httpIdleConnTimeout,
+		}}
+		t.byClient[client] = ct
+	}
+	ct.used = now
+	return ct.Transport
+}
+
+func handleProxyError(response http.ResponseWriter, request *http.Request, err error) {
+	if s, ok := request.Context().Value(httpSessionKey{}).(*httpSession); ok {
+		s.err = err
+	}
+	response.WriteHeader(http.StatusBadGateway)
+}
+
 // ServeHTTPTunnel serve incoming request with CONNECT method, then route data to proxy server
 func (h *HTTPProxy) ServeHTTPTunnel(response http.ResponseWriter, request *http.Request) {
+	user, ok := h.authenticate(response, request)
+	if !ok {
+		return
+	}
 	var conn net.Conn
 	if hj, ok := response.(http.Hijacker); ok {
 		var err error
@@ -60,34 +159,175 @@ func (h *HTTPProxy) ServeHTTPTunnel(response http.ResponseWriter, request *http.
 	}
 	defer conn.Close()
 
-	dest, err := h.forward.Dial("tcp", request.Host)
+	info := h.opts.newSessionInfo(nextConnID(), "http-connect", request.RemoteAddr, request.Host)
+	info.User = user
+	dest, err := h.opts.dialForward(h.forward, info, "tcp", request.Host)
 	if err != nil {
 		fmt.Fprintf(conn, "HTTP/1.0 500 NewRemoteSocks failed, err:%s\r\n\r\n", err)
+		h.opts.endSession(info, 0, 0, err)
 		return
 	}
 	defer dest.Close()
 
+	var body int64
 	if request.Body != nil {
-		if _, err = io.Copy(dest, request.Body); err != nil {
+		if body, err = io.Copy(dest, request.Body); err != nil {
 			fmt.Fprintf(conn, "%d %s", http.StatusBadGateway, err.Error())
+			h.opts.endSession(info, body, 0, err)
 			return
 		}
 	}
 	fmt.Fprintf(conn, "HTTP/1.0 200 Connection established\r\n\r\n")
 
-	go func() {
-		defer conn.Close()
-		defer dest.Close()
-		io.Copy(dest, conn)
-	}()
-	io.Copy(conn, dest)
+	client, err := h.opts.decorateSession(conn, info)
+	if err != nil {
+		h.opts.endSession(info, body, 0, err)
+		return
+	}
+	up, down, err := h.opts.relay(info, client, dest)
+	h.opts.endSession(info, body+up, down, err)
+}
+
+// serveHTTPRequest forwards a plain HTTP request through the ReverseProxy.
+func (h *HTTPProxy) serveHTTPRequest(response http.ResponseWriter, request *http.Request) {
+	user, ok := h.authenticate(response, request)
+	if !ok {
+		return
+	}
+	info := h.opts.newSessionInfo(nextConnID(), "http", request.RemoteAddr, requestDestination(request))
+	info.User = user
+	s := &httpSession{info: info}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(c httptrace.GotConnInfo) {
+			info.setUpstream(c.Conn)
+		},
+	}
+	ctx := httptrace.WithClientTrace(request.Context(), trace)
+	ctx = context.WithValue(ctx, httpSessionKey{}, s)
+	request = request.WithContext(ctx)
+
+	body := &countingReader{ReadCloser: request.Body}
+	if request.Body != nil {
+		request.Body = body
+	}
+	writer := &countingResponseWriter{ResponseWriter: response}
+
+	h.opts.observer.OnSessionStart(info)
+	h.ReverseProxy.ServeHTTP(writer, request)
+	h.opts.endSession(info, body.n, writer.n, s.err)
+}
+
+// authenticate returns the identity of the client of request: the user of its
+// Proxy-Authorization, or else of its client certificate. Set by WithAuthenticators, a
+// UserPassAuthenticator verifies the Basic credentials of Proxy-Authorization, which
+// requests must carry unless NoAuth is among the authenticators too; the others are
+// ignored. Requests failing authentication are answered with 407.
+func (h *HTTPProxy) authenticate(response http.ResponseWriter, request *http.Request) (string, bool) {
+	user := peerIdentity(request.TLS)
+	if h.opts.authenticators == nil {
+		return user, true
+	}
+	noAuth := false
+	username, password, ok := proxyBasicAuth(request)
+	for _, a := range h.opts.authenticators {
+		switch a := a.(type) {
+		case *UserPassAuthenticator:
+			if ok && a.verify(username, password) {
+				return username, true
+			}
+		default:
+			noAuth = noAuth || a.Method() == MethodNoAuth
+		}
+	}
+	if noAuth && !ok {
+		return user, true
+	}
+	if ok {
+		h.opts.logger.Debug("http proxy authentication failed", "client", request.RemoteAddr, "user", username)
+	}
+	response.Header().Set("Proxy-Authenticate", `Basic realm="socks"`)
+	http.Error(response, "proxy authentication required", http.StatusProxyAuthRequired)
+	return "", false
+}
+
+// proxyBasicAuth returns the Basic credentials of the Proxy-Authorization header.
+func proxyBasicAuth(request *http.Request) (username, password string, ok bool) {
+	auth := request.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	return (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+}
+
+// requestDestination returns the host:port a plain HTTP request is sent to.
+func requestDestination(request *http.Request) string {
+	host := request.URL.Host
+	if host == "" {
+		host = request.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if request.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
 }
 
 // ServeHTTP implements HTTP Handler
 func (h *HTTPProxy) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if !h.opts.acquire(request.RemoteAddr) {
+		http.Error(response, "too many connections", http.StatusServiceUnavailable)
+		h.opts.logger.Warn("session rejected", "client", request.RemoteAddr, "dest", request.Host)
+		return
+	}
+	defer h.opts.release(request.RemoteAddr)
+
 	if request.Method == "CONNECT" {
 		h.ServeHTTPTunnel(response, request)
 	} else {
-		h.ReverseProxy.ServeHTTP(response, request)
+		h.serveHTTPRequest(response, request)
 	}
 }
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("socks: %T does not implement http.Hijacker", w.ResponseWriter)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,125 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+// countingDialer dials directly and counts the dials.
+type countingDialer struct {
+	dials int32
+}
+
+func (d *countingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return DialContext(ctx, Direct, network, address)
+}
+
+func TestHTTPProxyReusesUpstreamConns(t *testing.T) {
+	backend := sockstest.NewHTTPServer("hello")
+	defer backend.Close()
+	forward := &countingDialer{}
+	proxy := httptest.NewServer(NewHTTPProxy(forward))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(client *http.Client) {
+		t.Helper()
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "hello" {
+			t.Fatalf("got %q, %v, want hello", body, err)
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := 0; i < 3; i++ {
+		get(client)
+	}
+	if dials := atomic.LoadInt32(&forward.dials); dials != 1 {
+		t.Fatalf("got %d dials for 3 requests of one client, want 1", dials)
+	}
+
+	// Upstream connections are not shared between client connections.
+	other := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get(other)
+	if dials := atomic.LoadInt32(&forward.dials); dials != 2 {
+		t.Fatalf("got %d dials after a request of another client, want 2", dials)
+	}
+}
+
+func TestHTTPProxyAuthentication(t *testing.T) {
+	backend := sockstest.NewHTTPServer("hello")
+	defer backend.Close()
+	auth := &UserPassAuthenticator{Username: "user", Password: "secret"}
+	proxy := httptest.NewServer(NewHTTPProxy(Direct, WithAuthenticators(auth)))
+	defer proxy.Close()
+
+	for _, test := range []struct {
+		user *url.Userinfo
+		want int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "wrong"), http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "secret"), http.StatusOK},
+	} {
+		proxyURL, err := url.Parse(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyURL.User = test.user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%v: got %d, want %d", test.user, resp.StatusCode, test.want)
+		}
+		if test.want == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("%v: no Proxy-Authenticate header", test.user)
+		}
+	}
+
+	// CONNECT requires the credentials too.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, err := http.NewRequest("CONNECT", "http://"+strings.TrimPrefix(backend.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("CONNECT without credentials: got %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+}
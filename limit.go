@@ -0,0 +1,149 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rejectTimeout bounds the time spent telling a rejected client that it is rejected.
+const rejectTimeout = 2 * time.Second
+
+// maxRejecting bounds the rejected clients a server tells at a time. Beyond it,
+// rejected connections are closed right away.
+const maxRejecting = 16
+
+// ConnLimiter limits the concurrent sessions and the accept rate of servers.
+// It is safe for concurrent use and can be shared by several servers.
+type ConnLimiter struct {
+	accept *TokenBucket
+
+	lock        sync.Mutex
+	maxSessions int
+	maxPerIP    int
+	sessions    int
+	perIP       map[string]int
+}
+
+// NewConnLimiter returns a ConnLimiter that allows at most maxSessions concurrent sessions,
+// at most maxPerIP concurrent sessions from one client IP and at most acceptRate new
+// sessions per second with bursts of acceptBurst. Zero values mean no limit.
+func NewConnLimiter(maxSessions, maxPerIP int, acceptRate, acceptBurst int64) *ConnLimiter {
+	l := &ConnLimiter{
+		accept: NewTokenBucket(0, 0),
+		perIP:  make(map[string]int),
+	}
+	l.SetLimits(maxSessions, maxPerIP, acceptRate, acceptBurst)
+	return l
+}
+
+// SetLimits changes the limits of l, as passed to NewConnLimiter. The sessions in
+// progress are kept, even those beyond the new limits.
+func (l *ConnLimiter) SetLimits(maxSessions, maxPerIP int, acceptRate, acceptBurst int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maxSessions = maxSessions
+	l.maxPerIP = maxPerIP
+	l.accept.SetRate(acceptRate, acceptBurst)
+}
+
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Acquire reports whether a new session from the client at addr is allowed.
+// If it is, Release must be called with the same addr when the session ends.
+func (l *ConnLimiter) Acquire(addr string) bool {
+	if l == nil {
+		return true
+	}
+	ip := clientIP(addr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxSessions > 0 && l.sessions >= l.maxSessions {
+		return false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	if !l.accept.Allow() {
+		return false
+	}
+	l.sessions++
+	l.perIP[ip]++
+	return true
+}
+
+// Release ends a session allowed by Acquire.
+func (l *ConnLimiter) Release(addr string) {
+	if l == nil {
+		return
+	}
+	ip := clientIP(addr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sessions--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Sessions returns the number of active sessions.
+func (l *ConnLimiter) Sessions() int {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sessions
+}
+
+// acquire acquires a session from every limiter, or from none of them.
+func (o *options) acquire(addr string) bool {
+	co, _ := o.observer.(ConnObserver)
+	for i, l := range o.limiters {
+		if !l.Acquire(addr) {
+			for _, acquired := range o.limiters[:i] {
+				acquired.Release(addr)
+			}
+			if co != nil {
+				co.OnReject(addr)
+			}
+			return false
+		}
+	}
+	if co != nil {
+		co.OnAccept(addr)
+	}
+	return true
+}
+
+// reject closes conn, rejected by the limits, once tell has told its client so. tell runs
+// in its own goroutine within rejectTimeout, unless maxRejecting clients are already
+// being told: then conn is closed right away.
+func (o *options) reject(conn net.Conn, tell func(conn net.Conn, id uint64, opts *options)) {
+	id := nextConnID()
+	select {
+	case o.rejecting <- struct{}{}:
+	default:
+		o.logger.Warn("session rejected", "conn", id, "client", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-o.rejecting }()
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		tell(conn, id, o)
+	}()
+}
+
+func (o *options) release(addr string) {
+	for _, l := range o.limiters {
+		l.Release(addr)
+	}
+}
@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestSocks5ServerConnLimiter(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server, err := NewSocks5Server(Direct, WithConnLimiter(NewConnLimiter(0, 1, 0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = client.Dial("tcp", echo.Addr())
+	if err == nil || !strings.Contains(err.Error(), socks5Errors[ReplyNotAllowed]) {
+		t.Fatalf("second session from the same IP got %v, want %q", err, socks5Errors[ReplyNotAllowed])
+	}
+}
+
+func TestSocks5ServerRejectBounded(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server, err := NewSocks5Server(Direct, WithConnLimiter(NewConnLimiter(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	// The first client takes the only token; the next maxRejecting are told they are
+	// rejected, and wait for their request until rejectTimeout.
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 1+maxRejecting; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	// Further rejected clients are closed right away.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(rejectTimeout / 2))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("read from a rejected client got %v, want the connection closed", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestConnLimiterSetLimits(t *testing.T) {
+	l := NewConnLimiter(1, 0, 0, 0)
+	if !l.Acquire("10.0.0.1:1") || l.Acquire("10.0.0.2:1") {
+		t.Fatal("want one session")
+	}
+	l.SetLimits(2, 0, 0, 0)
+	if !l.Acquire("10.0.0.2:1") || l.Acquire("10.0.0.3:1") {
+		t.Fatal("want two sessions after raising the limit")
+	}
+	// Lowering the limit keeps the sessions in progress.
+	l.SetLimits(1, 0, 0, 0)
+	if l.Sessions() != 2 {
+		t.Fatalf("got %d sessions, want 2", l.Sessions())
+	}
+	l.Release("10.0.0.1:1")
+	if l.Acquire("10.0.0.1:1") {
+		t.Fatal("session allowed beyond the lowered limit")
+	}
+	l.SetLimits(0, 0, 1, 1)
+	if !l.Acquire("10.0.0.1:1") || l.Acquire("10.0.0.3:1") {
+		t.Fatal("want one session by the accept rate")
+	}
+}
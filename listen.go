@@ -0,0 +1,195 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	listenQueueTimeout = 10 * time.Second
+	listenLinger       = 30 * time.Second
+)
+
+// ListenHandler returns a Socks5Handler that serves the LISTEN requests for the addresses
+// allow accepts, and passes the other requests, BIND included, to next.
+//
+// LISTEN is a private command, CmdListen, that works like BIND except that its address
+// is the address to listen on, where RFC 1928 takes the address of BIND as the expected
+// peer. It lets clients expose a port of the server: the LISTEN requests for the same
+// address share its listener, each relaying one of its connections. The listener is
+// kept for 30 seconds after its last request ends, which lets a client reconnect
+// without losing the port, and a connection accepted while no request waits is kept
+// for 10 seconds.
+func ListenHandler(next Socks5Handler, allow func(address string) bool) Socks5Handler {
+	return &listenHandler{
+		next:      next,
+		allow:     allow,
+		listeners: make(map[string]*sharedListener),
+	}
+}
+
+type listenHandler struct {
+	next      Socks5Handler
+	allow     func(address string) bool
+	lock      sync.Mutex
+	listeners map[string]*sharedListener
+}
+
+// sharedListener is a listener shared by the LISTEN requests for its address.
+type sharedListener struct {
+	listener net.Listener
+	conns    chan net.Conn
+	done     chan struct{} // closed once the listener fails
+	requests int
+	linger   *time.Timer
+}
+
+func (h *listenHandler) ServeSocks5(r *Socks5Request) {
+	if r.Command != CmdListen {
+		h.next.ServeSocks5(r)
+		return
+	}
+	address := r.Addr.String()
+	if !h.allow(address) {
+		r.fail(ReplyNotAllowed, errors.New("socks: LISTEN not allowed on "+address))
+		return
+	}
+	l, err := h.acquire(address)
+	if err != nil {
+		r.fail(ReplyGeneralFailure, err)
+		return
+	}
+	defer h.release(address, l)
+
+	if err := r.Reply(ReplySucceeded, netAddr(l.listener.Addr())); err != nil {
+		r.err = err
+		return
+	}
+	conn, err := l.accept(r.Conn)
+	if err != nil {
+		r.err = err
+		return
+	}
+	// The second reply tells the client the address of the peer.
+	if _, err := (&Reply{Reply: ReplySucceeded, Addr: *netAddr(conn.RemoteAddr())}).WriteTo(r.Conn); err != nil {
+		conn.Close()
+		r.err = err
+		return
+	}
+	r.Relay(conn)
+}
+
+// acquire returns the listener of address, listening if there is none.
+func (h *listenHandler) acquire(address string) (*sharedListener, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	l := h.listeners[address]
+	if l != nil {
+		select {
+		case <-l.done:
+			l.listener.Close()
+			l = nil
+		default:
+		}
+	}
+	if l == nil {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		l = &sharedListener{
+			listener: listener,
+			conns:    make(chan net.Conn),
+			done:     make(chan struct{}),
+		}
+		h.listeners[address] = l
+		go l.serve()
+	}
+	if l.linger != nil {
+		l.linger.Stop()
+		l.linger = nil
+	}
+	l.requests++
+	return l, nil
+}
+
+// release closes the listener of address after listenLinger unless a request comes.
+func (h *listenHandler) release(address string, l *sharedListener) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if l.requests--; l.requests > 0 {
+		return
+	}
+	l.linger = time.AfterFunc(listenLinger, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if l.requests == 0 && h.listeners[address] == l {
+			delete(h.listeners, address)
+			l.listener.Close()
+		}
+	})
+}
+
+func (l *sharedListener) serve() {
+	defer close(l.done)
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			timer := time.NewTimer(listenQueueTimeout)
+			defer timer.Stop()
+			select {
+			case l.conns <- conn:
+			case <-timer.C:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// accept waits for a connection of the listener. It gives up if client closes, or sends
+// anything, which it must not do before the second reply.
+func (l *sharedListener) accept(client net.Conn) (net.Conn, error) {
+	closed := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := client.Read(b[:])
+		if err == nil {
+			err = errors.New("socks: data received before the LISTEN reply")
+		}
+		closed <- err
+	}()
+
+	select {
+	case conn := <-l.conns:
+		// Interrupt the read, which must not have failed otherwise.
+		client.SetReadDeadline(time.Unix(1, 0))
+		err := <-closed
+		client.SetReadDeadline(time.Time{})
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case err := <-closed:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("socks: LISTEN listener failed")
+	}
+}
+
+// netAddr returns the address of a TCP connection or listener as an Addr, or 0.0.0.0:0
+// for other addresses.
+func netAddr(addr net.Addr) *Addr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return &Addr{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)}
+	}
+	return &Addr{IP: net.IPv4zero}
+}
@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestListenHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	allow := func(address string) bool { return address == "127.0.0.1:0" }
+	server, err := NewSocks5Server(Direct, WithHandler(ListenHandler(ConnectHandler(Direct), allow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := client.Listen(ctx, "127.0.0.1:1"); err == nil || !strings.Contains(err.Error(), socks5Errors[ReplyNotAllowed]) {
+		t.Fatalf("LISTEN on a forbidden address got %v, want %q", err, socks5Errors[ReplyNotAllowed])
+	}
+	// Standard BIND requests, whose address is the expected peer, go to next.
+	if _, _, err := client.request(ctx, CmdBind, "127.0.0.1:1"); err == nil || !strings.Contains(err.Error(), socks5Errors[ReplyCommandNotSupported]) {
+		t.Fatalf("BIND got %v, want %q", err, socks5Errors[ReplyCommandNotSupported])
+	}
+
+	// Requests for the same address share its listener.
+	first, err := client.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := client.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if first.Addr.Port == 0 || first.Addr.Port != second.Addr.Port {
+		t.Fatalf("LISTEN requests listen on %s and %s, want the same port", first.Addr.String(), second.Addr.String())
+	}
+
+	accepted := make(chan net.Conn, 2)
+	for _, listen := range []*Socks5Listen{first, second} {
+		go func(listen *Socks5Listen) {
+			conn, err := listen.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			accepted <- conn
+			io.Copy(conn, conn)
+			conn.Close()
+		}(listen)
+	}
+	for i := 0; i < 2; i++ {
+		peer, err := net.Dial("tcp", first.Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := <-accepted
+		if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+			t.Errorf("LISTEN connection from %s, want %s", conn.RemoteAddr(), peer.LocalAddr())
+		}
+		sockstest.AssertEcho(t, peer, 1000)
+		peer.Close()
+	}
+}
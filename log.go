@@ -0,0 +1,29 @@
+package socks
+
+import "sync/atomic"
+
+// Logger receives structured log events. keyvals holds alternating keys and values,
+// the same convention as log/slog, so a *slog.Logger can be used as a Logger.
+//
+// Servers and clients log with the keys conn, client, user, dest, upstream, proxy,
+// error, up, down and duration.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+var lastConnID uint64
+
+// nextConnID returns a process wide unique id for an accepted connection.
+func nextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
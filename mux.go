@@ -0,0 +1,803 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A mux frame is an 8 byte header, version, command, payload length (uint16) and
+// stream ID (uint32), followed by the payload.
+const (
+	muxVersion    = 1
+	muxHeaderSize = 8
+	muxMaxPayload = 0xffff
+
+	// muxWindow is the receive window of each stream. A peer sends at most muxWindow
+	// bytes that weren't granted back by UPD frames.
+	muxWindow = 256 << 10
+
+	muxSYN = 0 // opens a stream
+	muxFIN = 1 // closes a stream
+	muxPSH = 2 // carries stream data
+	muxUPD = 3 // grants the uint32 payload bytes of send window
+	muxNOP = 4 // keeps the connection alive
+
+	defaultMuxSessions  = 2
+	defaultMuxKeepAlive = 10 * time.Second
+)
+
+var (
+	errMuxClientClosed  = errors.New("socks: mux client closed")
+	errMuxSessionClosed = errors.New("socks: mux session closed")
+	errMuxStreamClosed  = errors.New("socks: mux stream closed")
+)
+
+// MuxConfig configures stream multiplexing. Zero fields take their defaults.
+type MuxConfig struct {
+	// Sessions is the number of connections MuxClient keeps to each address, 2 by default.
+	Sessions int
+	// KeepAlive is the interval of keepalive frames, 10 seconds by default. A connection
+	// that receives nothing for three intervals is closed.
+	KeepAlive time.Duration
+}
+
+func (c MuxConfig) withDefaults() MuxConfig {
+	if c.Sessions <= 0 {
+		c.Sessions = defaultMuxSessions
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = defaultMuxKeepAlive
+	}
+	return c
+}
+
+// MuxClient implements Dialer by opening streams over a few long-lived connections to
+// each address, so a new stream costs no connection or TLS handshake. Use it as the
+// forward of another client, with a MuxListener in front of that client's server.
+// A lost connection is dropped from the pool and replaced by the next Dial.
+type MuxClient struct {
+	forward Dialer
+	conf    MuxConfig
+	opts    options
+
+	lock   sync.Mutex
+	pools  map[string]*muxPool
+	closed bool
+}
+
+type muxPool struct {
+	sessions []*muxSession
+	dialing  int
+	// ready is closed and replaced whenever a dial finishes.
+	ready chan struct{}
+}
+
+// NewMuxClient returns a MuxClient connecting through forward. The connections use TLS
+// if the options include WithTLSConfig.
+func NewMuxClient(forward Dialer, conf MuxConfig, opts ...Option) *MuxClient {
+	return &MuxClient{
+		forward: forward,
+		conf:    conf.withDefaults(),
+		opts:    newOptions(opts),
+		pools:   make(map[string]*muxPool),
+	}
+}
+
+// Dial opens a stream to address.
+func (c *MuxClient) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer when a
+// new connection is needed.
+func (c *MuxClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		session, err := c.session(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.open()
+		// The session may have died since it was picked; try once more on another.
+		if err == nil || attempt == 1 {
+			return stream, err
+		}
+	}
+}
+
+// session returns the least busy live session to address, dialing a new one while the
+// pool isn't full and every session carries streams.
+func (c *MuxClient) session(ctx context.Context, network, address string) (*muxSession, error) {
+	key := network + " " + address
+	c.lock.Lock()
+	var pool *muxPool
+	for {
+		if c.closed {
+			c.lock.Unlock()
+			return nil, errMuxClientClosed
+		}
+		pool = c.pools[key]
+		if pool == nil {
+			pool = &muxPool{ready: make(chan struct{})}
+			c.pools[key] = pool
+		}
+		var best *muxSession
+		bestStreams := 0
+		for _, s := range pool.sessions {
+			if s.isClosed() {
+				continue
+			}
+			if n := s.numStreams(); best == nil || n < bestStreams {
+				best, bestStreams = s, n
+			}
+		}
+		full := len(pool.sessions)+pool.dialing >= c.conf.Sessions
+		if best != nil && (bestStreams == 0 || full) {
+			c.lock.Unlock()
+			return best, nil
+		}
+		if best != nil || !full {
+			break
+		}
+		// Every session of a full pool is still being dialed.
+		ready := pool.ready
+		c.lock.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.lock.Lock()
+	}
+	pool.dialing++
+	c.lock.Unlock()
+
+	conn, err := c.dial(ctx, network, address)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool.dialing--
+	close(pool.ready)
+	pool.ready = make(chan struct{})
+	if err != nil {
+		c.opts.logger.Debug("mux dial failed", "address", address, "error", err)
+		return nil, err
+	}
+	if c.closed {
+		conn.Close()
+		return nil, errMuxClientClosed
+	}
+	session := newMuxSession(conn, c.conf, c.opts.logger, nil, func(s *muxSession) {
+		c.remove(key, s)
+	})
+	pool.sessions = append(pool.sessions, session)
+	return session, nil
+}
+
+func (c *MuxClient) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := DialContext(ctx, c.forward, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := c.opts.clientTLS(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Close stops c from opening streams. Its connections are closed once they carry no
+// streams, so the streams in use carry on.
+func (c *MuxClient) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	var sessions []*muxSession
+	for _, pool := range c.pools {
+		sessions = append(sessions, pool.sessions...)
+	}
+	c.lock.Unlock()
+	for _, s := range sessions {
+		s.drain()
+	}
+	return nil
+}
+
+func (c *MuxClient) remove(key string, session *muxSession) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool := c.pools[key]
+	if pool == nil {
+		return
+	}
+	for n, s := range pool.sessions {
+		if s == session {
+			pool.sessions = append(pool.sessions[:n], pool.sessions[n+1:]...)
+			break
+		}
+	}
+	if len(pool.sessions) == 0 && pool.dialing == 0 {
+		delete(c.pools, key)
+	}
+}
+
+// MuxListener accepts the streams of MuxClient connections on a net.Listener.
+type MuxListener struct {
+	listener net.Listener
+	conf     MuxConfig
+	opts     options
+	streams  chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	err      error
+
+	lock     sync.Mutex
+	sessions map[*muxSession]struct{}
+}
+
+// NewMuxListener returns a listener that accepts the streams of all connections
+// accepted by listener. With WithTLSConfig, the connections use TLS.
+func NewMuxListener(listener net.Listener, conf MuxConfig, opts ...Option) *MuxListener {
+	l := &MuxListener{
+		listener: listener,
+		conf:     conf.withDefaults(),
+		opts:     newOptions(opts),
+		streams:  make(chan net.Conn),
+		done:     make(chan struct{}),
+		sessions: make(map[*muxSession]struct{}),
+	}
+	go l.serve(l.opts.tlsListener(listener))
+	return l
+}
+
+func (l *MuxListener) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			l.close(err, false)
+			return
+		}
+		l.lock.Lock()
+		if l.sessions == nil {
+			// The listener was closed.
+			l.lock.Unlock()
+			conn.Close()
+			return
+		}
+		session := newMuxSession(conn, l.conf, l.opts.logger, l.deliver, func(s *muxSession) {
+			l.lock.Lock()
+			delete(l.sessions, s)
+			l.lock.Unlock()
+		})
+		l.sessions[session] = struct{}{}
+		l.lock.Unlock()
+	}
+}
+
+func (l *MuxListener) deliver(stream *muxStream) bool {
+	select {
+	case l.streams <- stream:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// Accept waits for the next stream.
+func (l *MuxListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener and all its connections.
+func (l *MuxListener) Close() error {
+	return l.close(errors.New("socks: mux listener closed"), false)
+}
+
+// Shutdown closes the underlying listener like Close, but lets its connections carry
+// the streams in progress: each is closed once it carries none. New streams are refused.
+func (l *MuxListener) Shutdown() error {
+	return l.close(errors.New("socks: mux listener closed"), true)
+}
+
+// close closes the underlying listener once, making Accept return reason. Its
+// connections are closed, or drained if drain is set.
+func (l *MuxListener) close(reason error, drain bool) error {
+	var err error
+	l.once.Do(func() {
+		l.err = reason
+		close(l.done)
+		err = l.listener.Close()
+		l.lock.Lock()
+		sessions := l.sessions
+		l.sessions = nil
+		l.lock.Unlock()
+		for s := range sessions {
+			if drain {
+				s.drain()
+			} else {
+				s.close(errMuxSessionClosed)
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the underlying listener.
+func (l *MuxListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// muxSession carries the streams of one connection. Only the client side opens streams;
+// the server side hands them to accept.
+type muxSession struct {
+	conn    net.Conn
+	conf    MuxConfig
+	logger  Logger
+	accept  func(*muxStream) bool
+	onClose func(*muxSession)
+
+	writeLock sync.Mutex
+	lastRecv  int64
+
+	lock     sync.Mutex
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	draining bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newMuxSession(conn net.Conn, conf MuxConfig, logger Logger, accept func(*muxStream) bool, onClose func(*muxSession)) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		conf:     conf,
+		logger:   logger,
+		accept:   accept,
+		onClose:  onClose,
+		lastRecv: time.Now().UnixNano(),
+		streams:  make(map[uint32]*muxStream),
+		nextID:   1,
+		done:     make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) numStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) open() (*muxStream, error) {
+	s.lock.Lock()
+	if s.isClosed() || s.draining {
+		s.lock.Unlock()
+		return nil, errMuxSessionClosed
+	}
+	stream := newMuxStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.lock.Unlock()
+
+	if err := s.writeFrame(muxSYN, stream.id, nil); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	idle := s.draining && len(s.streams) == 0
+	s.lock.Unlock()
+	if idle {
+		s.close(errMuxSessionClosed)
+	}
+}
+
+// drain stops the session from opening streams, and closes it once it carries none.
+func (s *muxSession) drain() {
+	s.lock.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.lock.Unlock()
+	if idle {
+		s.close(errMuxSessionClosed)
+	}
+}
+
+// writeFrame writes one frame, closing the session if that fails. Writes time out after
+// three keepalive intervals, so a stuck connection doesn't block its streams forever.
+func (s *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	frame = append(frame, payload...)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return s.err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(3 * s.conf.KeepAlive))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) recvLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.close(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if header[0] != muxVersion {
+			s.close(errors.New("socks: unknown mux version " + strconv.Itoa(int(header[0]))))
+			return
+		}
+		cmd := header[1]
+		payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		id := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.close(err)
+			return
+		}
+
+		var err error
+		switch cmd {
+		case muxSYN:
+			err = s.handleSYN(id)
+		case muxFIN:
+			if stream := s.stream(id); stream != nil {
+				stream.finish()
+			}
+		case muxPSH:
+			if stream := s.stream(id); stream != nil && !stream.push(payload) {
+				err = errors.New("socks: mux peer overran the window of stream " + strconv.FormatUint(uint64(id), 10))
+			}
+		case muxUPD:
+			if len(payload) != 4 {
+				err = errors.New("socks: invalid mux window update")
+			} else if stream := s.stream(id); stream != nil {
+				stream.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		case muxNOP:
+		default:
+			err = errors.New("socks: unknown mux command " + strconv.Itoa(int(cmd)))
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleSYN(id uint32) error {
+	if s.accept == nil {
+		return errors.New("socks: mux server opened a stream")
+	}
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.lock.Unlock()
+		return errors.New("socks: mux stream " + strconv.FormatUint(uint64(id), 10) + " opened twice")
+	}
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	s.lock.Unlock()
+	if !s.accept(stream) {
+		stream.Close()
+	}
+	return nil
+}
+
+func (s *muxSession) keepAlive() {
+	ticker := time.NewTicker(s.conf.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > 3*s.conf.KeepAlive {
+				s.close(errors.New("socks: mux keepalive timeout"))
+				return
+			}
+			s.writeFrame(muxNOP, 0, nil)
+		}
+	}
+}
+
+func (s *muxSession) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+		s.logger.Debug("mux session closed", "remote", s.conn.RemoteAddr().String(), "error", err)
+		if s.onClose != nil {
+			s.onClose(s)
+		}
+	})
+}
+
+// muxStream is a net.Conn carried by a muxSession.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	lock       sync.Mutex
+	buf        bytes.Buffer
+	consumed   int
+	finRecv    bool
+	sendWindow int
+
+	readable  chan struct{}
+	writable  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  muxDeadline
+	writeDeadline muxDeadline
+}
+
+// ConnectionState returns the state of the TLS connection carrying the session of the
+// stream, the zero state if it isn't carried by TLS.
+func (s *muxStream) ConnectionState() tls.ConnectionState {
+	return connectionState(s.session.conn)
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:       session,
+		id:            id,
+		sendWindow:    muxWindow,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		readDeadline:  makeMuxDeadline(),
+		writeDeadline: makeMuxDeadline(),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers data received for the stream. It reports false if the peer exceeded the
+// window.
+func (s *muxStream) push(data []byte) bool {
+	s.lock.Lock()
+	if s.buf.Len()+len(data) > muxWindow {
+		s.lock.Unlock()
+		return false
+	}
+	s.buf.Write(data)
+	s.lock.Unlock()
+	notify(s.readable)
+	return true
+}
+
+func (s *muxStream) finish() {
+	s.lock.Lock()
+	s.finRecv = true
+	s.lock.Unlock()
+	notify(s.readable)
+}
+
+func (s *muxStream) grant(n int) {
+	s.lock.Lock()
+	s.sendWindow += n
+	s.lock.Unlock()
+	notify(s.writable)
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		s.lock.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(p)
+			s.consumed += n
+			granted := 0
+			if s.consumed >= muxWindow/2 {
+				granted, s.consumed = s.consumed, 0
+			}
+			s.lock.Unlock()
+			if granted > 0 {
+				update := make([]byte, 4)
+				binary.BigEndian.PutUint32(update, uint32(granted))
+				s.session.writeFrame(muxUPD, s.id, update)
+			}
+			return n, nil
+		}
+		finRecv := s.finRecv
+		s.lock.Unlock()
+		if finRecv {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-s.readable:
+		case <-s.closed:
+			return 0, errMuxStreamClosed
+		case <-s.session.done:
+			return 0, s.session.err
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		select {
+		case <-s.closed:
+			return written, errMuxStreamClosed
+		case <-s.session.done:
+			return written, s.session.err
+		case <-s.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+
+		s.lock.Lock()
+		size := len(p) - written
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		if size > muxMaxPayload {
+			size = muxMaxPayload
+		}
+		s.sendWindow -= size
+		s.lock.Unlock()
+
+		if size == 0 {
+			select {
+			case <-s.writable:
+			case <-s.closed:
+			case <-s.session.done:
+			case <-s.writeDeadline.wait():
+			}
+			continue
+		}
+		if err := s.session.writeFrame(muxPSH, s.id, p[written:written+size]); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Close closes the stream, telling the peer that no more data follows.
+func (s *muxStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.session.remove(s.id)
+		s.session.writeFrame(muxFIN, s.id, nil)
+	})
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// muxDeadline is a deadline whose wait channel is closed when it passes.
+type muxDeadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeMuxDeadline() muxDeadline {
+	return muxDeadline{cancel: make(chan struct{})}
+}
+
+func (d *muxDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired, wait for it to close cancel
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.cancel:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+func (d *muxDeadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
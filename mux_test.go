@@ -0,0 +1,143 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestMuxTunnel(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewMuxListener(raw, MuxConfig{})
+	defer listener.Close()
+	server, err := NewSocks5Server(Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	mux := NewMuxClient(Direct, MuxConfig{Sessions: 2})
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := client.Dial("tcp", echo.Addr())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			// More than the window, so the streams depend on window updates.
+			errs <- sockstest.CheckEcho(conn, 3*muxWindow)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux.lock.Lock()
+	pool := mux.pools["tcp "+listener.Addr().String()]
+	sessions := append([]*muxSession(nil), pool.sessions...)
+	mux.lock.Unlock()
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+
+	// Lost sessions are replaced by the next Dial.
+	for _, s := range sessions {
+		s.close(errors.New("lost"))
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+
+	// Closing the client keeps the streams in use, and closes their sessions after them.
+	mux.Close()
+	if _, err := client.Dial("tcp", echo.Addr()); err == nil {
+		t.Fatal("dial through a closed mux client succeeded")
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+	mux.lock.Lock()
+	sessions = append([]*muxSession(nil), mux.pools["tcp "+listener.Addr().String()].sessions...)
+	mux.lock.Unlock()
+	conn.Close()
+	waitFor(t, "closed sessions", func() bool {
+		for _, s := range sessions {
+			if !s.isClosed() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMuxListenerShutdown(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewMuxListener(raw, MuxConfig{})
+	defer listener.Close()
+	server, err := NewSocks5Server(Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	mux := NewMuxClient(Direct, MuxConfig{Sessions: 1})
+	defer mux.Close()
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	listener.lock.Lock()
+	var sessions []*muxSession
+	for s := range listener.sessions {
+		sessions = append(sessions, s)
+	}
+	listener.lock.Unlock()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+
+	// The streams in progress carry on, new ones are refused.
+	listener.Shutdown()
+	sockstest.AssertEcho(t, conn, 1000)
+	if _, err := client.Dial("tcp", echo.Addr()); err == nil {
+		t.Fatal("dial through a shut down mux listener succeeded")
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+
+	conn.Close()
+	waitFor(t, "closed session", sessions[0].isClosed)
+}
@@ -0,0 +1,139 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// SessionInfo describes one proxied session.
+type SessionInfo struct {
+	// ID identifies the accepted connection or HTTP request in logs.
+	ID uint64
+	// Protocol is the inbound protocol: socks4, socks5, http-connect or http.
+	Protocol string
+	// Listener names the listener that accepted the client, set by WithListenerName.
+	Listener string
+	// ClientAddr is the remote address of the client.
+	ClientAddr string
+	// User is the authenticated user, the identity of the TLS client certificate or
+	// the SOCKS4 user id, empty if none.
+	User string
+	// Destination is the address the client asked for, as host:port.
+	Destination string
+	// Domain is the host of Destination if the client asked for a domain name rather
+	// than an IP address. Dialers that resolve or rewrite the destination keep it.
+	Domain string
+	// Upstream names the upstream that carried the session, if the forward Dialer reports one.
+	Upstream string
+	// Start is the time the request was received.
+	Start time.Time
+
+	// reportedUp and reportedDown count the bytes already reported by OnTraffic.
+	reportedUp   int64
+	reportedDown int64
+}
+
+// Observer receives session events from servers. Its methods are called
+// concurrently from the goroutines serving clients.
+type Observer interface {
+	// OnSessionStart is called once the destination of a request is known, before dialing.
+	OnSessionStart(info *SessionInfo)
+	// OnSessionEnd is called when a session started by OnSessionStart is finished.
+	// bytesUp counts bytes from the client to the destination, bytesDown the reverse.
+	// err is the dial error or the first relay error, nil if the session ended normally.
+	OnSessionEnd(info *SessionInfo, bytesUp, bytesDown int64, duration time.Duration, err error)
+	// OnDialFailed is called when forward failed to connect to the destination.
+	OnDialFailed(info *SessionInfo, err error)
+}
+
+// A ConnObserver is an Observer that is also told whether servers accepted or
+// rejected new clients. Servers check their Observer for this interface.
+type ConnObserver interface {
+	Observer
+	// OnAccept is called when a new client passed the server's limits.
+	OnAccept(clientAddr string)
+	// OnReject is called when a new client was rejected by the server's limits.
+	OnReject(clientAddr string)
+}
+
+// A TrafficObserver is an Observer that is also told about the bytes of sessions while
+// they are relayed, so that long sessions are accounted before they end. OnTraffic
+// reports the bytes copied since its last call; by the time OnSessionEnd is called, it
+// has reported all bytes of the session. Servers check their Observer for this interface.
+type TrafficObserver interface {
+	Observer
+	OnTraffic(info *SessionInfo, bytesUp, bytesDown int64)
+}
+
+// An UpstreamConn is a connection that knows the name of the upstream carrying it.
+// Forward Dialers can return it so that SessionInfo.Upstream is filled in.
+type UpstreamConn interface {
+	net.Conn
+	Upstream() string
+}
+
+// UpstreamError is returned by forward Dialers that know which upstream failed.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return "upstream " + e.Upstream + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func (o *options) newSessionInfo(id uint64, protocol, clientAddr, destination string) *SessionInfo {
+	info := &SessionInfo{
+		ID:          id,
+		Protocol:    protocol,
+		Listener:    o.listener,
+		ClientAddr:  clientAddr,
+		Destination: destination,
+		Start:       time.Now(),
+	}
+	if host, _, err := net.SplitHostPort(destination); err == nil && net.ParseIP(host) == nil {
+		info.Domain = host
+	}
+	return info
+}
+
+func (info *SessionInfo) setUpstream(v interface{}) {
+	switch u := v.(type) {
+	case UpstreamConn:
+		info.Upstream = u.Upstream()
+	case error:
+		var ue *UpstreamError
+		if errors.As(u, &ue) {
+			info.Upstream = ue.Upstream
+		}
+	}
+}
+
+// logFields returns the log fields describing info followed by keyvals.
+func (info *SessionInfo) logFields(keyvals ...interface{}) []interface{} {
+	fields := []interface{}{
+		"conn", info.ID,
+		"protocol", info.Protocol,
+		"client", info.ClientAddr,
+		"dest", info.Destination,
+	}
+	if info.User != "" {
+		fields = append(fields, "user", info.User)
+	}
+	if info.Upstream != "" {
+		fields = append(fields, "upstream", info.Upstream)
+	}
+	return append(fields, keyvals...)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OnSessionStart(*SessionInfo)                                   {}
+func (nopObserver) OnSessionEnd(*SessionInfo, int64, int64, time.Duration, error) {}
+func (nopObserver) OnDialFailed(*SessionInfo, error)                              {}
@@ -0,0 +1,138 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+type sessionRecord struct {
+	info     SessionInfo
+	up, down int64
+	err      error
+}
+
+type recordObserver struct {
+	ended chan sessionRecord
+}
+
+func newRecordObserver() *recordObserver {
+	return &recordObserver{ended: make(chan sessionRecord, 1)}
+}
+
+func (r *recordObserver) OnSessionStart(info *SessionInfo) {}
+
+func (r *recordObserver) OnSessionEnd(info *SessionInfo, up, down int64, duration time.Duration, err error) {
+	r.ended <- sessionRecord{info: *info, up: up, down: down, err: err}
+}
+
+func (r *recordObserver) OnDialFailed(info *SessionInfo, err error) {}
+
+func TestSocks5ServerObserver(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	observer := newRecordObserver()
+	server, err := NewSocks5Server(Direct, WithObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 100)
+	conn.Close()
+
+	select {
+	case r := <-observer.ended:
+		if r.info.Protocol != "socks5" || r.info.Destination != echo.Addr() {
+			t.Fatalf("unexpected session info: %+v", r.info)
+		}
+		if r.up != 100 || r.down != 100 {
+			t.Fatalf("got %d bytes up and %d bytes down, want 100", r.up, r.down)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSessionEnd not called")
+	}
+}
+
+type trafficObserver struct {
+	*recordObserver
+	traffic chan [2]int64
+}
+
+func (o *trafficObserver) OnTraffic(info *SessionInfo, up, down int64) {
+	o.traffic <- [2]int64{up, down}
+}
+
+func TestSocks5ServerTrafficObserver(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	observer := &trafficObserver{recordObserver: newRecordObserver(), traffic: make(chan [2]int64, 16)}
+	server, err := NewSocks5Server(Direct, WithObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sockstest.AssertEcho(t, conn, 100)
+
+	// The bytes are reported while the session is still open.
+	var up, down int64
+	for up < 100 || down < 100 {
+		select {
+		case n := <-observer.traffic:
+			up, down = up+n[0], down+n[1]
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d bytes up and %d bytes down before the end, want 100", up, down)
+		}
+	}
+	select {
+	case r := <-observer.ended:
+		t.Fatalf("session ended early: %+v", r)
+	default:
+	}
+	conn.Close()
+	select {
+	case r := <-observer.ended:
+		if r.up != 100 || r.down != 100 {
+			t.Fatalf("got %d bytes up and %d bytes down, want 100", r.up, r.down)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSessionEnd not called")
+	}
+	select {
+	case n := <-observer.traffic:
+		t.Fatalf("got %v more bytes reported at the end, want none", n)
+	default:
+	}
+}
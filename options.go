@@ -0,0 +1,90 @@
+package socks
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// An Option configures a server (Socks4Server, Socks5Server, HTTPProxy or
+// ForwardServer), a client (Socks4Client, Socks5Client, ShadowSocksClient,
+// WebSocketClient or MuxClient), a listener (WebSocketListener or MuxListener) or a
+// WarmPool. Options that don't apply to the configured type are ignored.
+type Option func(*options)
+
+type options struct {
+	logger            Logger
+	observer          Observer
+	sessionDecorators []SessionDecorator
+	limiters          []*ConnLimiter
+	handler           Socks5Handler
+	listener          string
+	resolvePolicy     ResolvePolicy
+	resolver          Resolver
+	authenticators    []Authenticator
+	tlsConfig         *tls.Config
+	pins              [][]byte
+	pool              *PoolConfig
+	rejecting         chan struct{}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger:    nopLogger{},
+		observer:  nopObserver{},
+		resolver:  net.DefaultResolver,
+		rejecting: make(chan struct{}, maxRejecting),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the Logger of a server or client.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithObserver sets the Observer that receives session events.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		if observer != nil {
+			o.observer = observer
+		}
+	}
+}
+
+// WithConnLimiter adds a ConnLimiter that every new session must pass. Rejected SOCKS clients
+// get a "not allowed" reply to their request, rejected HTTP clients get 503 Service Unavailable.
+func WithConnLimiter(limiter *ConnLimiter) Option {
+	return func(o *options) {
+		if limiter != nil {
+			o.limiters = append(o.limiters, limiter)
+		}
+	}
+}
+
+// A SessionDecorator wraps the client connection of a session once its request
+// has been accepted, before data is relayed. info carries the authenticated user.
+type SessionDecorator func(conn net.Conn, info *SessionInfo) (net.Conn, error)
+
+// WithSessionDecorator adds a SessionDecorator applied to SOCKS sessions and HTTP tunnels.
+func WithSessionDecorator(decorator SessionDecorator) Option {
+	return func(o *options) {
+		o.sessionDecorators = append(o.sessionDecorators, decorator)
+	}
+}
+
+func (o *options) decorateSession(conn net.Conn, info *SessionInfo) (net.Conn, error) {
+	for _, decorate := range o.sessionDecorators {
+		var err error
+		if conn, err = decorate(conn, info); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
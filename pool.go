@@ -0,0 +1,290 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolSize    = 2
+	defaultPoolMaxIdle = 30 * time.Second
+
+	// poolRetryDelay delays refilling after a pooled connection broke, so a server
+	// that closes idle connections right away isn't dialed in a loop.
+	poolRetryDelay = time.Second
+)
+
+// PoolConfig configures a WarmPool. Zero fields take their defaults.
+type PoolConfig struct {
+	// Size is the number of idle connections kept to each address, 2 by default.
+	Size int
+	// MaxIdle is how long a connection stays idle before it is replaced by a fresh
+	// one, 30 seconds by default. Keep it below the idle timeout of the server.
+	MaxIdle time.Duration
+}
+
+func (c PoolConfig) withDefaults() PoolConfig {
+	if c.Size <= 0 {
+		c.Size = defaultPoolSize
+	}
+	if c.MaxIdle <= 0 {
+		c.MaxIdle = defaultPoolMaxIdle
+	}
+	return c
+}
+
+// WithWarmPool makes ShadowSocksClient keep connections to its server dialed ahead of
+// time, so Dial only has to write the target address. Close the client to close the pool.
+func WithWarmPool(conf PoolConfig) Option {
+	return func(o *options) {
+		o.pool = &conf
+	}
+}
+
+// A Preparer is a connection with setup it can do before its first write, like a
+// stream cipher sending its IV. WarmPool prepares the connections it keeps idle.
+type Preparer interface {
+	Prepare() error
+}
+
+// WarmPool is a Dialer that keeps idle connections dialed through forward to each
+// address it dialed before, and hands them out instead of dialing. It suits hops that
+// always dial the same few addresses, like the forward of a proxy client. Connections
+// that implement Preparer are prepared once dialed. An idle connection that receives
+// data or gets closed by the server is evicted.
+type WarmPool struct {
+	forward Dialer
+	conf    PoolConfig
+	opts    options
+
+	lock   sync.Mutex
+	addrs  map[string]*warmAddr
+	closed bool
+}
+
+type warmAddr struct {
+	network string
+	address string
+	idle    []*warmConn
+	filling bool
+}
+
+type warmConn struct {
+	net.Conn
+	addr   *warmAddr
+	expire *time.Timer
+	// done is closed when watch returns, after setting healthy.
+	done    chan struct{}
+	healthy bool
+}
+
+// NewWarmPool returns a WarmPool dialing through forward.
+func NewWarmPool(forward Dialer, conf PoolConfig, opts ...Option) *WarmPool {
+	return &WarmPool{
+		forward: forward,
+		conf:    conf.withDefaults(),
+		opts:    newOptions(opts),
+		addrs:   make(map[string]*warmAddr),
+	}
+}
+
+// Warm starts filling the pool of address before the first Dial.
+func (p *WarmPool) Warm(network, address string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fill(p.addr(network, address))
+}
+
+// Dial returns an idle connection to address, or dials one if there is none.
+func (p *WarmPool) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer when no
+// idle connection is left.
+func (p *WarmPool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return DialContext(ctx, p.forward, network, address)
+	}
+	a := p.addr(network, address)
+	p.fill(a)
+	p.lock.Unlock()
+	if conn := p.take(a); conn != nil {
+		return conn, nil
+	}
+	return DialContext(ctx, p.forward, network, address)
+}
+
+// Idle returns the number of idle connections to all addresses.
+func (p *WarmPool) Idle() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := 0
+	for _, a := range p.addrs {
+		n += len(a.idle)
+	}
+	return n
+}
+
+// Close closes the idle connections and stops refilling. Dial keeps working without
+// the pool.
+func (p *WarmPool) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	var idle []*warmConn
+	for _, a := range p.addrs {
+		idle = append(idle, a.idle...)
+		a.idle = nil
+	}
+	p.lock.Unlock()
+	for _, c := range idle {
+		c.expire.Stop()
+		c.Conn.Close()
+	}
+	return nil
+}
+
+func (p *WarmPool) addr(network, address string) *warmAddr {
+	key := network + " " + address
+	a := p.addrs[key]
+	if a == nil {
+		a = &warmAddr{network: network, address: address}
+		p.addrs[key] = a
+	}
+	return a
+}
+
+// fill starts refilling a unless it is full or already being refilled. p.lock must be
+// held.
+func (p *WarmPool) fill(a *warmAddr) {
+	if p.closed || a.filling || len(a.idle) >= p.conf.Size {
+		return
+	}
+	a.filling = true
+	go p.refill(a)
+}
+
+func (p *WarmPool) refill(a *warmAddr) {
+	for {
+		p.lock.Lock()
+		if p.closed || len(a.idle) >= p.conf.Size {
+			a.filling = false
+			p.lock.Unlock()
+			return
+		}
+		p.lock.Unlock()
+
+		conn, err := p.dial(a)
+		if err != nil {
+			p.opts.logger.Debug("warm pool dial failed", "address", a.address, "error", err)
+			p.lock.Lock()
+			a.filling = false
+			p.lock.Unlock()
+			return
+		}
+		c := &warmConn{Conn: conn, addr: a, done: make(chan struct{})}
+		p.lock.Lock()
+		if p.closed {
+			a.filling = false
+			p.lock.Unlock()
+			conn.Close()
+			return
+		}
+		c.expire = time.AfterFunc(p.conf.MaxIdle, func() {
+			p.evict(c, false)
+		})
+		a.idle = append(a.idle, c)
+		p.lock.Unlock()
+		go p.watch(c)
+	}
+}
+
+// dial dials a new idle connection to a and prepares it.
+func (p *WarmPool) dial(a *warmAddr) (net.Conn, error) {
+	conn, err := p.forward.Dial(a.network, a.address)
+	if err != nil {
+		return nil, err
+	}
+	if preparer, ok := conn.(Preparer); ok {
+		if err := preparer.Prepare(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// watch reads from an idle connection, which must get nothing until take interrupts
+// the read with a deadline.
+func (p *WarmPool) watch(c *warmConn) {
+	var b [1]byte
+	_, err := c.Conn.Read(b[:])
+	netErr, ok := err.(net.Error)
+	c.healthy = ok && netErr.Timeout()
+	close(c.done)
+	if !c.healthy {
+		p.evict(c, true)
+	}
+}
+
+// evict closes c if it is still idle and refills its address, later if c broke.
+func (p *WarmPool) evict(c *warmConn, broken bool) {
+	p.lock.Lock()
+	a := c.addr
+	found := false
+	for n, idle := range a.idle {
+		if idle == c {
+			a.idle = append(a.idle[:n], a.idle[n+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.lock.Unlock()
+		return
+	}
+	c.expire.Stop()
+	if broken {
+		p.opts.logger.Debug("warm pool evicted broken connection", "address", a.address)
+		time.AfterFunc(poolRetryDelay, func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			p.fill(a)
+		})
+	} else {
+		p.fill(a)
+	}
+	p.lock.Unlock()
+	c.Conn.Close()
+}
+
+// take returns the most recently dialed healthy idle connection of a, or nil.
+func (p *WarmPool) take(a *warmAddr) net.Conn {
+	for {
+		p.lock.Lock()
+		if len(a.idle) == 0 {
+			p.lock.Unlock()
+			return nil
+		}
+		c := a.idle[len(a.idle)-1]
+		a.idle = a.idle[:len(a.idle)-1]
+		c.expire.Stop()
+		p.fill(a)
+		p.lock.Unlock()
+
+		// Stop watch; a connection that can't take deadlines can't be pooled.
+		if err := c.Conn.SetReadDeadline(time.Unix(1, 0)); err != nil {
+			c.Conn.Close()
+			continue
+		}
+		<-c.done
+		if c.healthy && c.Conn.SetReadDeadline(time.Time{}) == nil {
+			return c.Conn
+		}
+		c.Conn.Close()
+	}
+}
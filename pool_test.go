@@ -0,0 +1,157 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+// waitFor fails t unless cond becomes true within 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShadowSocksClientWarmPool(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	upstream := sockstest.NewShadowSocksUpstream()
+	defer upstream.Close()
+
+	client, err := NewShadowSocksClient("tcp", upstream.Addr(), Direct, WithWarmPool(PoolConfig{Size: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := client.forward.(*WarmPool)
+	waitFor(t, "a warm pool", func() bool { return pool.Idle() == 2 })
+
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+	conn.Close()
+	waitFor(t, "a refilled pool", func() bool { return pool.Idle() == 2 })
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if idle := pool.Idle(); idle != 0 {
+		t.Fatalf("closed client keeps %d idle connections, want 0", idle)
+	}
+	// The client keeps working without the pool, which is not refilled.
+	conn, err = client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 10)
+	conn.Close()
+	if idle := pool.Idle(); idle != 0 {
+		t.Fatalf("closed pool refilled %d connections, want 0", idle)
+	}
+}
+
+func TestWarmPoolEviction(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var lock sync.Mutex
+	var accepted []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			accepted = append(accepted, conn)
+			lock.Unlock()
+		}
+	}()
+	numAccepted := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(accepted)
+	}
+
+	pool := NewWarmPool(Direct, PoolConfig{Size: 2, MaxIdle: time.Hour})
+	defer pool.Close()
+	pool.Warm("tcp", listener.Addr().String())
+	waitFor(t, "a warm pool", func() bool { return pool.Idle() == 2 })
+
+	// Connections closed by the server are evicted, and replaced after a delay.
+	lock.Lock()
+	for _, conn := range accepted {
+		conn.Close()
+	}
+	lock.Unlock()
+	waitFor(t, "eviction", func() bool { return pool.Idle() == 0 })
+	waitFor(t, "a refilled pool", func() bool { return pool.Idle() == 2 && numAccepted() == 4 })
+
+	// Connections idle for longer than MaxIdle are replaced.
+	pool.Close()
+	pool = NewWarmPool(Direct, PoolConfig{Size: 1, MaxIdle: 50 * time.Millisecond})
+	defer pool.Close()
+	pool.Warm("tcp", listener.Addr().String())
+	waitFor(t, "replaced idle connections", func() bool { return numAccepted() >= 7 })
+}
+
+// preparingDialer dials directly, returning connections that write "iv" when prepared.
+type preparingDialer struct{}
+
+func (preparingDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := Direct.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedConn{Conn: conn}, nil
+}
+
+type preparedConn struct {
+	net.Conn
+}
+
+func (c *preparedConn) Prepare() error {
+	_, err := c.Write([]byte("iv"))
+	return err
+}
+
+func TestWarmPoolPrepares(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 2)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _ := io.ReadFull(conn, b)
+		received <- string(b[:n])
+	}()
+
+	pool := NewWarmPool(preparingDialer{}, PoolConfig{Size: 1, MaxIdle: time.Hour})
+	defer pool.Close()
+	pool.Warm("tcp", listener.Addr().String())
+	// The connection is prepared before any Dial.
+	if got := <-received; got != "iv" {
+		t.Fatalf("server got %q before the first Dial, want iv", got)
+	}
+}
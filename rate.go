@@ -0,0 +1,147 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket rate limiter. It is safe for concurrent use,
+// so one bucket can be shared by many connections.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket that is refilled with rate tokens per second
+// and holds at most burst tokens. If burst is not positive, it defaults to rate. If rate
+// is not positive, the bucket is unlimited: it never runs out of tokens.
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetRate(rate, burst)
+	return b
+}
+
+// SetRate changes the rate and burst of b, as passed to NewTokenBucket. The tokens b
+// holds are kept, up to the new burst; an unlimited bucket starts full.
+func (b *TokenBucket) SetRate(rate, burst int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if rate <= 0 {
+		b.rate, b.burst, b.tokens = 0, 0, 0
+		return
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	now := time.Now()
+	if b.rate > 0 {
+		b.refill(now)
+	} else {
+		b.tokens = float64(burst)
+	}
+	b.rate, b.burst, b.last = float64(rate), float64(burst), now
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes one token if one is available and reports whether it did.
+func (b *TokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait takes n tokens, blocking until the bucket has refilled enough to pay for them.
+func (b *TokenBucket) Wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// chunk returns the largest write that fits in the bucket's burst.
+func (b *TokenBucket) chunk(n int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if burst := int(b.burst); burst > 0 && n > burst {
+		return burst
+	}
+	return n
+}
+
+// RateLimitedConn limits the read and write rate of a net.Conn.
+type RateLimitedConn struct {
+	net.Conn
+	read  *TokenBucket
+	write *TokenBucket
+}
+
+// NewRateLimitedConn returns a RateLimitedConn that takes a token from read for every
+// byte read and from write for every byte written. A nil bucket means no limit.
+func NewRateLimitedConn(conn net.Conn, read, write *TokenBucket) *RateLimitedConn {
+	return &RateLimitedConn{
+		Conn:  conn,
+		read:  read,
+		write: write,
+	}
+}
+
+func (c *RateLimitedConn) Read(p []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(p)
+	}
+	n, err := c.Conn.Read(p[:c.read.chunk(len(p))])
+	if n > 0 {
+		c.read.Wait(n)
+	}
+	return n, err
+}
+
+func (c *RateLimitedConn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		n := c.write.chunk(len(p) - written)
+		c.write.Wait(n)
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
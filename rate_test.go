@@ -0,0 +1,48 @@
+package socks
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedConnWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	conn := NewRateLimitedConn(client, nil, NewTokenBucket(1000, 100))
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	// the first 100 bytes are paid by the burst, the remaining 500 take half a second.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("600 bytes written in %v, want at least 400ms", elapsed)
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		b := NewTokenBucket(rate, 0)
+		for i := 0; i < 1000; i++ {
+			if !b.Allow() {
+				t.Fatalf("rate %d: Allow failed after %d tokens", rate, i)
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			b.Wait(1 << 20)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("rate %d: Wait blocked", rate)
+		}
+	}
+}
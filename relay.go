@@ -0,0 +1,103 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relay copies data between client and dest until either direction is finished,
+// then closes both. It returns the bytes copied from client to dest and from dest
+// to client, and the error of the direction that finished first. A TrafficObserver is
+// told about the bytes of info as they are copied.
+func (o *options) relay(info *SessionInfo, client, dest net.Conn) (up, down int64, err error) {
+	var upWriter, downWriter io.Writer = dest, client
+	if _, ok := o.observer.(TrafficObserver); ok {
+		upWriter = &trafficWriter{Writer: dest, report: func(n int64) { o.traffic(info, n, 0) }}
+		downWriter = &trafficWriter{Writer: client, report: func(n int64) { o.traffic(info, 0, n) }}
+	}
+	var once sync.Once
+	finish := func(copyErr error) {
+		once.Do(func() {
+			err = copyErr
+		})
+		client.Close()
+		dest.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var copyErr error
+		down, copyErr = io.Copy(downWriter, dest)
+		finish(copyErr)
+	}()
+	var copyErr error
+	up, copyErr = io.Copy(upWriter, client)
+	finish(copyErr)
+	<-done
+	return up, down, err
+}
+
+// dialForward dials address through forward on behalf of the session, reporting
+// the session start and a failed dial to the observer.
+func (o *options) dialForward(forward Dialer, info *SessionInfo, network, address string) (net.Conn, error) {
+	o.observer.OnSessionStart(info)
+	return o.dial(forward, info, network, address)
+}
+
+// dial dials address through forward on behalf of a started session, reporting a
+// failed dial to the observer.
+func (o *options) dial(forward Dialer, info *SessionInfo, network, address string) (net.Conn, error) {
+	ctx := ContextWithSessionInfo(context.Background(), info)
+	dest, err := DialContext(ctx, forward, network, address)
+	if err != nil {
+		info.setUpstream(err)
+		o.observer.OnDialFailed(info, err)
+		o.logger.Warn("dial failed", info.logFields("error", err)...)
+		return nil, err
+	}
+	info.setUpstream(dest)
+	return dest, nil
+}
+
+// trafficWriter reports the bytes written through it.
+type trafficWriter struct {
+	io.Writer
+	report func(n int64)
+}
+
+func (w *trafficWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.report(int64(n))
+	}
+	return n, err
+}
+
+// traffic reports bytes of info copied since the last report to a TrafficObserver.
+func (o *options) traffic(info *SessionInfo, up, down int64) {
+	observer, ok := o.observer.(TrafficObserver)
+	if !ok || (up == 0 && down == 0) {
+		return
+	}
+	atomic.AddInt64(&info.reportedUp, up)
+	atomic.AddInt64(&info.reportedDown, down)
+	observer.OnTraffic(info, up, down)
+}
+
+// endSession reports the end of a started session, with the bytes not reported yet
+// to a TrafficObserver.
+func (o *options) endSession(info *SessionInfo, up, down int64, err error) {
+	o.traffic(info, up-atomic.LoadInt64(&info.reportedUp), down-atomic.LoadInt64(&info.reportedDown))
+	duration := time.Since(info.Start)
+	o.observer.OnSessionEnd(info, up, down, duration, err)
+	fields := info.logFields("up", up, "down", down, "duration", duration)
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+	o.logger.Info("session closed", fields...)
+}
@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// A ResolvePolicy decides where a client resolves the domain names of destinations.
+type ResolvePolicy int
+
+const (
+	// ResolveRemote sends domain names to the proxy, as socks5h and SOCKS4a do.
+	ResolveRemote ResolvePolicy = iota
+	// ResolveLocal resolves domain names with the client's Resolver and sends the first
+	// address. If the lookup fails, the domain name is sent to the proxy instead.
+	ResolveLocal
+	// ResolvePreferIPv4 is ResolveLocal, choosing an IPv4 address if there is one.
+	ResolvePreferIPv4
+	// ResolvePreferIPv6 is ResolveLocal, choosing an IPv6 address if there is one.
+	ResolvePreferIPv6
+)
+
+var resolvePolicyNames = []string{"remote", "local", "preferIPv4", "preferIPv6"}
+
+func (p ResolvePolicy) String() string {
+	if p < 0 || int(p) >= len(resolvePolicyNames) {
+		return "unknown"
+	}
+	return resolvePolicyNames[p]
+}
+
+// ParseResolvePolicy parses the names returned by ResolvePolicy.String, ignoring case.
+// The empty string is ResolveRemote.
+func ParseResolvePolicy(s string) (ResolvePolicy, error) {
+	if s == "" {
+		return ResolveRemote, nil
+	}
+	for n, name := range resolvePolicyNames {
+		if strings.EqualFold(s, name) {
+			return ResolvePolicy(n), nil
+		}
+	}
+	return ResolveRemote, errors.New("socks: unknown resolve policy " + s)
+}
+
+// A Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// WithResolvePolicy sets how a client resolves the domain names of destinations.
+// SOCKS4 servers only take IPv4 addresses, so Socks4Client ignores IPv6 addresses
+// and uses SOCKS4a for names it doesn't resolve.
+func WithResolvePolicy(policy ResolvePolicy) Option {
+	return func(o *options) {
+		o.resolvePolicy = policy
+	}
+}
+
+// WithResolver sets the Resolver used by clients that resolve locally. The default
+// is net.DefaultResolver.
+func WithResolver(resolver Resolver) Option {
+	return func(o *options) {
+		if resolver != nil {
+			o.resolver = resolver
+		}
+	}
+}
+
+// resolveAddr applies the resolve policy to addr. It returns addr with the domain name
+// replaced by an IP address, or addr itself if the name is to be sent to the proxy.
+func (o *options) resolveAddr(ctx context.Context, addr *Addr, ipv4Only bool) *Addr {
+	if addr.IP != nil || o.resolvePolicy == ResolveRemote {
+		return addr
+	}
+	addrs, err := o.resolver.LookupIPAddr(ctx, addr.Name)
+	if err != nil {
+		o.logger.Debug("local resolve failed, sending domain to proxy", "host", addr.Name, "error", err)
+		return addr
+	}
+	var first, ip4, ip6 net.IP
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			if ip4 == nil {
+				ip4 = ip
+			}
+		} else if ip6 == nil && !ipv4Only {
+			ip6 = a.IP
+		} else {
+			continue
+		}
+		if first == nil {
+			first = a.IP
+		}
+	}
+	ip := first
+	switch {
+	case o.resolvePolicy == ResolvePreferIPv4 && ip4 != nil:
+		ip = ip4
+	case o.resolvePolicy == ResolvePreferIPv6 && ip6 != nil:
+		ip = ip6
+	}
+	if ip == nil {
+		return addr
+	}
+	return &Addr{IP: ip, Port: addr.Port}
+}
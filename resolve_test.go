@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+type staticResolver map[string][]net.IPAddr
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host " + host)
+}
+
+func TestResolvePolicy(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	resolver := staticResolver{
+		"dual.test": {{IP: net.ParseIP("::1")}, {IP: net.IPv4(127, 0, 0, 1)}},
+		"v6.test":   {{IP: net.ParseIP("::1")}},
+	}
+	tests := []struct {
+		upstream  func(...sockstest.Behavior) *sockstest.Upstream
+		newClient func(address string, opts ...Option) (Dialer, error)
+		policy    ResolvePolicy
+		host      string
+		want      string
+	}{
+		{sockstest.NewSocks5Upstream, newSocks5TestClient, ResolveRemote, "dual.test", "dual.test"},
+		{sockstest.NewSocks5Upstream, newSocks5TestClient, ResolveLocal, "dual.test", "::1"},
+		{sockstest.NewSocks5Upstream, newSocks5TestClient, ResolvePreferIPv4, "dual.test", "127.0.0.1"},
+		{sockstest.NewSocks5Upstream, newSocks5TestClient, ResolvePreferIPv6, "v6.test", "::1"},
+		{sockstest.NewSocks5Upstream, newSocks5TestClient, ResolveLocal, "unknown.test", "unknown.test"},
+		{sockstest.NewShadowSocksUpstream, newShadowSocksTestClient, ResolvePreferIPv4, "dual.test", "127.0.0.1"},
+		{sockstest.NewSocks4Upstream, newSocks4TestClient, ResolveRemote, "dual.test", "dual.test"},
+		{sockstest.NewSocks4Upstream, newSocks4TestClient, ResolveLocal, "dual.test", "127.0.0.1"},
+		{sockstest.NewSocks4Upstream, newSocks4TestClient, ResolvePreferIPv6, "v6.test", "v6.test"},
+	}
+	for _, test := range tests {
+		upstream := test.upstream(sockstest.Behavior{Target: echo.Addr()})
+		client, err := test.newClient(upstream.Addr(), WithResolvePolicy(test.policy), WithResolver(resolver))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := client.Dial("tcp", net.JoinHostPort(test.host, "80"))
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.policy, test.host, err)
+		}
+		sockstest.AssertEcho(t, conn, 10)
+		conn.Close()
+		upstream.Close()
+
+		want := net.JoinHostPort(test.want, "80")
+		if requests := upstream.Requests(); len(requests) != 1 || requests[0].Destination != want {
+			t.Errorf("%s %s: upstream got %+v, want destination %s", test.policy, test.host, requests, want)
+		}
+	}
+}
+
+func newSocks5TestClient(address string, opts ...Option) (Dialer, error) {
+	return NewSocks5Client("tcp", address, "", "", Direct, opts...)
+}
+
+func newSocks4TestClient(address string, opts ...Option) (Dialer, error) {
+	return NewSocks4Client("tcp", address, "", Direct, opts...)
+}
+
+func newShadowSocksTestClient(address string, opts ...Option) (Dialer, error) {
+	return NewShadowSocksClient("tcp", address, Direct, opts...)
+}
@@ -1,9 +1,10 @@
 package socks
 
 import (
+	"context"
 	"errors"
 	"net"
-	"strconv"
+	"time"
 )
 
 // ShadowSocksClient implements ShadowSocks Proxy Protocol
@@ -11,38 +12,66 @@ type ShadowSocksClient struct {
 	network string
 	address string
 	forward Dialer
+	pool    *WarmPool
+	opts    options
 }
 
 // NewShadowSocksClient return a new ShadowSocksClient that implements Dialer interface.
-func NewShadowSocksClient(network, address string, forward Dialer) (*ShadowSocksClient, error) {
-	return &ShadowSocksClient{
+func NewShadowSocksClient(network, address string, forward Dialer, opts ...Option) (*ShadowSocksClient, error) {
+	s := &ShadowSocksClient{
 		network: network,
 		address: address,
 		forward: forward,
-	}, nil
+		opts:    newOptions(opts),
+	}
+	if s.opts.pool != nil {
+		pool := NewWarmPool(forward, *s.opts.pool, opts...)
+		pool.Warm(network, address)
+		s.forward = pool
+		s.pool = pool
+	}
+	return s, nil
+}
+
+// Close closes the warm pool of the client, if WithWarmPool made one, with its idle
+// connections. Connections handed out by Dial stay open.
+func (s *ShadowSocksClient) Close() error {
+	if s.pool == nil {
+		return nil
+	}
+	return s.pool.Close()
 }
 
 // Dial return a new net.Conn that through proxy server establish with address
 func (s *ShadowSocksClient) Dial(network, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer.
+func (s *ShadowSocksClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dial(ctx, network, address)
+	if err != nil {
+		s.opts.logger.Debug("shadowsocks dial failed", "proxy", s.address, "dest", address, "error", err, "duration", time.Since(start))
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *ShadowSocksClient) dial(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	default:
 		return nil, errors.New("socks: no support ShadowSocks proxy connections of type: " + network)
 	}
 
-	host, portStr, err := net.SplitHostPort(address)
+	addr, err := ParseAddr(address)
 	if err != nil {
 		return nil, err
 	}
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, errors.New("socks: failed to parse port number:" + portStr)
-	}
-	if port < 1 || port > 0xffff {
-		return nil, errors.New("socks5: port number out of range:" + portStr)
-	}
+	addr = s.opts.resolveAddr(ctx, addr, false)
 
-	conn, err := s.forward.Dial(s.network, s.address)
+	conn, err := DialContext(ctx, s.forward, s.network, s.address)
 	if err != nil {
 		return nil, err
 	}
@@ -53,27 +82,7 @@ func (s *ShadowSocksClient) Dial(network, address string) (net.Conn, error) {
 		}
 	}()
 
-	buff := make([]byte, 0, 266)
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buff = append(buff, 1)
-			ip = ip4
-		} else {
-			buff = append(buff, 4)
-		}
-		buff = append(buff, ip...)
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("socks: destination hostname too long: " + host)
-		}
-		buff = append(buff, 3)
-		buff = append(buff, uint8(len(host)))
-		buff = append(buff, host...)
-	}
-	buff = append(buff, uint8(port>>8), uint8(port))
-
-	_, err = conn.Write(buff)
-	if err != nil {
+	if _, err := addr.WriteTo(conn); err != nil {
 		return nil, err
 	}
 
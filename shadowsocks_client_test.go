@@ -0,0 +1,26 @@
+package socks
+
+import (
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestShadowSocksClient(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	upstream := sockstest.NewShadowSocksUpstream()
+	defer upstream.Close()
+
+	client, err := NewShadowSocksClient("tcp", upstream.Addr(), Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 1000)
+	conn.Close()
+	sockstest.AssertRelayed(t, echo, 1000, 1000)
+}
@@ -1,17 +1,15 @@
 package socks
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"fmt"
-	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
 const (
 	socks4Version       = 4
-	socks4Connect       = 1
 	socks4Granted       = 90
 	socks4Rejected      = 91
 	socks4ConnectFailed = 92
@@ -29,17 +27,20 @@ var socks4Errors = []string{
 // Just support CONNECT command.
 type Socks4Server struct {
 	forward Dialer
+	opts    options
 }
 
 // NewSocks4Server returns a new Socks4Server that can serve from new clients.
-func NewSocks4Server(forward Dialer) (*Socks4Server, error) {
+func NewSocks4Server(forward Dialer, opts ...Option) (*Socks4Server, error) {
 	return &Socks4Server{
 		forward: forward,
+		opts:    newOptions(opts),
 	}, nil
 }
 
 // Serve with net.Listener for clients.
 func (s *Socks4Server) Serve(listener net.Listener) error {
+	listener = s.opts.tlsListener(listener)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -50,7 +51,12 @@ func (s *Socks4Server) Serve(listener net.Listener) error {
 			}
 		}
 
-		go serveSOCKS4Client(conn, s.forward)
+		// Limits are checked here, so that rejected clients don't pile up goroutines.
+		if !s.opts.acquire(conn.RemoteAddr().String()) {
+			s.opts.reject(conn, rejectSOCKS4Client)
+			continue
+		}
+		go serveSOCKS4Client(conn, s.forward, &s.opts)
 	}
 }
 
@@ -60,48 +66,55 @@ type Socks4Client struct {
 	address string
 	userID  string
 	forward Dialer
+	opts    options
 }
 
 // NewSocks4Client return a new Socks4Client that implements Dialer interface.
 // network must be supported by forward, address is proxy server's address, userID can empty.
-func NewSocks4Client(network, address, userID string, forward Dialer) (*Socks4Client, error) {
+func NewSocks4Client(network, address, userID string, forward Dialer, opts ...Option) (*Socks4Client, error) {
 	return &Socks4Client{
 		network: network,
 		address: address,
 		userID:  userID,
 		forward: forward,
+		opts:    newOptions(opts),
 	}, nil
 }
 
-// Dial return a new net.Conn if succeeded. network must be tcp, tcp4 or tcp6, address only is IPV4.
+// Dial return a new net.Conn if succeeded. network must be tcp, tcp4 or tcp6. address can be IPV4
+// or a domain name, which is sent with SOCKS4a or resolved locally as the resolve policy says.
 func (s *Socks4Client) Dial(network, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer.
+func (s *Socks4Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dial(ctx, network, address)
+	if err != nil {
+		s.opts.logger.Debug("socks4 dial failed", "proxy", s.address, "dest", address, "error", err, "duration", time.Since(start))
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socks4Client) dial(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	default:
 		return nil, errors.New("socks: no support for SOCKS4 proxy connections of type:" + network)
 	}
 
-	host, portStr, err := net.SplitHostPort(address)
+	addr, err := ParseAddr(address)
 	if err != nil {
 		return nil, err
 	}
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, errors.New("socks: failed to parse port:" + portStr)
-	}
-	if port < 1 || port > 0xffff {
-		return nil, errors.New("socks: port number out of range:" + portStr)
-	}
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return nil, errors.New("socks: destination host invalid:" + host)
-	}
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return nil, errors.New("socks:destination ip must be ipv4:" + host)
+	addr = s.opts.resolveAddr(ctx, addr, true)
+	if addr.IP != nil && addr.IP.To4() == nil {
+		return nil, errors.New("socks: destination ip must be ipv4: " + addr.Host())
 	}
 
-	conn, err := s.forward.Dial(s.network, s.address)
+	conn, err := DialContext(ctx, s.forward, s.network, s.address)
 	if err != nil {
 		return nil, err
 	}
@@ -111,25 +124,22 @@ func (s *Socks4Client) Dial(network, address string) (net.Conn, error) {
 			(*closeConn).Close()
 		}
 	}()
-
-	buff := make([]byte, 0, 8+len(s.userID)+1)
-	buff = append(buff, socks4Version, socks4Connect)
-	buff = append(buff, byte(port>>8), byte(port))
-	buff = append(buff, ip4...)
-	if len(s.userID) != 0 {
-		buff = append(buff, []byte(s.userID)...)
+	tlsConn, err := s.opts.clientTLS(conn, s.address)
+	if err != nil {
+		return nil, err
 	}
-	buff = append(buff, 0)
+	conn = tlsConn
 
-	if _, err := conn.Write(buff); err != nil {
+	request := &Socks4Request{Command: CmdConnect, Port: addr.Port, IP: addr.IP, UserID: s.userID, Name: addr.Name}
+	if _, err := request.WriteTo(conn); err != nil {
 		return nil, errors.New("socks: failed to write connect request to SOCKS4 server at: " + s.address + ": " + err.Error())
 	}
-	buff = buff[:8]
-	if _, err := io.ReadFull(conn, buff); err != nil {
+	var reply Socks4Reply
+	if _, err := reply.ReadFrom(conn); err != nil {
 		return nil, errors.New("socks: failed to read connect reply from SOCKS4 server at: " + s.address + ": " + err.Error())
 	}
-	if buff[1] != socks4Granted {
-		cd := int(buff[1]) - socks4Granted
+	if reply.Code != socks4Granted {
+		cd := int(reply.Code) - socks4Granted
 		failure := "unknown error"
 		if cd < len(socks4Errors) && cd >= 0 {
 			failure = socks4Errors[cd]
@@ -141,53 +151,76 @@ func (s *Socks4Client) Dial(network, address string) (net.Conn, error) {
 	return conn, nil
 }
 
-func serveSOCKS4Client(conn net.Conn, forward Dialer) {
+// rejectSOCKS4Client answers the request of a client rejected by the limits.
+func rejectSOCKS4Client(conn net.Conn, id uint64, opts *options) {
+	host, _, err := readSocks4Request(conn)
+	if err == nil {
+		writeSocks4Reply(conn, socks4Rejected)
+	}
+	opts.logger.Warn("session rejected", "conn", id, "client", conn.RemoteAddr().String(), "dest", host)
+}
+
+// serveSOCKS4Client serves a client whose session was acquired by the accept loop.
+func serveSOCKS4Client(conn net.Conn, forward Dialer, opts *options) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
-	buff, err := reader.Peek(9)
+	id := nextConnID()
+	clientAddr := conn.RemoteAddr().String()
+	defer opts.release(clientAddr)
+
+	certUser, err := tlsIdentity(conn)
 	if err != nil {
+		opts.logger.Debug("socks4 handshake failed", "conn", id, "client", clientAddr, "error", err)
 		return
 	}
-	if buff[8] != 0 {
-		if _, err = reader.ReadSlice(0); err != nil {
-			return
-		}
+	host, userID, err := readSocks4Request(conn)
+	if err != nil {
+		writeSocks4Reply(conn, socks4Rejected)
+		opts.logger.Debug("socks4 handshake failed", "conn", id, "client", clientAddr, "error", err)
+		return
 	}
 
-	reply := make([]byte, 8)
-	if buff[0] != socks4Version {
-		reply[1] = socks4Rejected
-		conn.Write(reply)
-		return
+	info := opts.newSessionInfo(id, "socks4", clientAddr, host)
+	info.User = userID
+	if certUser != "" {
+		info.User = certUser
 	}
-	if buff[1] != socks4Connect {
-		reply[1] = socks4Rejected
-		conn.Write(reply)
+	dest, err := opts.dialForward(forward, info, "tcp4", host)
+	if err != nil {
+		writeSocks4Reply(conn, socks4ConnectFailed)
+		opts.endSession(info, 0, 0, err)
 		return
 	}
+	defer dest.Close()
 
-	port := uint16(buff[2])<<8 | uint16(buff[3])
-	ip := buff[4:8]
+	if err := writeSocks4Reply(conn, socks4Granted); err != nil {
+		opts.endSession(info, 0, 0, err)
+		return
+	}
 
-	host := fmt.Sprintf("%d.%d.%d.%d:%d", ip[0], ip[1], ip[2], ip[3], port)
-	dest, err := forward.Dial("tcp4", host)
+	client, err := opts.decorateSession(conn, info)
 	if err != nil {
-		reply[1] = socks4ConnectFailed
-		conn.Write(reply)
+		opts.endSession(info, 0, 0, err)
 		return
 	}
-	defer dest.Close()
+	up, down, err := opts.relay(info, client, dest)
+	opts.endSession(info, up, down, err)
+}
 
-	reply[1] = socks4Granted
-	if _, err = conn.Write(reply); err != nil {
-		return
+// readSocks4Request reads a CONNECT request, returning the destination as host:port and the user id.
+// SOCKS4a requests carry a domain name instead of an IP address.
+func readSocks4Request(conn net.Conn) (string, string, error) {
+	var request Socks4Request
+	if _, err := request.ReadFrom(conn); err != nil {
+		return "", "", errors.New("socks: failed to read request: " + err.Error())
+	}
+	if request.Command != CmdConnect {
+		return "", "", errors.New("socks: unsupported command " + strconv.Itoa(int(request.Command)))
 	}
+	return request.Addr(), request.UserID, nil
+}
 
-	go func() {
-		defer conn.Close()
-		defer dest.Close()
-		io.Copy(dest, conn)
-	}()
-	io.Copy(conn, dest)
+func writeSocks4Reply(conn net.Conn, code byte) error {
+	_, err := (&Socks4Reply{Code: code}).WriteTo(conn)
+	return err
 }
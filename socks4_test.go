@@ -1,67 +1,75 @@
 package socks
 
 import (
+	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"strings"
 	"testing"
-)
 
-const (
-	TestSocks4ServerAddr   = "127.0.0.1:8000"
-	TestSocks4TargetDomain = "www.baidu.com"
+	"github.com/eahydra/socks/sockstest"
 )
 
+const TestHTTPBody = "hello, socks"
+
 func TestSocks4Client(t *testing.T) {
-	listener, err := net.Listen("tcp", TestSocks4ServerAddr)
+	target := sockstest.NewHTTPServer(TestHTTPBody)
+	defer target.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer listener.Close()
-	go func() {
-		server, err := NewSocks4Server(Direct)
-		if err != nil {
-			t.Fatal(err)
-		}
-		server.Serve(listener)
-	}()
-
-	client, err := NewSocks4Client("tcp", TestSocks4ServerAddr, "", Direct)
+	server, err := NewSocks4Server(Direct)
 	if err != nil {
 		t.Fatal(err)
 	}
+	go server.Serve(listener)
 
-	addrs, err := net.LookupHost(TestSocks4TargetDomain)
+	client, err := NewSocks4Client("tcp", listener.Addr().String(), "", Direct)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(addrs) == 0 {
-		t.Fatal("net.LookupHost with " + TestSocks4TargetDomain + " result invalid")
-	}
+	testHTTPGet(t, client, target.URL)
+}
 
-	conn, err := client.Dial("tcp", addrs[0]+":80")
-	if err != nil {
-		t.Fatal("socks4 client.Dial failed, err: " + err.Error())
-	}
-	t.Log("client.Dial succeeded")
-	httpClient := httputil.NewClientConn(conn, nil)
+func TestSocks4ClientRejected(t *testing.T) {
+	upstream := sockstest.NewSocks4Upstream(sockstest.Behavior{Reply: socks4Rejected})
+	defer upstream.Close()
+
+	client, err := NewSocks4Client("tcp", upstream.Addr(), "alice", Direct)
 	if err != nil {
-		conn.Close()
 		t.Fatal(err)
 	}
-	defer httpClient.Close()
+	_, err = client.Dial("tcp", "127.0.0.1:80")
+	if err == nil || !strings.Contains(err.Error(), socks4Errors[1]) {
+		t.Fatalf("got %v, want %q", err, socks4Errors[1])
+	}
+	requests := upstream.Requests()
+	if len(requests) != 1 || requests[0].User != "alice" || requests[0].Destination != "127.0.0.1:80" {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+}
 
-	request, err := http.NewRequest("GET", "/", nil)
-	if err != nil {
-		t.Fatal(err)
+// testHTTPGet gets url through d and checks the response body.
+func testHTTPGet(t *testing.T, d Dialer, url string) {
+	t.Helper()
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial: d.Dial,
+		},
 	}
-	resp, err := httpClient.Do(request)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		t.Fatal(err)
 	}
-	data, err := httputil.DumpResponse(resp, true)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log("socks4 HTTP Get:", string(data))
+	if string(data) != TestHTTPBody {
+		t.Fatalf("got body %q, want %q", data, TestHTTPBody)
+	}
 }
@@ -1,39 +1,13 @@
 package socks
 
 import (
+	"context"
 	"errors"
-	"io"
 	"net"
-	"strconv"
+	"time"
 )
 
-const (
-	socks5Version = 5
-
-	socks5AuthNone     = 0
-	socks5AuthPassword = 2
-	socks5AuthNoAccept = 0xff
-
-	socks5AuthPasswordVer = 1
-
-	socks5Connect = 1
-
-	socks5IP4    = 1
-	socks5Domain = 3
-	socks5IP6    = 4
-)
-
-const (
-	socks5Success                 = 0
-	socks5GeneralFailure          = 1
-	socks5ConnectNotAllowed       = 2
-	socks5NetworkUnreachable      = 3
-	socks5HostUnreachable         = 4
-	socks5ConnectionRefused       = 5
-	socks5TTLExpired              = 6
-	socks5CommandNotSupported     = 7
-	socks5AddressTypeNotSupported = 8
-)
+const socks5Version = 5
 
 var socks5Errors = []string{
 	"",
@@ -48,38 +22,74 @@ var socks5Errors = []string{
 }
 
 // Socks5Client implements Socks5 Proxy Protocol(RFC 1928) Client Protocol.
-// Just support CONNECT command, and support USERNAME/PASSWORD authentication methods(RFC 1929)
+// Just support CONNECT command, the private LISTEN command through Listen, and support USERNAME/PASSWORD authentication methods(RFC 1929)
 type Socks5Client struct {
 	network  string
 	address  string
 	user     string
 	password string
 	forward  Dialer
+	opts     options
 }
 
 // NewSocks5Client return a new Socks5Client that implements Dialer interface.
-func NewSocks5Client(network, address, user, password string, forward Dialer) (*Socks5Client, error) {
+func NewSocks5Client(network, address, user, password string, forward Dialer, opts ...Option) (*Socks5Client, error) {
 	return &Socks5Client{
 		network:  network,
 		address:  address,
 		user:     user,
 		password: password,
 		forward:  forward,
+		opts:     newOptions(opts),
 	}, nil
 }
 
 // Dial return a new net.Conn that through the CONNECT command to establish connections with proxy server.
 // address as RFC's requirements that can be IPV4, IPV6 and domain host, such as 8.8.8.8:999 or google.com:80
 func (s *Socks5Client) Dial(network, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer.
+func (s *Socks5Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dial(ctx, network, address)
+	if err != nil {
+		s.opts.logger.Debug("socks5 dial failed", "proxy", s.address, "dest", address, "error", err, "duration", time.Since(start))
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticators returns the authenticators set by WithAuthenticators, or those for the
+// user and password the client was created with.
+func (s *Socks5Client) authenticators() []Authenticator {
+	if s.opts.authenticators != nil {
+		return s.opts.authenticators
+	}
+	authenticators := []Authenticator{NoAuth}
+	if len(s.user) > 0 && len(s.user) < 256 && len(s.password) < 256 {
+		authenticators = append(authenticators, &UserPassAuthenticator{Username: s.user, Password: s.password})
+	}
+	return authenticators
+}
+
+func (s *Socks5Client) dial(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	default:
 		return nil, errors.New("socks: no support for SOCKS5 proxy connections of type:" + network)
 	}
+	conn, _, err := s.request(ctx, CmdConnect, address)
+	return conn, err
+}
 
-	conn, err := s.forward.Dial(s.network, s.address)
+// request sends a request with command for address through a new connection to the
+// server, and returns the connection once it replied successfully, with its reply.
+func (s *Socks5Client) request(ctx context.Context, command byte, address string) (net.Conn, *Reply, error) {
+	conn, err := DialContext(ctx, s.forward, s.network, s.address)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	closeConn := &conn
 	defer func() {
@@ -87,225 +97,196 @@ func (s *Socks5Client) Dial(network, address string) (net.Conn, error) {
 			(*closeConn).Close()
 		}
 	}()
-
-	host, portStr, err := net.SplitHostPort(address)
+	tlsConn, err := s.opts.clientTLS(conn, s.address)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	conn = tlsConn
 
-	// check port
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, errors.New("socks: failed to parse port number: " + portStr)
-	}
-	if port < 1 || port > 0xffff {
-		return nil, errors.New("socks: port number out of range: " + portStr)
+	var addr *Addr
+	if command == CmdListen {
+		addr, err = parseAddr(address, 0)
+	} else if addr, err = ParseAddr(address); err == nil {
+		addr = s.opts.resolveAddr(ctx, addr, false)
 	}
-
-	buff := make([]byte, 0, 6+len(host))
-
-	buff = append(buff, socks5Version)
-
-	// set authentication methods
-	if len(s.user) > 0 && len(s.user) < 256 && len(s.password) < 256 {
-		buff = append(buff, 2, socks5AuthNone, socks5AuthPassword)
-	} else {
-		buff = append(buff, 1, socks5AuthNone)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// send authentication methods
-	if _, err := conn.Write(buff); err != nil {
-		return nil, errors.New("socks: failed to write handshake request at: " + s.address + ": " + err.Error())
-	}
-	if _, err := io.ReadFull(conn, buff[:2]); err != nil {
-		return nil, errors.New("socks: failed to read handshake reply at: " + s.address + ": " + err.Error())
+	authConn, err := clientAuthenticate(conn, s.authenticators())
+	if err != nil {
+		return nil, nil, errors.New("socks: SOCKS5 server at: " + s.address + ": " + err.Error())
 	}
+	conn = authConn
 
-	// handle authentication methods reply
-	if buff[0] != socks5Version {
-		return nil, errors.New("socks: SOCKS5 server at: " + s.address + " invalid version" + strconv.Itoa(int(buff[0])))
+	request := &Request{Command: command, Addr: *addr}
+	if _, err := request.WriteTo(conn); err != nil {
+		return nil, nil, errors.New("socks: failed to write request to SOCKS5 server at: " + s.address + ": " + err.Error())
 	}
-	if buff[1] == socks5AuthNoAccept {
-		return nil, errors.New("socks: SOCKS server at: " + s.address + " no acceptable methods")
+	reply, err := readSocks5Reply(conn)
+	if replyErr, ok := err.(*ReplyError); ok {
+		replyErr.Server = s.address
+		return nil, nil, replyErr
 	}
-
-	if buff[1] == socks5AuthPassword {
-		// build username/password authentication request
-		buff = buff[:0]
-		buff = append(buff, socks5AuthPasswordVer)
-		buff = append(buff, uint8(len(s.user)))
-		buff = append(buff, []byte(s.user)...)
-		buff = append(buff, uint8(len(s.password)))
-		buff = append(buff, []byte(s.password)...)
-
-		if _, err := conn.Write(buff); err != nil {
-			return nil, errors.New("socks: failed to write password authentication request to SOCKS5 server at: " + s.address + ": " + err.Error())
-		}
-		if _, err := io.ReadFull(conn, buff[:2]); err != nil {
-			return nil, errors.New("socks: failed to read password authentication reply from SOCKS5 server at: " + s.address + ": " + err.Error())
-		}
-		// 0 indicates success
-		if buff[1] != 0 {
-			return nil, errors.New("socks: SOCKS5 server at: " + s.address + " reject username/password")
-		}
+	if err != nil {
+		return nil, nil, errors.New("socks: SOCKS5 server at: " + s.address + ": " + err.Error())
 	}
 
-	// build connect request
-	buff = buff[:0]
-	buff = append(buff, socks5Version, socks5Connect, 0)
+	closeConn = nil
+	return conn, reply, nil
+}
 
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buff = append(buff, socks5IP4)
-			ip = ip4
-		} else {
-			buff = append(buff, socks5IP6)
-		}
-		buff = append(buff, ip...)
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("socks: destination hostname too long: " + host)
-		}
-		buff = append(buff, socks5Domain)
-		buff = append(buff, uint8(len(host)))
-		buff = append(buff, host...)
-	}
-	buff = append(buff, byte(port>>8), byte(port))
+// ReplyError is the failure reply of a SOCKS5 server to a request. The server works,
+// but could not carry out the request, like connecting to an unreachable host.
+type ReplyError struct {
+	// Server is the address of the server, empty if the error came with its reply
+	// to a request already answered, like the second reply of LISTEN.
+	Server string
+	Reply  byte
+}
 
-	if _, err := conn.Write(buff); err != nil {
-		return nil, errors.New("socks: failed to write connect request to SOCKS5 server at: " + s.address + ": " + err.Error())
+func (e *ReplyError) Error() string {
+	failure := "unknown error"
+	if int(e.Reply) < len(socks5Errors) {
+		failure = socks5Errors[e.Reply]
 	}
-	if _, err := io.ReadFull(conn, buff[:4]); err != nil {
-		return nil, errors.New("socks: failed to read connect reply from SOCKS5 server at: " + s.address + ": " + err.Error())
+	if e.Server == "" {
+		return "request failed: " + failure
 	}
+	return "socks: SOCKS5 server at: " + e.Server + ": request failed: " + failure
+}
 
-	failure := "unknown error"
-	if int(buff[1]) < len(socks5Errors) {
-		failure = socks5Errors[buff[1]]
+// readSocks5Reply reads a reply, failing with a ReplyError unless it succeeded.
+func readSocks5Reply(conn net.Conn) (*Reply, error) {
+	var reply Reply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		return nil, errors.New("failed to read reply: " + err.Error())
 	}
-	if len(failure) > 0 {
-		return nil, errors.New("socks: SOCKS5 server failed to connect: " + failure)
+	if reply.Reply != ReplySucceeded {
+		return nil, &ReplyError{Reply: reply.Reply}
 	}
+	return &reply, nil
+}
 
-	// read remain data include BIND.ADDRESS and BIND.PORT
-	discardBytes := 0
-	switch buff[3] {
-	case socks5IP4:
-		discardBytes = net.IPv4len
-	case socks5IP6:
-		discardBytes = net.IPv6len
-	case socks5Domain:
-		if _, err := io.ReadFull(conn, buff[:1]); err != nil {
-			return nil, errors.New("socks: failed to read domain length from SOCKS5 server at: " + s.address + ": " + err.Error())
-		}
-		discardBytes = int(buff[0])
-	default:
-		return nil, errors.New("socks: got unknown address type " + strconv.Itoa(int(buff[3])) + " from SOCKS5 server at: " + s.address)
-	}
-	discardBytes += 2
-	if cap(buff) < discardBytes {
-		buff = make([]byte, discardBytes)
-	} else {
-		buff = buff[:discardBytes]
+// Listen sends a LISTEN request for address, which a server with ListenHandler listens
+// on, and returns once the server listens.
+func (s *Socks5Client) Listen(ctx context.Context, address string) (*Socks5Listen, error) {
+	conn, reply, err := s.request(ctx, CmdListen, address)
+	if err != nil {
+		s.opts.logger.Debug("socks5 listen failed", "proxy", s.address, "address", address, "error", err)
+		return nil, err
 	}
-	if _, err := io.ReadFull(conn, buff); err != nil {
-		return nil, errors.New("socks: failed to read address and port from SOCKS5 server at: " + s.address + ": " + err.Error())
+	return &Socks5Listen{Addr: reply.Addr, conn: conn}, nil
+}
+
+// Socks5Listen is a LISTEN request accepted by a SOCKS5 server.
+type Socks5Listen struct {
+	// Addr is the address the server listens on.
+	Addr Addr
+
+	conn net.Conn
+}
+
+// Accept waits for the second reply of the server, sent when a peer connects, and
+// returns the connection relayed to the peer, with the address of the peer as its
+// RemoteAddr. It can be called once.
+func (l *Socks5Listen) Accept() (net.Conn, error) {
+	reply, err := readSocks5Reply(l.conn)
+	if err != nil {
+		l.conn.Close()
+		return nil, errors.New("socks: SOCKS5 LISTEN: " + err.Error())
 	}
+	return &listenConn{Conn: l.conn, peer: reply.Addr}, nil
+}
 
-	closeConn = nil
-	return conn, nil
+// Close closes the connection of the request, which makes the server stop waiting.
+func (l *Socks5Listen) Close() error {
+	return l.conn.Close()
 }
 
-func serveSocks5Client(conn net.Conn, forward Dialer) {
-	defer conn.Close()
+type listenConn struct {
+	net.Conn
+	peer Addr
+}
 
-	buff := make([]byte, 262)
-	reply := []byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x22, 0x22}
+func (c *listenConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.peer.IP, Port: int(c.peer.Port)}
+}
 
-	if _, err := io.ReadFull(conn, buff[:2]); err != nil {
-		return
-	}
-	if buff[0] != socks5Version {
-		reply[1] = socks5AuthNoAccept
-		conn.Write(reply[:2])
-		return
-	}
-	numMethod := buff[1]
-	if _, err := io.ReadFull(conn, buff[:numMethod]); err != nil {
-		return
-	}
-	reply[1] = socks5AuthNone
-	if _, err := conn.Write(reply[:2]); err != nil {
+// rejectSocks5Client answers the request of a client rejected by the limits.
+func rejectSocks5Client(conn net.Conn, id uint64, opts *options) {
+	clientAddr := conn.RemoteAddr().String()
+	client, _, request, err := readSocks5Request(conn, opts.authenticators)
+	if err != nil {
+		opts.logger.Warn("session rejected", "conn", id, "client", clientAddr)
 		return
 	}
+	writeSocks5Reply(client, ReplyNotAllowed)
+	opts.logger.Warn("session rejected", "conn", id, "client", clientAddr, "dest", request.Addr.String())
+}
 
-	if _, err := io.ReadFull(conn, buff[:4]); err != nil {
-		return
-	}
-	if buff[1] != socks5Connect {
-		reply[1] = socks5CommandNotSupported
-		conn.Write(reply)
-		return
-	}
+// serveSocks5Client serves a client whose session was acquired by the accept loop.
+func serveSocks5Client(conn net.Conn, opts *options) {
+	defer conn.Close()
 
-	addressType := buff[3]
-	addressLen := 0
-	switch addressType {
-	case socks5IP4:
-		addressLen = net.IPv4len
-	case socks5IP6:
-		addressLen = net.IPv6len
-	case socks5Domain:
-		if _, err := io.ReadFull(conn, buff[:1]); err != nil {
-			return
-		}
-		addressLen = int(buff[0])
-	default:
-		reply[1] = socks5AddressTypeNotSupported
-		conn.Write(reply)
+	id := nextConnID()
+	clientAddr := conn.RemoteAddr().String()
+	defer opts.release(clientAddr)
+
+	certUser, err := tlsIdentity(conn)
+	if err != nil {
+		opts.logger.Debug("socks5 handshake failed", "conn", id, "client", clientAddr, "error", err)
 		return
 	}
-	host := make([]byte, addressLen)
-	if _, err := io.ReadFull(conn, host); err != nil {
+	client, user, request, err := readSocks5Request(conn, opts.authenticators)
+	if err != nil {
+		opts.logger.Debug("socks5 handshake failed", "conn", id, "client", clientAddr, "error", err)
 		return
 	}
-	if _, err := io.ReadFull(conn, buff[:2]); err != nil {
-		return
+	if user == "" {
+		user = certUser
 	}
-	hostStr := ""
-	switch addressType {
-	case socks5IP4, socks5IP6:
-		ip := net.IP(host)
-		hostStr = ip.String()
-	case socks5Domain:
-		hostStr = string(host)
+
+	info := opts.newSessionInfo(id, "socks5", clientAddr, request.Addr.String())
+	info.User = user
+	opts.observer.OnSessionStart(info)
+	r := &Socks5Request{
+		Command: request.Command,
+		Addr:    request.Addr,
+		User:    user,
+		Conn:    client,
+		Info:    info,
+		opts:    opts,
 	}
-	port := uint16(buff[0])<<8 | uint16(buff[1])
-	if port < 1 || port > 0xffff {
-		reply[1] = socks5HostUnreachable
-		conn.Write(reply)
-		return
+	opts.handler.ServeSocks5(r)
+	if !r.replied {
+		r.fail(ReplyGeneralFailure, errors.New("socks: SOCKS5 handler sent no reply"))
 	}
-	portStr := strconv.Itoa(int(port))
+	opts.endSession(info, r.up, r.down, r.err)
+}
 
-	hostStr = net.JoinHostPort(hostStr, portStr)
-	dest, err := forward.Dial("tcp", hostStr)
+// readSocks5Request runs the method negotiation and sub-negotiation with the client and
+// reads its request. It returns the conn to use from then on and the identity of the client.
+// Requests with an unsupported address type are answered with a failure reply.
+func readSocks5Request(conn net.Conn, authenticators []Authenticator) (net.Conn, string, *Request, error) {
+	conn, user, err := serverAuthenticate(conn, authenticators)
 	if err != nil {
-		reply[1] = socks5ConnectionRefused
-		conn.Write(reply)
-		return
-	}
-	defer dest.Close()
-	reply[1] = socks5Success
-	if _, err := conn.Write(reply); err != nil {
-		return
+		return nil, "", nil, err
 	}
 
-	go func() {
-		defer conn.Close()
-		defer dest.Close()
-		io.Copy(conn, dest)
-	}()
+	request := &Request{}
+	if _, err := request.ReadFrom(conn); err != nil {
+		var addrErr *UnsupportedAddrTypeError
+		if errors.As(err, &addrErr) {
+			writeSocks5Reply(conn, ReplyAddressNotSupported)
+		}
+		return nil, "", nil, errors.New("socks: failed to read request: " + err.Error())
+	}
+	return conn, user, request, nil
+}
 
-	io.Copy(dest, conn)
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	reply := &Reply{Reply: rep, Addr: Addr{IP: net.IPv4zero, Port: 0x2222}}
+	_, err := reply.WriteTo(conn)
+	return err
 }
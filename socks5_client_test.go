@@ -1,61 +1,108 @@
 package socks
 
 import (
+	"errors"
 	"net"
-	"net/http"
-	"net/http/httputil"
+	"strings"
 	"testing"
-)
+	"time"
 
-const (
-	TestSocks5ServerAddress = "127.0.0.1:8001"
-	TestSocks5TargetDomain  = "www.baidu.com"
+	"github.com/eahydra/socks/sockstest"
 )
 
 func TestSocks5Client(t *testing.T) {
-	listener, err := net.Listen("tcp", TestSocks5ServerAddress)
+	target := sockstest.NewHTTPServer(TestHTTPBody)
+	defer target.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer listener.Close()
-
-	go func() {
-		server, err := NewSocks5Server(Direct)
-		if err != nil {
-			t.Fatal(err)
-		}
-		server.Serve(listener)
-	}()
-
-	client, err := NewSocks5Client("tcp", TestSocks5ServerAddress, "", "", Direct)
+	server, err := NewSocks5Server(Direct)
 	if err != nil {
 		t.Fatal(err)
 	}
-	conn, err := client.Dial("tcp", TestSocks5TargetDomain+":80")
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
 	if err != nil {
 		t.Fatal(err)
 	}
+	testHTTPGet(t, client, target.URL)
+}
 
-	t.Log("client.Dial succeeded")
-	httpClient := httputil.NewClientConn(conn, nil)
+func TestSocks5ClientUpstream(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	upstream := sockstest.NewSocks5Upstream(sockstest.Behavior{RequireAuth: true, Target: echo.Addr()})
+	defer upstream.Close()
+
+	client, err := NewSocks5Client("tcp", upstream.Addr(), "alice", "secret", Direct)
 	if err != nil {
-		conn.Close()
 		t.Fatal(err)
 	}
-	defer httpClient.Close()
-
-	request, err := http.NewRequest("GET", "/", nil)
+	conn, err := client.Dial("tcp", "echo.test:7")
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := httpClient.Do(request)
+	sockstest.AssertEcho(t, conn, 4096)
+	conn.Close()
+	sockstest.AssertRelayed(t, upstream.Server, 4096, 4096)
+
+	requests := upstream.Requests()
+	want := sockstest.Request{Destination: "echo.test:7", User: "alice", Password: "secret"}
+	if len(requests) != 1 || requests[0] != want {
+		t.Fatalf("got requests %+v, want %+v", requests, want)
+	}
+}
+
+func TestSocks5ClientFailures(t *testing.T) {
+	tests := []struct {
+		behavior sockstest.Behavior
+		want     string
+		reply    bool
+	}{
+		{sockstest.Behavior{Reply: ReplyHostUnreachable}, socks5Errors[ReplyHostUnreachable], true},
+		{sockstest.Behavior{Raw: []byte{5, 0, 0, 9}}, "unknown address type 9", false},
+		{sockstest.Behavior{Raw: []byte{4, 0}}, "failed to read", false},
+	}
+	for _, test := range tests {
+		upstream := sockstest.NewSocks5Upstream(test.behavior)
+		client, err := NewSocks5Client("tcp", upstream.Addr(), "", "", Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Dial("tcp", "127.0.0.1:80")
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("behavior %+v: got %v, want %q", test.behavior, err, test.want)
+		}
+		var replyErr *ReplyError
+		if errors.As(err, &replyErr) != test.reply {
+			t.Errorf("behavior %+v: got %T, want a ReplyError: %v", test.behavior, err, test.reply)
+		}
+		upstream.Close()
+	}
+}
+
+func TestSocks5ClientDelay(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+	upstream := sockstest.NewSocks5Upstream(sockstest.Behavior{Delay: 100 * time.Millisecond})
+	defer upstream.Close()
+
+	client, err := NewSocks5Client("tcp", upstream.Addr(), "", "", Direct)
 	if err != nil {
 		t.Fatal(err)
 	}
-	data, err := httputil.DumpResponse(resp, true)
+	start := time.Now()
+	conn, err := client.Dial("tcp", echo.Addr())
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log("socks5 HTTP Get:", string(data))
-
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Dial returned after %v, before the upstream replied", elapsed)
+	}
+	sockstest.AssertEcho(t, conn, 100)
 }
@@ -0,0 +1,120 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Socks5Request is a request received by a Socks5Server, passed to its Socks5Handler
+// once the method negotiation is done.
+type Socks5Request struct {
+	// Command is the requested command, such as CmdConnect.
+	Command byte
+	// Addr is the requested destination.
+	Addr Addr
+	// User is the authenticated identity of the client, empty if it didn't authenticate.
+	// It comes from the SOCKS5 authentication method, or else from the TLS client certificate.
+	User string
+	// Conn is the client connection. The handler must not close it.
+	Conn net.Conn
+	// Info describes the session to the server's Observer.
+	Info *SessionInfo
+
+	opts    *options
+	replied bool
+	up      int64
+	down    int64
+	err     error
+}
+
+// Reply sends a reply with code rep and the bound address to the client. A nil bound
+// sends 0.0.0.0. Only one reply can be sent; if the handler returns without replying,
+// the server replies ReplyGeneralFailure.
+func (r *Socks5Request) Reply(rep byte, bound *Addr) error {
+	if r.replied {
+		return errors.New("socks: SOCKS5 reply already sent")
+	}
+	r.replied = true
+	if bound == nil {
+		bound = &Addr{IP: net.IPv4zero, Port: 0x2222}
+	}
+	_, err := (&Reply{Reply: rep, Addr: *bound}).WriteTo(r.Conn)
+	return err
+}
+
+// Relay replies ReplySucceeded unless a reply was sent already, then copies data between
+// the client and dest until either side is finished, and closes dest. The server's
+// session decorators apply, and the bytes copied are reported when the session ends.
+func (r *Socks5Request) Relay(dest net.Conn) error {
+	defer dest.Close()
+	if !r.replied {
+		if err := r.Reply(ReplySucceeded, nil); err != nil {
+			r.err = err
+			return err
+		}
+	}
+	client, err := r.opts.decorateSession(r.Conn, r.Info)
+	if err != nil {
+		r.err = err
+		return err
+	}
+	r.up, r.down, r.err = r.opts.relay(r.Info, client, dest)
+	return r.err
+}
+
+// fail replies rep and records err as the reason the session ended.
+func (r *Socks5Request) fail(rep byte, err error) {
+	r.err = err
+	r.Reply(rep, nil)
+}
+
+// A Socks5Handler serves the requests of a Socks5Server, as http.Handler does for HTTP.
+type Socks5Handler interface {
+	ServeSocks5(r *Socks5Request)
+}
+
+// Socks5HandlerFunc adapts a function to a Socks5Handler.
+type Socks5HandlerFunc func(r *Socks5Request)
+
+// ServeSocks5 calls f(r).
+func (f Socks5HandlerFunc) ServeSocks5(r *Socks5Request) {
+	f(r)
+}
+
+// ConnectHandler returns a Socks5Handler that serves CONNECT by dialing the destination
+// through forward, and answers other commands with ReplyCommandNotSupported. It is the
+// handler of a Socks5Server without WithHandler.
+func ConnectHandler(forward Dialer) Socks5Handler {
+	return connectHandler{forward: forward}
+}
+
+type connectHandler struct {
+	forward Dialer
+}
+
+func (h connectHandler) ServeSocks5(r *Socks5Request) {
+	if r.Command != CmdConnect {
+		r.fail(ReplyCommandNotSupported, errors.New("socks: unsupported command "+strconv.Itoa(int(r.Command))))
+		return
+	}
+	if r.Addr.Port < 1 {
+		r.fail(ReplyHostUnreachable, errors.New("socks: invalid port number 0"))
+		return
+	}
+	dest, err := r.opts.dial(h.forward, r.Info, "tcp", r.Addr.String())
+	if err != nil {
+		r.fail(ReplyConnectionRefused, err)
+		return
+	}
+	r.Relay(dest)
+}
+
+// WithHandler sets the Socks5Handler of a Socks5Server, replacing the ConnectHandler of its forward.
+func WithHandler(handler Socks5Handler) Option {
+	return func(o *options) {
+		if handler != nil {
+			o.handler = handler
+		}
+	}
+}
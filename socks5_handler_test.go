@@ -0,0 +1,65 @@
+package socks
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestSocks5ServerHandler(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connect := ConnectHandler(Direct)
+	handler := Socks5HandlerFunc(func(r *Socks5Request) {
+		switch {
+		case r.Addr.Name == "status.local":
+			r.Reply(ReplySucceeded, nil)
+			io.WriteString(r.Conn, "ok")
+		case r.Addr.Name == "blocked.local":
+			r.Reply(ReplyNotAllowed, nil)
+		default:
+			connect.ServeSocks5(r)
+		}
+	})
+	server, err := NewSocks5Server(nil, WithHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := client.Dial("tcp", "status.local:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("status page returned %q, %v", body, err)
+	}
+
+	if _, err := client.Dial("tcp", "blocked.local:80"); err == nil || !strings.Contains(err.Error(), socks5Errors[ReplyNotAllowed]) {
+		t.Fatalf("blocked destination got %v, want %q", err, socks5Errors[ReplyNotAllowed])
+	}
+
+	conn, err = client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockstest.AssertEcho(t, conn, 100)
+	conn.Close()
+}
@@ -2,20 +2,28 @@ package socks
 
 import "net"
 
-// Socks5Server implements Socks5 Proxy Protocol(RFC 1928), just support CONNECT command.
+// Socks5Server implements Socks5 Proxy Protocol(RFC 1928). Requests are served by its
+// Socks5Handler, which supports just the CONNECT command by default.
 type Socks5Server struct {
-	forward Dialer
+	opts options
 }
 
-// NewSocks5Server return a new Socks5Server
-func NewSocks5Server(forward Dialer) (*Socks5Server, error) {
-	return &Socks5Server{
-		forward: forward,
-	}, nil
+// NewSocks5Server return a new Socks5Server that serves CONNECT through forward,
+// or through the handler set by WithHandler, in which case forward may be nil.
+func NewSocks5Server(forward Dialer, opts ...Option) (*Socks5Server, error) {
+	s := &Socks5Server{opts: newOptions(opts)}
+	if s.opts.handler == nil {
+		s.opts.handler = ConnectHandler(forward)
+	}
+	if s.opts.authenticators == nil {
+		s.opts.authenticators = []Authenticator{NoAuth}
+	}
+	return s, nil
 }
 
 // Serve with net.Listener for new incoming clients.
 func (s *Socks5Server) Serve(listener net.Listener) error {
+	listener = s.opts.tlsListener(listener)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -26,6 +34,11 @@ func (s *Socks5Server) Serve(listener net.Listener) error {
 			}
 		}
 
-		go serveSocks5Client(conn, s.forward)
+		// Limits are checked here, so that rejected clients don't pile up goroutines.
+		if !s.opts.acquire(conn.RemoteAddr().String()) {
+			s.opts.reject(conn, rejectSocks5Client)
+			continue
+		}
+		go serveSocks5Client(conn, &s.opts)
 	}
 }
@@ -0,0 +1,171 @@
+// Package sockstest provides loopback targets and scripted fake proxy servers
+// for testing code built on package socks without network access.
+//
+// The fake upstreams implement the wire protocols on their own, without using
+// package socks, so they can check its clients independently.
+package sockstest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Server is a loopback TCP server that handles each connection in its own goroutine.
+type Server struct {
+	listener net.Listener
+	handle   func(*Server, net.Conn)
+
+	up   int64
+	down int64
+}
+
+func newServer(handle func(*Server, net.Conn)) *Server {
+	s := listen(handle)
+	go s.serve()
+	return s
+}
+
+// listen returns a Server that is listening but doesn't serve yet.
+func listen(handle func(*Server, net.Conn)) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("sockstest: failed to listen on a port: " + err.Error())
+	}
+	return &Server{
+		listener: listener,
+		handle:   handle,
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			s.handle(s, conn)
+		}()
+	}
+}
+
+// Addr returns the address the server listens on, as host:port.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server from accepting connections. Connections in progress are not interrupted.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// BytesRelayed returns the bytes the server received from and sent to its clients
+// after any proxy handshake.
+func (s *Server) BytesRelayed() (received, sent int64) {
+	return atomic.LoadInt64(&s.up), atomic.LoadInt64(&s.down)
+}
+
+// relay copies data between conn and dest until either side is finished and counts it.
+func (s *Server) relay(conn, dest net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, _ := io.Copy(conn, dest)
+		atomic.AddInt64(&s.down, n)
+		conn.Close()
+		dest.Close()
+	}()
+	n, _ := io.Copy(dest, conn)
+	atomic.AddInt64(&s.up, n)
+	conn.Close()
+	dest.Close()
+	<-done
+}
+
+// bufferedConn reads through the reader that parsed a handshake, so that data sent
+// along with the handshake is relayed too.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NewEchoServer starts a loopback server that writes back everything it reads.
+func NewEchoServer() *Server {
+	return newServer(func(s *Server, conn net.Conn) {
+		n, _ := io.Copy(conn, conn)
+		atomic.AddInt64(&s.up, n)
+		atomic.AddInt64(&s.down, n)
+	})
+}
+
+// NewHTTPServer starts a loopback HTTP server that answers every request with body.
+func NewHTTPServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+}
+
+// CheckEcho writes size random bytes to conn, which must lead to an echo server,
+// and checks that the same bytes are read back.
+func CheckEcho(conn net.Conn, size int) error {
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errc <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("sockstest: read %d bytes of echo: %v", size, err)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, payload) {
+		return errors.New("sockstest: echo does not match the bytes written")
+	}
+	return nil
+}
+
+// AssertEcho is CheckEcho that fails t on error.
+func AssertEcho(t testing.TB, conn net.Conn, size int) {
+	t.Helper()
+	if err := CheckEcho(conn, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AssertRelayed fails t unless s received and sent exactly the given bytes. Since s
+// counts a connection once it is finished, it waits a while for the counts to match.
+func AssertRelayed(t testing.TB, s *Server, received, sent int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, w := s.BytesRelayed()
+		if r == received && w == sent {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sockstest: %s relayed %d bytes received and %d bytes sent, want %d and %d", s.Addr(), r, w, received, sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,335 @@
+package sockstest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Behavior scripts how a fake upstream answers one request.
+type Behavior struct {
+	// Reply is the reply code. Zero means success, which is 0 for SOCKS5, 90 for
+	// SOCKS4 and 200 for HTTP CONNECT. A shadowsocks upstream has no reply, so any
+	// non-zero Reply closes the connection after the request is read.
+	Reply int
+	// Delay is waited after the request is read, before replying.
+	Delay time.Duration
+	// Raw, if not nil, is written instead of the reply and the connection is closed.
+	// Use it to send malformed frames.
+	Raw []byte
+	// Target, if not empty, is dialed instead of the requested destination.
+	Target string
+	// RequireAuth makes a SOCKS5 upstream select USERNAME/PASSWORD authentication.
+	RequireAuth bool
+}
+
+// Request records a request received by a fake upstream.
+type Request struct {
+	Destination string
+	User        string
+	Password    string
+}
+
+// Upstream is a fake proxy server that answers requests as scripted by its Behaviors.
+// The n-th connection uses the n-th Behavior; connections past the end use the last one.
+// After a successful reply, it relays data to the destination.
+type Upstream struct {
+	*Server
+	lock      sync.Mutex
+	behaviors []Behavior
+	conns     int
+	requests  []Request
+}
+
+func newUpstream(serve func(*Upstream, net.Conn, Behavior) error, behaviors []Behavior) *Upstream {
+	if len(behaviors) == 0 {
+		behaviors = []Behavior{{}}
+	}
+	u := &Upstream{behaviors: behaviors}
+	u.Server = listen(func(_ *Server, conn net.Conn) {
+		serve(u, conn, u.nextBehavior())
+	})
+	go u.serve()
+	return u
+}
+
+func (u *Upstream) nextBehavior() Behavior {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	n := u.conns
+	if n >= len(u.behaviors) {
+		n = len(u.behaviors) - 1
+	}
+	u.conns++
+	return u.behaviors[n]
+}
+
+func (u *Upstream) record(r Request) {
+	u.lock.Lock()
+	u.requests = append(u.requests, r)
+	u.lock.Unlock()
+}
+
+// Requests returns the requests received so far.
+func (u *Upstream) Requests() []Request {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]Request(nil), u.requests...)
+}
+
+// answer carries out b for a request to destination and returns the connection to
+// relay to. reply builds the reply for a code, or is nil if the protocol has none.
+func (u *Upstream) answer(conn net.Conn, b Behavior, destination string, reply func(code int) []byte) (net.Conn, error) {
+	time.Sleep(b.Delay)
+	if b.Raw != nil {
+		conn.Write(b.Raw)
+		return nil, errors.New("sockstest: sent raw reply")
+	}
+	if b.Reply != 0 {
+		if reply != nil {
+			conn.Write(reply(b.Reply))
+		}
+		return nil, fmt.Errorf("sockstest: sent failure reply %d", b.Reply)
+	}
+	if b.Target != "" {
+		destination = b.Target
+	}
+	dest, err := net.Dial("tcp", destination)
+	if err != nil {
+		return nil, err
+	}
+	if reply != nil {
+		if _, err := conn.Write(reply(0)); err != nil {
+			dest.Close()
+			return nil, err
+		}
+	}
+	return dest, nil
+}
+
+// NewSocks5Upstream starts a fake SOCKS5 server that supports the CONNECT command.
+func NewSocks5Upstream(behaviors ...Behavior) *Upstream {
+	return newUpstream(serveSocks5, behaviors)
+}
+
+func serveSocks5(u *Upstream, conn net.Conn, b Behavior) error {
+	buff := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buff[:2]); err != nil {
+		return err
+	}
+	methods := buff[1]
+	if _, err := io.ReadFull(conn, buff[:methods]); err != nil {
+		return err
+	}
+	want := byte(0)
+	if b.RequireAuth {
+		want = 2
+	}
+	method := byte(0xff)
+	for _, m := range buff[:methods] {
+		if m == want {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{5, method}); err != nil || method == 0xff {
+		return err
+	}
+
+	var r Request
+	if method == 2 {
+		if _, err := io.ReadFull(conn, buff[:2]); err != nil {
+			return err
+		}
+		user := make([]byte, buff[1])
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buff[:1]); err != nil {
+			return err
+		}
+		password := make([]byte, buff[0])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return err
+		}
+		r.User, r.Password = string(user), string(password)
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.ReadFull(conn, buff[:4]); err != nil {
+		return err
+	}
+	destination, err := readSocksAddr(conn, buff[3])
+	if err != nil {
+		return err
+	}
+	r.Destination = destination
+	u.record(r)
+
+	reply := func(code int) []byte {
+		return []byte{5, byte(code), 0, 1, 127, 0, 0, 1, 0, 0}
+	}
+	if buff[1] != 1 {
+		conn.Write(reply(7))
+		return errors.New("sockstest: unsupported command")
+	}
+	dest, err := u.answer(conn, b, destination, reply)
+	if err != nil {
+		return err
+	}
+	u.relay(conn, dest)
+	return nil
+}
+
+// readSocksAddr reads the address of the given type and the port that follows it,
+// as used by SOCKS5 and shadowsocks.
+func readSocksAddr(r io.Reader, addrType byte) (string, error) {
+	var host string
+	switch addrType {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if addrType == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("sockstest: unknown address type %d", addrType)
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// NewSocks4Upstream starts a fake SOCKS4 server that supports the CONNECT command and SOCKS4a domains.
+func NewSocks4Upstream(behaviors ...Behavior) *Upstream {
+	return newUpstream(serveSocks4, behaviors)
+}
+
+func serveSocks4(u *Upstream, conn net.Conn, b Behavior) error {
+	reader := bufio.NewReader(conn)
+	buff := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return err
+	}
+	user, err := reader.ReadString(0)
+	if err != nil {
+		return err
+	}
+	host := net.IP(buff[4:8]).String()
+	if buff[4] == 0 && buff[5] == 0 && buff[6] == 0 && buff[7] != 0 {
+		domain, err := reader.ReadString(0)
+		if err != nil {
+			return err
+		}
+		host = domain[:len(domain)-1]
+	}
+	destination := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buff[2:4]))))
+	u.record(Request{Destination: destination, User: user[:len(user)-1]})
+
+	reply := func(code int) []byte {
+		if code == 0 {
+			code = 90
+		}
+		return []byte{0, byte(code), 0, 0, 0, 0, 0, 0}
+	}
+	if buff[1] != 1 {
+		conn.Write(reply(91))
+		return errors.New("sockstest: unsupported command")
+	}
+	dest, err := u.answer(conn, b, destination, reply)
+	if err != nil {
+		return err
+	}
+	u.relay(&bufferedConn{Conn: conn, reader: reader}, dest)
+	return nil
+}
+
+// NewShadowSocksUpstream starts a fake shadowsocks server without encryption,
+// the counterpart of a ShadowSocksClient whose forward does no encryption.
+func NewShadowSocksUpstream(behaviors ...Behavior) *Upstream {
+	return newUpstream(serveShadowSocks, behaviors)
+}
+
+func serveShadowSocks(u *Upstream, conn net.Conn, b Behavior) error {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(conn, addrType); err != nil {
+		return err
+	}
+	destination, err := readSocksAddr(conn, addrType[0])
+	if err != nil {
+		return err
+	}
+	u.record(Request{Destination: destination})
+	dest, err := u.answer(conn, b, destination, nil)
+	if err != nil {
+		return err
+	}
+	u.relay(conn, dest)
+	return nil
+}
+
+// NewHTTPConnectUpstream starts a fake HTTP proxy that supports the CONNECT method.
+func NewHTTPConnectUpstream(behaviors ...Behavior) *Upstream {
+	return newUpstream(serveHTTPConnect, behaviors)
+}
+
+func serveHTTPConnect(u *Upstream, conn net.Conn, b Behavior) error {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	var r Request
+	r.Destination = request.Host
+	r.User, r.Password, _ = parseProxyAuthorization(request)
+	u.record(r)
+
+	reply := func(code int) []byte {
+		if code == 0 {
+			code = http.StatusOK
+		}
+		return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code)))
+	}
+	if request.Method != http.MethodConnect {
+		conn.Write(reply(http.StatusMethodNotAllowed))
+		return errors.New("sockstest: unsupported method " + request.Method)
+	}
+	dest, err := u.answer(conn, b, request.Host, reply)
+	if err != nil {
+		return err
+	}
+	u.relay(&bufferedConn{Conn: conn, reader: reader}, dest)
+	return nil
+}
+
+func parseProxyAuthorization(request *http.Request) (string, string, bool) {
+	auth := request.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return r.BasicAuth()
+}
@@ -0,0 +1,150 @@
+package socks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// WithTLSConfig makes Socks4Server, Socks5Server, WebSocketListener and MuxListener
+// accept TLS on their listeners, and Socks4Client, Socks5Client, WebSocketClient and
+// MuxClient connect over TLS. Clients send the host
+// of the proxy address as SNI unless config.ServerName is set. If config makes servers
+// verify client certificates, the CertificateIdentity of the client becomes the user
+// of the session unless the client authenticated with SOCKS5.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithCertificatePins makes clients accept the certificate of their proxy only if one of
+// pins is its CertificatePin. This check comes in addition to the verification of the
+// TLS config, and replaces it if InsecureSkipVerify is set.
+func WithCertificatePins(pins ...[]byte) Option {
+	return func(o *options) {
+		o.pins = append(o.pins, pins...)
+	}
+}
+
+// CertificatePin returns the SHA-256 hash of the SubjectPublicKeyInfo of cert, which
+// stays the same when a certificate is renewed with the same key.
+func CertificatePin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// tlsListener returns listener, serving TLS if a config was set.
+func (o *options) tlsListener(listener net.Listener) net.Listener {
+	if o.tlsConfig == nil {
+		return listener
+	}
+	return tls.NewListener(listener, o.tlsConfig)
+}
+
+// clientTLS runs the TLS handshake with the proxy at address over conn if a config was set.
+func (o *options) clientTLS(conn net.Conn, address string) (net.Conn, error) {
+	if o.tlsConfig == nil {
+		return conn, nil
+	}
+	config := o.tlsConfig.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if len(o.pins) != 0 {
+		verify := config.VerifyPeerCertificate
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			return checkPins(rawCerts, o.pins)
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.New("socks: TLS handshake with " + address + " failed: " + err.Error())
+	}
+	return tlsConn, nil
+}
+
+func checkPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("socks: no certificate to check pins")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	pin := CertificatePin(cert)
+	for _, p := range pins {
+		if bytes.Equal(p, pin) {
+			return nil
+		}
+	}
+	return errors.New("socks: certificate of " + cert.Subject.CommonName + " matches no pin")
+}
+
+// CertificateIdentity returns the identity a client certificate authenticates: its subject
+// common name, or if that is empty its first DNS name, email address, URI or IP address.
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) != 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) != 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) != 0:
+		return cert.URIs[0].String()
+	case len(cert.IPAddresses) != 0:
+		return cert.IPAddresses[0].String()
+	}
+	return ""
+}
+
+// peerIdentity returns the CertificateIdentity of the client certificate of state, empty
+// if there is no state or the client sent no certificate.
+func peerIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return CertificateIdentity(state.PeerCertificates[0])
+}
+
+// tlsStateConn is a connection that knows the state of the TLS connection carrying it:
+// a *tls.Conn, or a WebSocket connection or mux stream served by a TLS listener.
+type tlsStateConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// connectionState returns the TLS state of the connection carrying conn, the zero state
+// if there is none.
+func connectionState(conn net.Conn) tls.ConnectionState {
+	if c, ok := conn.(tlsStateConn); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// tlsIdentity completes the handshake of conn if it is a TLS connection, and returns
+// the identity of the client certificate of the TLS connection carrying conn, empty if
+// there is none.
+func tlsIdentity(conn net.Conn) (string, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return "", errors.New("socks: TLS handshake failed: " + err.Error())
+		}
+	}
+	state := connectionState(conn)
+	return peerIdentity(&state), nil
+}
@@ -0,0 +1,245 @@
+package socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+// newTestCertificate returns a certificate for 127.0.0.1 named cn, signed by parent,
+// or self-signed CA if parent is nil.
+func newTestCertificate(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// startSocks5Server starts a Socks5Server dialing directly and returns its listener.
+func startSocks5Server(t *testing.T, opts ...Option) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSocks5Server(Direct, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return listener
+}
+
+func TestSocks5ClientTLS(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	cert := newTestCertificate(t, "proxy", nil)
+	other := newTestCertificate(t, "other", nil)
+	listener := startSocks5Server(t, WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer listener.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	tests := []struct {
+		name string
+		opts []Option
+		err  string
+	}{
+		{"verified", []Option{WithTLSConfig(&tls.Config{RootCAs: roots})}, ""},
+		{"unknown authority", []Option{WithTLSConfig(&tls.Config{})}, "certificate"},
+		{"pinned", []Option{WithTLSConfig(&tls.Config{InsecureSkipVerify: true}), WithCertificatePins(CertificatePin(cert.Leaf))}, ""},
+		{"wrong pin", []Option{WithTLSConfig(&tls.Config{RootCAs: roots}), WithCertificatePins(CertificatePin(other.Leaf))}, "matches no pin"},
+	}
+	for _, test := range tests {
+		client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := client.Dial("tcp", echo.Addr())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		sockstest.AssertEcho(t, conn, 1000)
+		conn.Close()
+	}
+}
+
+func TestSocks5ServerClientCertificate(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "proxy", &ca)
+	clientCert := newTestCertificate(t, "machine-1", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	users := make(chan string, 1)
+	connect := ConnectHandler(Direct)
+	listener := startSocks5Server(t,
+		WithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}),
+		WithHandler(Socks5HandlerFunc(func(r *Socks5Request) {
+			users <- r.User
+			connect.ServeSocks5(r)
+		})))
+	defer listener.Close()
+
+	client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct,
+		WithTLSConfig(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", echo.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := <-users; user != "machine-1" {
+		t.Fatalf("server got user %q, want machine-1", user)
+	}
+	sockstest.AssertEcho(t, conn, 100)
+	conn.Close()
+
+	client, err = NewSocks5Client("tcp", listener.Addr().String(), "", "", Direct,
+		WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := client.Dial("tcp", echo.Addr()); err == nil {
+		conn.Close()
+		t.Fatal("client without certificate was served")
+	}
+}
+
+// TestClientCertificateThroughTunnels checks that sessions carried by listeners that
+// terminate TLS themselves still get the identity of the client certificate.
+func TestClientCertificateThroughTunnels(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "proxy", &ca)
+	clientCert := newTestCertificate(t, "machine-1", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverTLS := WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	clientTLS := WithTLSConfig(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+
+	tests := []struct {
+		name      string
+		listen    func(net.Listener) net.Listener
+		transport func() (Dialer, error)
+	}{
+		{
+			name:   "websocket",
+			listen: func(l net.Listener) net.Listener { return NewWebSocketListener(l, "/", serverTLS) },
+			transport: func() (Dialer, error) {
+				return NewWebSocketClient("/", "", Direct, clientTLS)
+			},
+		},
+		{
+			name:   "mux",
+			listen: func(l net.Listener) net.Listener { return NewMuxListener(l, MuxConfig{}, serverTLS) },
+			transport: func() (Dialer, error) {
+				return NewMuxClient(Direct, MuxConfig{}, clientTLS), nil
+			},
+		},
+		{
+			name: "mux over websocket",
+			listen: func(l net.Listener) net.Listener {
+				return NewMuxListener(NewWebSocketListener(l, "/", serverTLS), MuxConfig{})
+			},
+			transport: func() (Dialer, error) {
+				ws, err := NewWebSocketClient("/", "", Direct, clientTLS)
+				return NewMuxClient(ws, MuxConfig{}), err
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := test.listen(raw)
+			defer listener.Close()
+			users := make(chan string, 1)
+			connect := ConnectHandler(Direct)
+			server, err := NewSocks5Server(nil, WithHandler(Socks5HandlerFunc(func(r *Socks5Request) {
+				users <- r.User
+				connect.ServeSocks5(r)
+			})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(listener)
+
+			transport, err := test.transport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewSocks5Client("tcp", raw.Addr().String(), "", "", transport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := client.Dial("tcp", echo.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if user := <-users; user != "machine-1" {
+				t.Fatalf("server got user %q, want machine-1", user)
+			}
+			sockstest.AssertEcho(t, conn, 100)
+		})
+	}
+}
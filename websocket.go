@@ -0,0 +1,454 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// webSocketHandshakeTimeout bounds the opening handshake on both sides.
+	webSocketHandshakeTimeout = 10 * time.Second
+)
+
+// WebSocketClient implements Dialer by opening a WebSocket (RFC 6455) connection to the
+// dialed address and carrying the stream in binary messages. Use it as the forward of
+// another client to tunnel that client's proxy protocol through HTTP(S) infrastructure.
+type WebSocketClient struct {
+	path    string
+	host    string
+	forward Dialer
+	opts    options
+}
+
+// NewWebSocketClient returns a WebSocketClient that requests path, "/" if empty. host is
+// sent as the Host header, the dialed address if empty, which allows CDN fronting. The
+// connection is wss if the options include WithTLSConfig.
+func NewWebSocketClient(path, host string, forward Dialer, opts ...Option) (*WebSocketClient, error) {
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("socks: WebSocket path must start with /: " + path)
+	}
+	return &WebSocketClient{
+		path:    path,
+		host:    host,
+		forward: forward,
+		opts:    newOptions(opts),
+	}, nil
+}
+
+// Dial connects to the WebSocket server at address.
+func (w *WebSocketClient) Dial(network, address string) (net.Conn, error) {
+	return w.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial with a context, which is passed on to the forward Dialer.
+func (w *WebSocketClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := DialContext(ctx, w.forward, network, address)
+	if err != nil {
+		return nil, err
+	}
+	wsConn, err := w.handshake(conn, address)
+	if err != nil {
+		conn.Close()
+		w.opts.logger.Debug("websocket dial failed", "address", address, "error", err)
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+func (w *WebSocketClient) handshake(conn net.Conn, address string) (net.Conn, error) {
+	conn, err := w.opts.clientTLS(conn, address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	host := w.host
+	if host == "" {
+		host = address
+	}
+	request := "GET " + w.path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		return nil, errors.New("socks: failed to write WebSocket handshake: " + err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, errors.New("socks: failed to read WebSocket handshake: " + err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("socks: WebSocket server at " + address + " answered " + response.Status)
+	}
+	if !headerContains(response.Header, "Upgrade", "websocket") || !headerContains(response.Header, "Connection", "upgrade") {
+		return nil, errors.New("socks: WebSocket server at " + address + " didn't upgrade the connection")
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("socks: WebSocket server at " + address + " sent a wrong Sec-WebSocket-Accept")
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+// WebSocketListener accepts WebSocket connections on a net.Listener. The opening
+// handshakes run in the background, so a slow client doesn't hold up others.
+type WebSocketListener struct {
+	listener net.Listener
+	path     string
+	opts     options
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+// NewWebSocketListener returns a listener that accepts WebSocket upgrades for path on
+// listener, "/" if empty, and returns them as connections carrying binary messages.
+// Requests for other paths get 404 Not Found. With WithTLSConfig, it serves wss.
+func NewWebSocketListener(listener net.Listener, path string, opts ...Option) *WebSocketListener {
+	if path == "" {
+		path = "/"
+	}
+	l := &WebSocketListener{
+		listener: listener,
+		path:     path,
+		opts:     newOptions(opts),
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.serve(l.opts.tlsListener(listener))
+	return l
+}
+
+func (l *WebSocketListener) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			l.close(err)
+			return
+		}
+		go func() {
+			wsConn, err := l.handshake(conn)
+			if err != nil {
+				conn.Close()
+				l.opts.logger.Debug("websocket handshake failed", "client", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			select {
+			case l.conns <- wsConn:
+			case <-l.done:
+				wsConn.Close()
+			}
+		}()
+	}
+}
+
+func (l *WebSocketListener) handshake(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(code int, reason string) (net.Conn, error) {
+		io.WriteString(conn, "HTTP/1.1 "+strconv.Itoa(code)+" "+http.StatusText(code)+"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("socks: bad WebSocket request for " + request.URL.Path + ": " + reason)
+	}
+	if request.URL.Path != l.path {
+		return fail(http.StatusNotFound, "unknown path")
+	}
+	if request.Method != http.MethodGet || !headerContains(request.Header, "Upgrade", "websocket") ||
+		!headerContains(request.Header, "Connection", "upgrade") {
+		return fail(http.StatusBadRequest, "not an upgrade request")
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return fail(http.StatusBadRequest, "unsupported version "+request.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return fail(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		return nil, err
+	}
+	return newWebSocketConn(conn, reader, false), nil
+}
+
+// Accept waits for the next WebSocket connection.
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener.
+func (l *WebSocketListener) Close() error {
+	return l.close(errors.New("socks: WebSocket listener closed"))
+}
+
+// close closes the underlying listener once, making Accept return reason.
+func (l *WebSocketListener) close(reason error) error {
+	var err error
+	l.once.Do(func() {
+		l.err = reason
+		close(l.done)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the address of the underlying listener.
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether the comma separated values of header name include
+// value, ignoring case.
+func headerContains(header http.Header, name, value string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn carries a byte stream in WebSocket binary messages. Each Write sends
+// one frame; Read returns the payload of data frames in order, answering pings.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool
+
+	writeLock sync.Mutex
+	closed    bool
+
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+}
+
+// ConnectionState returns the state of the TLS connection carrying the WebSocket
+// connection, the zero state if it isn't carried by TLS.
+func (c *webSocketConn) ConnectionState() tls.ConnectionState {
+	return connectionState(c.Conn)
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+		client: client,
+	}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *webSocketConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for n := range p {
+		p[n] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextDataFrame reads frame headers, handling control frames, until a data frame starts.
+func (c *webSocketConn) nextDataFrame() error {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		if header[0]&0x70 != 0 {
+			return errors.New("socks: WebSocket frame has reserved bits set")
+		}
+		masked := header[1]&0x80 != 0
+		if masked == c.client {
+			return errors.New("socks: WebSocket frame masking is wrong for its direction")
+		}
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, b); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(b))
+		case 127:
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, b); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(b)
+			if length>>63 != 0 {
+				return errors.New("socks: WebSocket frame too long")
+			}
+		}
+		c.masked = masked
+		c.maskPos = 0
+		if masked {
+			if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+			c.remaining = length
+			return nil
+		case wsClose, wsPing, wsPong:
+			if length > 125 || header[0]&0x80 == 0 {
+				return errors.New("socks: invalid WebSocket control frame")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.reader, payload); err != nil {
+				return err
+			}
+			c.unmask(payload)
+			switch opcode {
+			case wsClose:
+				c.writeFrame(wsClose, payload)
+				return io.EOF
+			case wsPing:
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			return errors.New("socks: unknown WebSocket opcode " + strconv.Itoa(int(opcode)))
+		}
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes payload as one final frame, masked if c is the client side.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+	start := len(frame)
+	if c.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start = len(frame)
+		frame = append(frame, payload...)
+		for n := range frame[start:] {
+			frame[start+n] ^= mask[n&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return errors.New("socks: WebSocket connection closed")
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame and closes the connection.
+func (c *webSocketConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,70 @@
+package socks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/eahydra/socks/sockstest"
+)
+
+func TestWebSocketTunnel(t *testing.T) {
+	echo := sockstest.NewEchoServer()
+	defer echo.Close()
+
+	cert := newTestCertificate(t, "proxy", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	tests := []struct {
+		name       string
+		serverOpts []Option
+		clientOpts []Option
+	}{
+		{name: "ws"},
+		{
+			name:       "wss",
+			serverOpts: []Option{WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})},
+			clientOpts: []Option{WithTLSConfig(&tls.Config{RootCAs: roots})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := NewWebSocketListener(raw, "/tunnel", test.serverOpts...)
+			defer listener.Close()
+			server, err := NewSocks5Server(Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(listener)
+
+			ws, err := NewWebSocketClient("/tunnel", "cdn.example.com", Direct, test.clientOpts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewSocks5Client("tcp", listener.Addr().String(), "", "", ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := client.Dial("tcp", echo.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sockstest.AssertEcho(t, conn, 200000)
+			conn.Close()
+
+			wrongPath, err := NewWebSocketClient("/other", "", Direct, test.clientOpts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wrongPath.Dial("tcp", listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "404") {
+				t.Fatalf("got %v, want 404", err)
+			}
+		})
+	}
+}